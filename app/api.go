@@ -22,29 +22,261 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/ossrs/go-oryx/core"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// the status of server for /api/v1/status.
+type ApiStatus struct {
+	State string `json:"state"`
+	// the version with git commit and build date.
+	Version string `json:"version"`
+	// the seconds since run, 0 when not running.
+	Uptime     int64        `json:"uptime"`
+	Workers    []WorkerInfo `json:"workers"`
+	GoMaxProcs int          `json:"gomaxprocs"`
+	Heartbeat  struct {
+		Enabled     bool      `json:"enabled"`
+		Failures    int       `json:"failures"`
+		LastSuccess time.Time `json:"last_success"`
+		LastError   string    `json:"last_error"`
+	} `json:"heartbeat"`
+}
+
+// the status of server, safe for user to poll.
+func (s *Server) Status() *ApiStatus {
+	v := &ApiStatus{}
+
+	v.State = ServerState(atomic.LoadInt32(&s.state)).String()
+	v.Version = core.FullVersion()
+	v.Uptime = int64(s.Uptime() / time.Second)
+	v.Workers = s.Workers()
+	v.GoMaxProcs = s.gomaxprocs(0)
+
+	v.Heartbeat.Enabled = s.config().Heartbeat.Enabled
+	v.Heartbeat.Failures = s.htbt.Failures()
+	v.Heartbeat.LastSuccess = s.htbt.LastSuccess()
+	if err := s.htbt.LastError(); err != nil {
+		v.Heartbeat.LastError = err.Error()
+	}
+
+	return v
+}
+
+// the timeout for api to shutdown when quit.
+var apiShutdownTimeout = 3 * time.Second
+
 type Summary struct {
 	Ok   bool  `json:"ok"`
 	Now  int64 `json:"now_ms"`
 	Self struct {
-		Version string `json:"version"`
-		Pid     int64  `json:"pid"`
-		Ppid    int64  `json:"ppid"`
+		Version   string `json:"version"`
+		GitCommit string `json:"git_commit"`
+		BuildDate string `json:"build_date"`
+		Pid       int64  `json:"pid"`
+		Ppid      int64  `json:"ppid"`
 	} `json:"self"`
+	Config *ConfigInfo `json:"config"`
 }
 
-func NewSummary() *Summary {
+// the summary of process, the config info is of c.
+func NewSummary(c *Config) *Summary {
 	s := &Summary{}
 
 	s.Now = time.Now().UnixNano() / int64(time.Millisecond)
 
 	s.Self.Version = core.Version()
+	s.Self.GitCommit = core.GitCommit
+	s.Self.BuildDate = core.BuildDate
 	s.Self.Pid = int64(os.Getpid())
 	s.Self.Ppid = int64(os.Getppid())
 
+	s.Config = c.Info()
+
 	return s
 }
+
+// the prefix of api.listen for unix domain socket, for example, unix:/var/run/oryx.sock
+const apiUnixPrefix = "unix:"
+
+// listen the api at addr, the tcp host:port or unix:path,
+// for unix domain socket, remove the stale socket file and create it in perm.
+func listenApi(addr string, perm os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(addr, apiUnixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	name := strings.TrimPrefix(addr, apiUnixPrefix)
+
+	// the stale socket file of crashed process, never remove the file in use or not socket.
+	if fi, err := os.Lstat(name); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(fmt.Sprintf("api socket %v exists and not socket", name))
+		}
+		if c, err := net.Dial("unix", name); err == nil {
+			c.Close()
+			return nil, errors.New(fmt.Sprintf("api socket %v is in use", name))
+		}
+		if err := os.Remove(name); err != nil {
+			return nil, errors.New(fmt.Sprintf("remove stale api socket %v failed, err is %v", name, err))
+		}
+		core.Trace.Println("remove stale api socket", name)
+	}
+
+	l, err := net.Listen("unix", name)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(name, perm); err != nil {
+		l.Close()
+		return nil, errors.New(fmt.Sprintf("chmod api socket %v to %v failed, err is %v", name, perm, err))
+	}
+	return l, nil
+}
+
+// remove the socket file of api unix domain socket when closed, ignore tcp.
+func removeApiSocket(l net.Listener) {
+	if l.Addr().Network() != "unix" {
+		return
+	}
+
+	name := l.Addr().String()
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		core.Warn.Println("remove api socket", name, "failed, err is", err)
+	}
+}
+
+// serve the api on the listener opened by initialize,
+// shutdown when quit, wait for the active requests in apiShutdownTimeout.
+func (s *Server) apiCycle(w WorkerContainer) {
+	ctx := w.Context()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.serveStatus)
+	mux.HandleFunc("/api/v1/status", s.serveApiStatus)
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	mux.HandleFunc("/healthz", s.serveHealthz)
+	mux.HandleFunc("/readyz", s.serveReadyz)
+	mux.HandleFunc("/api/v1/logs/tail", s.serveLogTail)
+	mux.HandleFunc("/api/v1/config", s.serveConfig)
+	mux.HandleFunc("/api/v1/reloads", s.serveReloads)
+	mux.HandleFunc("/api/v1/stats", s.serveStats)
+	srv := &http.Server{Handler: mux}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(s.apiListener)
+	}()
+	core.Ctx(ctx, core.Trace).Println("api listen at", s.apiListener.Addr())
+
+	select {
+	case <-w.QC():
+		w.Quit()
+
+		sctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			core.Ctx(ctx, core.Warn).Println("api shutdown failed, err is", err)
+		}
+	case err := <-done:
+		core.Ctx(ctx, core.Error).Println("api serve failed, err is", err)
+	}
+}
+
+// the cheap status for lb health check, without lock,
+// response 200 when ready to serve, otherwise 503.
+func (s *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	state := ServerState(atomic.LoadInt32(&s.state))
+	ready := s.Ready()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, `{"state":"%v","version":"%v","ready":%v}`, state, core.Version(), ready)
+}
+
+// the status of server, for the readiness probe and introspection,
+// response 200 when ready to serve, otherwise 503.
+func (s *Server) serveApiStatus(w http.ResponseWriter, r *http.Request) {
+	v := s.Status()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !s.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// the metrics in prometheus text format.
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.WriteTo(w)
+}
+
+// the last log lines, the oldest first, at most log.tail_size lines,
+// the query n to get the last n lines, for example, /api/v1/logs/tail?n=10
+// response 404 when log tail disabled.
+func (s *Server) serveLogTail(w http.ResponseWriter, r *http.Request) {
+	if s.config().Log.TailSize <= 0 {
+		http.Error(w, "log tail disabled", http.StatusNotFound)
+		return
+	}
+
+	lines := s.logger.tail.last()
+	if n, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && n >= 0 && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Lines []string `json:"lines"`
+	}{lines})
+}
+
+// the info of the current config file, the path, mod time and load time.
+func (s *Server) serveConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.ConfigInfo())
+}
+
+// the stats of server, the panics and restarts of workers, the features and config.
+func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Stats())
+}
+
+// the recent reloads, the oldest first, see reload.history.
+func (s *Server) serveReloads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Reloads []ReloadRecord `json:"reloads"`
+	}{s.ReloadHistory()})
+}
+
+// the liveness probe, response 200 unless closed, otherwise 503.
+func (s *Server) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	serveProbe(w, s.Live())
+}
+
+// the readiness probe, response 200 when ready to serve, otherwise 503.
+func (s *Server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	serveProbe(w, s.Ready())
+}
+
+func serveProbe(w http.ResponseWriter, ok bool) {
+	if !ok {
+		http.Error(w, "not ok", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
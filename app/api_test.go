@@ -0,0 +1,427 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx/core"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApiStatus(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	defer svr.Close()
+
+	f := writeTestConfig(t, `{"api": {"listen": "127.0.0.1:0"}}`)
+	if err := svr.ParseConfig(f); err != nil {
+		t.Fatal("parse config failed, err is", err)
+	}
+	if err := svr.Initialize(); err != nil {
+		t.Fatal("initialize failed, err is", err)
+	}
+
+	status := func() (code int, v map[string]interface{}) {
+		r, err := http.Get(fmt.Sprintf("http://%v/status", svr.apiListener.Addr()))
+		if err != nil {
+			t.Fatal("get status failed, err is", err)
+		}
+		defer r.Body.Close()
+
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			t.Fatal("decode status failed, err is", err)
+		}
+		return r.StatusCode, v
+	}
+
+	if code, v := status(); code != http.StatusServiceUnavailable || v["state"] != "ready" || v["ready"] != false || len(v) != 3 {
+		t.Error("should not ready before run, actual is", code, v)
+	}
+
+	running := make(chan bool)
+	svr.Hook(HookAfterRunning, func() error {
+		close(running)
+		return nil
+	})
+	go svr.Run()
+	<-running
+	waitReady(t, svr)
+
+	if code, v := status(); code != http.StatusOK || v["state"] != "running" || v["ready"] != true || len(v["version"].(string)) == 0 {
+		t.Error("should ready when run, actual is", code, v)
+	}
+}
+
+func TestApiServerStatus(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	defer svr.Close()
+
+	f := writeTestConfig(t, `{"api": {"listen": "127.0.0.1:0"}}`)
+	if err := svr.ParseConfig(f); err != nil {
+		t.Fatal("parse config failed, err is", err)
+	}
+	if err := svr.Initialize(); err != nil {
+		t.Fatal("initialize failed, err is", err)
+	}
+
+	running := make(chan bool)
+	svr.Hook(HookAfterRunning, func() error {
+		close(running)
+		return nil
+	})
+	go svr.Run()
+	<-running
+	waitReady(t, svr)
+
+	r, err := http.Get(fmt.Sprintf("http://%v/api/v1/status", svr.apiListener.Addr()))
+	if err != nil {
+		t.Fatal("get status failed, err is", err)
+	}
+	defer r.Body.Close()
+
+	var v ApiStatus
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		t.Fatal("decode status failed, err is", err)
+	}
+	if r.StatusCode != http.StatusOK || v.State != "running" || v.Version != core.FullVersion() || v.GoMaxProcs <= 0 || v.Heartbeat.Enabled {
+		t.Error("invalid status", r.StatusCode, v)
+	}
+
+	names := map[string]bool{}
+	for _, w := range v.Workers {
+		names[w.Name] = true
+	}
+	if !names["api"] || !names["htbt(main)"] {
+		t.Error("should list the workers, actual is", v.Workers)
+	}
+
+	// the api quit with server.
+	svr.Close()
+	if _, err := http.Get(fmt.Sprintf("http://%v/api/v1/status", svr.apiListener.Addr())); err == nil {
+		t.Error("api should shutdown when quit")
+	}
+}
+
+// wait for the server ready after run.
+func waitReady(t *testing.T, svr *Server) {
+	for i := 0; i < 100 && !svr.Ready(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !svr.Ready() {
+		t.Fatal("server not ready")
+	}
+}
+
+func TestApiProbes(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	defer svr.Close()
+
+	f := writeTestConfig(t, `{"api": {"listen": "127.0.0.1:0"}}`)
+	if err := svr.ParseConfig(f); err != nil {
+		t.Fatal("parse config failed, err is", err)
+	}
+	if err := svr.Initialize(); err != nil {
+		t.Fatal("initialize failed, err is", err)
+	}
+
+	probe := func(p string) int {
+		r, err := http.Get(fmt.Sprintf("http://%v%v", svr.apiListener.Addr(), p))
+		if err != nil {
+			t.Fatal("get", p, "failed, err is", err)
+		}
+		r.Body.Close()
+		return r.StatusCode
+	}
+
+	if !svr.Live() || svr.Ready() || probe("/healthz") != http.StatusOK || probe("/readyz") != http.StatusServiceUnavailable {
+		t.Error("should live but not ready before run")
+	}
+
+	go svr.Run()
+	waitReady(t, svr)
+	if probe("/healthz") != http.StatusOK || probe("/readyz") != http.StatusOK {
+		t.Error("should live and ready when run")
+	}
+
+	svr.Close()
+	if svr.Live() || svr.Ready() {
+		t.Error("should not live or ready when closed")
+	}
+}
+
+func TestApiLogTail(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	defer svr.Close()
+
+	w := httptest.NewRecorder()
+	svr.serveLogTail(w, httptest.NewRequest("GET", "/api/v1/logs/tail", nil))
+	if w.Code != http.StatusNotFound {
+		t.Error("should 404 when disabled, actual is", w.Code)
+	}
+
+	GetConfig().Log.TailSize = 10
+	svr.logger.tail.resize(10)
+	for _, v := range []string{"a", "b", "c"} {
+		svr.logger.tail.append(v)
+	}
+
+	w = httptest.NewRecorder()
+	svr.serveLogTail(w, httptest.NewRequest("GET", "/api/v1/logs/tail?n=2", nil))
+	if v := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || v != `{"lines":["b","c"]}` {
+		t.Error("should tail the last lines, actual is", w.Code, v)
+	}
+}
+
+func TestApiConfig(t *testing.T) {
+	defer restoreGlobals()()
+
+	f := writeTestConfig(t, `{"workers": 1}`)
+	c := NewConfig()
+	if err := c.Loads(f); err != nil {
+		t.Fatal("loads failed, err is", err)
+	}
+
+	svr := NewServerWithConfig(c)
+	defer svr.Close()
+
+	w := httptest.NewRecorder()
+	svr.serveConfig(w, httptest.NewRequest("GET", "/api/v1/config", nil))
+
+	var v ConfigInfo
+	if err := json.NewDecoder(w.Body).Decode(&v); err != nil {
+		t.Fatal("decode config failed, err is", err)
+	}
+	if ci := c.Info(); w.Code != http.StatusOK || v.Path != f || !v.ModTime.Equal(ci.ModTime) || !v.LoadTime.Equal(ci.LoadTime) {
+		t.Error("invalid config info", w.Code, v)
+	}
+}
+
+func TestApiStats(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	pb := workerRestartBackoff
+	defer func() {
+		workerRestartBackoff = pb
+	}()
+	workerRestartBackoff = time.Millisecond
+
+	svr := NewServer()
+	defer svr.Close()
+
+	// panic twice then run until quit.
+	var runs int
+	running := make(chan bool)
+	svr.GForkRestart("flaky", 5, func(wc WorkerContainer) {
+		if runs++; runs <= 2 {
+			panic("flaky")
+		}
+		close(running)
+		<-wc.QC()
+		wc.Quit()
+	})
+	<-running
+
+	w := httptest.NewRecorder()
+	svr.serveStats(w, httptest.NewRequest("GET", "/api/v1/stats", nil))
+
+	var v ServerStats
+	if err := json.NewDecoder(w.Body).Decode(&v); err != nil {
+		t.Fatal("decode stats failed, err is", err)
+	}
+	if w.Code != http.StatusOK || v.Workers != 1 || v.Panics != 2 || v.Restarts["flaky"] != 2 || v.Config == nil {
+		t.Error("invalid stats", w.Code, v)
+	}
+
+	svr.Quit()
+	svr.waitWorkers()
+}
+
+func TestApiReloads(t *testing.T) {
+	defer restoreGlobals()()
+
+	f := writeTestConfig(t, `{"workers": 1}`)
+	SetConfig(NewConfig())
+	if err := GetConfig().Loads(f); err != nil {
+		t.Fatal("loads failed, err is", err)
+	}
+
+	svr := NewServer()
+	defer svr.Close()
+
+	reloads := func() (v []ReloadRecord) {
+		w := httptest.NewRecorder()
+		svr.serveReloads(w, httptest.NewRequest("GET", "/api/v1/reloads", nil))
+
+		var r struct {
+			Reloads []ReloadRecord `json:"reloads"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&r); err != nil || w.Code != http.StatusOK {
+			t.Fatal("get reloads failed, code is", w.Code, "err is", err)
+		}
+		return r.Reloads
+	}
+
+	if v := reloads(); len(v) != 0 {
+		t.Error("should no reloads, actual is", v)
+	}
+
+	if err := ioutil.WriteFile(f, []byte(`{"workers": 1, "log": {"level": "warn", "tank": "console"}}`), 0644); err != nil {
+		t.Fatal("write config failed, err is", err)
+	}
+	if err := svr.reload(); err != nil {
+		t.Fatal("reload failed, err is", err)
+	}
+	if err := ioutil.WriteFile(f, []byte(`{"workers": -1}`), 0644); err != nil {
+		t.Fatal("write config failed, err is", err)
+	}
+	if err := svr.reload(); err == nil {
+		t.Fatal("reload should failed")
+	}
+
+	v := reloads()
+	if len(v) != 2 || !v[0].Ok || len(v[0].Scopes) != 1 || v[0].Scopes[0] != "log" {
+		t.Fatal("invalid reloads", v)
+	}
+	if r := v[1]; r.Ok || len(r.Error) == 0 || !r.Time.Equal(svr.ReloadHistory()[1].Time) {
+		t.Error("invalid failed reload", r)
+	}
+}
+
+func TestApiUnixSocketInitFailed(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	// the pid file in a regular file as dir, fail to write.
+	dir := t.TempDir()
+	sock, pid := path.Join(dir, "oryx.sock"), path.Join(dir, "file", "oryx.pid")
+	if err := ioutil.WriteFile(path.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal("write file failed, err is", err)
+	}
+
+	svr := NewServer()
+	defer svr.Close()
+
+	f := writeTestConfig(t, fmt.Sprintf(`{"pid_file": "%v", "api": {"listen": "unix:%v"}}`, pid, sock))
+	if err := svr.ParseConfig(f); err != nil {
+		t.Fatal("parse config failed, err is", err)
+	}
+	if err := svr.Initialize(); err == nil {
+		t.Fatal("initialize should fail for pid file")
+	}
+
+	// never leave the listener and socket file when initialize failed.
+	if svr.apiListener != nil {
+		t.Error("should not listen api when initialize failed")
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Error("should not leave the socket file, err is", err)
+	}
+}
+
+func TestApiUnixSocket(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	// the stale socket file of crashed process.
+	sock := path.Join(t.TempDir(), "oryx.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal("listen failed, err is", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	svr := NewServer()
+	defer svr.Close()
+
+	f := writeTestConfig(t, fmt.Sprintf(`{"api": {"listen": "unix:%v", "socket_perm": "0600"}}`, sock))
+	if err := svr.ParseConfig(f); err != nil {
+		t.Fatal("parse config failed, err is", err)
+	}
+	if err := svr.Initialize(); err != nil {
+		t.Fatal("initialize failed, err is", err)
+	}
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0600 {
+		t.Error("should create socket in perm, actual is", fi, err)
+	}
+
+	running := make(chan bool)
+	svr.Hook(HookAfterRunning, func() error {
+		close(running)
+		return nil
+	})
+	go svr.Run()
+	<-running
+	waitReady(t, svr)
+
+	c := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial("unix", sock)
+	}}}
+	r, err := c.Get("http://oryx/healthz")
+	if err != nil {
+		t.Fatal("get over unix socket failed, err is", err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		t.Error("invalid status", r.StatusCode)
+	}
+
+	// never listen at the socket in use.
+	if _, err := listenApi("unix:"+sock, 0600); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Error("should reject the socket in use, err is", err)
+	}
+
+	svr.Close()
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Error("should remove the socket when close, err is", err)
+	}
+
+	// never remove the file not socket.
+	if err := ioutil.WriteFile(sock, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenApi("unix:"+sock, 0600); err == nil || !strings.Contains(err.Error(), "not socket") {
+		t.Error("should reject the file not socket, err is", err)
+	}
+}
@@ -22,21 +22,50 @@
 package app
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/ossrs/go-oryx/core"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // the scope for reload.
 const (
 	ReloadWorkers = iota
 	ReloadLog
+	ReloadHeartbeat
+	ReloadGc
 )
 
+// the name of reload scope, for log and history.
+func reloadScopeName(scope int) string {
+	switch scope {
+	case ReloadWorkers:
+		return "workers"
+	case ReloadLog:
+		return "log"
+	case ReloadHeartbeat:
+		return "heartbeat"
+	case ReloadGc:
+		return "gc"
+	default:
+		return fmt.Sprintf("scope(%v)", scope)
+	}
+}
+
 // the reload handler,
 // the client which care about the reload event,
 // must implements this interface and then register itself
@@ -50,6 +79,39 @@ type ReloadHandler interface {
 	OnReloadGlobal(scope int, cc, pc *Config) error
 }
 
+// the reload checker, optional for the reload handler,
+// to dry-run the fresh config before any scope is applied.
+type ReloadChecker interface {
+	// check whether the fresh config can be applied,
+	// the reload is rejected and nothing is applied when error.
+	// @param cc the current loaded config, GsConfig.
+	// @param pc the previous old config.
+	CanReload(cc, pc *Config) error
+}
+
+// the reload completer, optional for the reload handler,
+// to know the result of reload after all handlers processed it.
+type ReloadCompleter interface {
+	// when reload completed, success is false when rejected, failed or rolled back.
+	OnReloadComplete(success bool)
+}
+
+// the reload tier, optional for the reload handler,
+// the tiers are notified one by one in ascending order,
+// only the handlers in the same tier are notified in parallel.
+type ReloadTier interface {
+	// the tier of handler, ReloadTierDefault when not implements this interface.
+	ReloadTier() int
+}
+
+const (
+	// the log handlers, which reassign the core loggers,
+	// notified before others and never in parallel.
+	ReloadTierLog = -1
+	// the tier of handlers which not implements the ReloadTier.
+	ReloadTierDefault = 0
+)
+
 // the reader support c++-style comment,
 //      block: /* comments */
 //      line: // comments
@@ -228,17 +290,103 @@ type Config struct {
 	// the rtmp global section.
 	Listen int  `json:"listen"` // the system service RTMP listen port
 	Daemon bool `json:"daemon"` // whether enabled the daemon for unix-like os
+	Strict bool `json:"strict"` // whether fail to start when optional subsystem failed to initialize.
+	// whether validate the config files against the embedded json schema, before the checks of validate.
+	Schema bool `json:"schema"`
+	// the pid file to write when initialize, empty to disable.
+	PidFile string `json:"pid_file"`
+	// the config files to include, the glob patterns relative to the including file.
+	Include []string `json:"include"`
 
 	// the go section.
 	Go struct {
-		GcInterval int `json:"gc_interval"` // the gc interval in seconds.
+		GcInterval  int  `json:"gc_interval"`   // the gc interval in seconds, 0 to disable.
+		GcAfterInit bool `json:"gc_after_init"` // whether force gc once after initialized.
+		// the gc percent for debug.SetGCPercent, 0 to use the go default, negative to disable go gc.
+		GcPercent int `json:"gc_percent"`
+		// the interval in ms of each step when reload workers downward.
+		WorkersRampMs int `json:"workers_ramp_ms"`
+		// the policy when worker panic, quit, crash or restart.
+		PanicPolicy string `json:"panic_policy"`
+		// the timeout in ms for worker to call wc.Heartbeat, 0 to disable.
+		LivenessMs int `json:"liveness_ms"`
+		// whether apply the panic policy when worker stuck, otherwise log only.
+		LivenessPanic bool `json:"liveness_panic"`
+		// the max lifetime in seconds when running, then drain and quit for supervisor to restart, 0 to disable.
+		MaxLifetime int `json:"max_lifetime"`
 	}
 
+	// the shutdown section.
+	Shutdown struct {
+		Policy string `json:"policy"` // the policy for worker not quit in its timeout, wait or abandon.
+		// log the running workers when wait workers exceed this grace in ms, 0 to disable.
+		WatchdogMs int `json:"watchdog_ms"`
+		// when signaled to quit, drain in this grace in ms before quit, 0 to quit immediately.
+		GraceMs int `json:"grace_ms"`
+	} `json:"shutdown"`
+
+	// the slow section, the threshold in ms to log the slow operation, 0 to disable.
+	Slow struct {
+		ReloadMs    int `json:"reload_ms"`    // the reload handler.
+		HeartbeatMs int `json:"heartbeat_ms"` // the heartbeat request to api server.
+	} `json:"slow"`
+
+	// the debug section.
+	Debug struct {
+		// whether log and fail the workers which not quit in deadline.
+		AssertCleanShutdown bool `json:"assert_clean_shutdown"`
+	} `json:"debug"`
+
+	// the reload section.
+	Reloader struct {
+		Concurrency int `json:"concurrency"` // the max handlers to notify in parallel, 0 or 1 is sequential.
+		History     int `json:"history"`     // the max reload records to keep, 0 to disable.
+		// whether reload when the config file changed, the changes in debounce_ms are merged.
+		Watch      bool `json:"watch"`
+		DebounceMs int  `json:"debounce_ms"`
+	} `json:"reload"`
+
 	// the log config.
 	Log struct {
-		Tank  string `json:"tank"`  // the log tank, file or console
-		Level string `json:"level"` // the log level, info/trace/warn/error
-		File  string `json:"file"`  // for log tank file, the log file path.
+		Tank   string `json:"tank"`   // the log tank, file or console
+		Level  string `json:"level"`  // the log level, info/trace/warn/error
+		File   string `json:"file"`   // for log tank file, the log file path.
+		Format string `json:"format"` // the log format, text or json.
+		// the prefix template of log line, for example, "[{level}][{time}] ".
+		PrefixTemplate string `json:"prefix_template"`
+		// the format of log time, default, rfc3339, unix or a go layout, for example, "2006-01-02 15:04:05.000".
+		TimeFormat string `json:"time_format"`
+		UTC        bool   `json:"utc"` // whether log time in utc, otherwise local.
+		// the tank override for error level, empty to use the tank.
+		ErrorTank     string `json:"error_tank"`      // the error log tank, file, console or syslog.
+		ErrorFile     string `json:"error_file"`      // for error tank file, the error log file path.
+		ErrorTankWarn bool   `json:"error_tank_warn"` // whether write warn level to error tank.
+		// the rotation of log files.
+		MaxSizeMB  int  `json:"max_size_mb"` // rotate when file exceed the size in MB, 0 to disable.
+		Daily      bool `json:"daily"`       // whether rotate when day changed.
+		MaxBackups int  `json:"max_backups"` // the max rotated files to keep, 0 to keep all.
+		// the max lines per second of all tanks, 0 to disable.
+		MaxLinesPerSec int `json:"max_lines_per_sec"`
+		// coalesce the identical consecutive lines, flush the repeats in ms, 0 to disable.
+		CoalesceMs int `json:"coalesce_ms"`
+		// the log level of modules, the worker name to level, fall back to level.
+		Modules map[string]string `json:"modules"`
+		// whether write the lines by the log worker, buffered in buffer_size lines.
+		Async      bool `json:"async"`
+		BufferSize int  `json:"buffer_size"`
+		// when async buffer is full, block or drop the line.
+		OverflowPolicy string `json:"overflow_policy"`
+		// the last lines to keep in memory for api to tail, 0 to disable.
+		TailSize int `json:"tail_size"`
+		// the permission in octal to create the dir of log files, for example, 0755.
+		DirPerm string `json:"dir_perm"`
+		// the retries to open the logger at startup, for the transient failure, 0 to fail fast.
+		OpenRetries int `json:"open_retries"`
+		// when tank is syslog, the facility and tag of syslog.
+		Syslog struct {
+			Facility string `json:"facility"`
+			Tag      string `json:"tag"`
+		} `json:"syslog"`
 	} `json:"log"`
 
 	// the heartbeat section.
@@ -246,8 +394,26 @@ type Config struct {
 		Enabled  bool    `json:"enabled"`   // whether enable the heartbeat.
 		Interval float64 `json:"interval"`  // the heartbeat interval in seconds.
 		Url      string  `json:"url"`       // the url to report.
-		DeviceId string  `json:"device_id"` // the device id to report.
+		DeviceId string  `json:"device_id"` // the device id to report, empty to use hostname.
 		Summary  bool    `json:"summaries"` // whether enable the detail summary.
+		// the interval in ms to discovery network and resolve the url.
+		DiscoveryIntervalMs int `json:"discovery_interval_ms"`
+		// whether beat once with status shutting_down when quit.
+		FinalBeat bool `json:"final_beat"`
+		// the extra fields to report.
+		Extra map[string]string `json:"extra"`
+		// the retry of each beat, the backoff is doubled for each retry.
+		Retries        int `json:"retries"`
+		RetryBackoffMs int `json:"retry_backoff_ms"`
+		// log error once when failed continuously for this times.
+		ErrorThreshold int `json:"error_threshold"`
+		// the token to auth, sent as bearer header, or the query param when token_param not empty.
+		Token      string `json:"token"`
+		TokenParam string `json:"token_param"`
+		// whether skip to verify the tls certificate of https url, for self-signed.
+		InsecureSkipVerify bool `json:"insecure_skip_verify"`
+		// the timeout in ms of each heartbeat request.
+		TimeoutMs int `json:"timeout_ms"`
 	} `json:"heartbeat"`
 
 	// the stat section.
@@ -256,54 +422,207 @@ type Config struct {
 		Disks   []string `json:"disk"`    // the disks to stat.
 	} `json:"stats"`
 
+	// the api section.
+	Api struct {
+		Listen string `json:"listen"` // the api listen address, host:port or unix:path, empty to disable.
+		// the permission in octal of the unix domain socket, for example, 0660.
+		SocketPerm string `json:"socket_perm"`
+	} `json:"api"`
+
+	// the statsd section, push metrics to statsd over udp.
+	Statsd struct {
+		Addr       string `json:"addr"`        // the statsd address, empty to disable.
+		Prefix     string `json:"prefix"`      // the prefix of metrics name.
+		IntervalMs int    `json:"interval_ms"` // the interval to push metrics.
+	} `json:"statsd"`
+
 	conf           string          `json:"-"` // the config file path.
+	modTime        time.Time       `json:"-"` // the modify time of config file when loads.
+	loadTime       time.Time       `json:"-"` // the time when config loaded.
+	previous       *Config         `json:"-"` // the previous config before reload.
 	reloadHandlers []ReloadHandler `json:"-"`
+	// the scopes of handlers subscribed by SubscribeScopes, others for all scopes.
+	reloadScopes map[ReloadHandler][]int `json:"-"`
+}
+
+// the info of the config file loaded,
+// the file maybe changed but not reloaded when mod time is after the load time.
+type ConfigInfo struct {
+	Path     string    `json:"path"`
+	ModTime  time.Time `json:"mod_time"`
+	LoadTime time.Time `json:"load_time"`
+}
+
+// the current global config, swapped as a whole on reload,
+// the settings are never modified in place, copy-on-write by clone then SetConfig,
+// the reload handlers are guarded by reloadLock, so it's safe to read without lock.
+var conf atomic.Value
+
+// the lock of the reload handlers and scopes of all configs,
+// for the handlers subscribe and unsubscribe the shared config in any goroutine.
+var reloadLock sync.Mutex
+
+func init() {
+	conf.Store(NewConfig())
+}
+
+// get the current global config, never modify it.
+func GetConfig() *Config {
+	return conf.Load().(*Config)
 }
 
-// the current global config.
-var Conf = NewConfig()
+// use the config c as the global config.
+func SetConfig(c *Config) {
+	conf.Store(c)
+}
 
 func NewConfig() *Config {
 	c := &Config{
 		reloadHandlers: []ReloadHandler{},
+		reloadScopes:   map[ReloadHandler][]int{},
 	}
 
 	c.Listen = core.RtmpListen
 	c.Workers = 0
 	c.Daemon = true
 	c.Go.GcInterval = 300
+	c.Go.PanicPolicy = "quit"
+	c.Shutdown.Policy = "wait"
+	c.Shutdown.WatchdogMs = 10 * 1000
 
 	c.Heartbeat.Enabled = false
 	c.Heartbeat.Interval = 9.3
 	c.Heartbeat.Url = "http://127.0.0.1:8085/api/v1/servers"
 	c.Heartbeat.Summary = false
+	c.Heartbeat.DiscoveryIntervalMs = 300 * 1000
+	c.Heartbeat.Retries = 2
+	c.Heartbeat.RetryBackoffMs = 500
+	c.Heartbeat.ErrorThreshold = 3
+	c.Heartbeat.TimeoutMs = 10 * 1000
+
+	c.Reloader.History = 10
+	c.Reloader.DebounceMs = 300
+
+	c.Slow.ReloadMs = 1000
+	c.Slow.HeartbeatMs = 3000
 
 	c.Stat.Network = 0
 
+	c.Statsd.Prefix = "oryx"
+	c.Statsd.IntervalMs = 10 * 1000
+
 	c.Log.Tank = "file"
 	c.Log.Level = "trace"
 	c.Log.File = "oryx.log"
+	c.Log.Format = "text"
+	c.Log.TimeFormat = "default"
+	c.Log.BufferSize = 1024
+	c.Log.OverflowPolicy = "block"
+	c.Log.DirPerm = "0755"
+	c.Log.OpenRetries = 3
+	c.Api.SocketPerm = "0660"
+	c.Log.Syslog.Facility = "daemon"
+	c.Log.Syslog.Tag = "oryx"
 
 	return c
 }
 
+// the timeout to read the config file and its included files,
+// for the read maybe hang, for example, on a stale NFS mount.
+var configReadTimeout = 30 * time.Second
+
 // loads and validate config from config file.
 func (c *Config) Loads(conf string) error {
+	return c.LoadsContext(context.Background(), conf)
+}
+
+// loads and validate config from config file,
+// fail when the config file or its included files not read before ctx done.
+func (c *Config) LoadsContext(ctx context.Context, conf string) error {
 	c.conf = conf
 
-	// read the whole config to []byte.
-	var d *json.Decoder
-	if f, err := os.Open(conf); err != nil {
+	b, modTime, err := readConfig(ctx, conf)
+	if err != nil {
 		return err
-	} else {
-		defer f.Close()
+	}
+
+	return c.loadsContent(ctx, conf, b, modTime)
+}
+
+// loads and validate config from the content of config file.
+func (c *Config) loadsContent(ctx context.Context, conf string, b []byte, modTime time.Time) error {
+	c.conf, c.modTime = conf, modTime
+	return c.loadsFrom(ctx, conf, bytes.NewReader(b))
+}
+
+// read the config file, abort when ctx done,
+// @remark the goroutine of the hang read is left, for the read can not be cancelled.
+func readConfig(ctx context.Context, name string) (b []byte, modTime time.Time, err error) {
+	type result struct {
+		b       []byte
+		modTime time.Time
+		err     error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		if fi, err := os.Stat(name); err != nil {
+			r.err = err
+		} else {
+			r.modTime = fi.ModTime()
+			r.b, r.err = ioutil.ReadFile(name)
+		}
+		done <- r
+	}()
+
+	select {
+	case r := <-done:
+		return r.b, r.modTime, r.err
+	case <-ctx.Done():
+		return nil, modTime, fmt.Errorf("read config %v failed, err is %w", name, ctx.Err())
+	}
+}
+
+// the info of config file, the path is empty when not loads from file.
+func (c *Config) Info() *ConfigInfo {
+	return &ConfigInfo{Path: c.conf, ModTime: c.modTime, LoadTime: c.loadTime}
+}
+
+// the effective config in json after includes, env and defaults applied,
+// the secrets are redacted, for example, the heartbeat token.
+func (c *Config) Dump() string {
+	v := *c.clone()
+	if len(v.Heartbeat.Token) > 0 {
+		v.Heartbeat.Token = "xxxxx"
+	}
+	if u, err := url.Parse(v.Heartbeat.Url); err == nil {
+		v.Heartbeat.Url = u.Redacted()
+	}
+
+	b, err := json.MarshalIndent(&v, "", "    ")
+	if err != nil {
+		return fmt.Sprintf("dump config failed, err is %v", err)
+	}
+	return string(b)
+}
+
+// loads and validate config from reader, for example, the stdin,
+// @remark the config loads from reader does not support reload.
+func (c *Config) LoadsFrom(r io.Reader) error {
+	return c.loadsFrom(context.Background(), "reader", r)
+}
 
-		d = json.NewDecoder(NewReader(f))
-		//d = json.NewDecoder(f)
+// loads from the reader of source, the source is used in error.
+func (c *Config) loadsFrom(ctx context.Context, source string, r io.Reader) error {
+	// decode config from stream, then the included files.
+	if err := c.decode(ctx, source, r, nil); err != nil {
+		return err
 	}
+	c.loadTime = time.Now()
 
-	// decode config from stream.
-	if err := d.Decode(c); err != nil {
+	// the env overrides the config file.
+	if err := c.ApplyEnv(); err != nil {
 		return err
 	}
 
@@ -311,8 +630,164 @@ func (c *Config) Loads(conf string) error {
 	return c.Validate()
 }
 
-// validate the config whether ok.
+// decode config from reader of source, then the included files in order,
+// the included file overrides the including file, and the later overrides the earlier.
+// the parents are the including files, to detect the circular include.
+func (c *Config) decode(ctx context.Context, source string, r io.Reader, parents []string) error {
+	c.Include = nil
+
+	// decode the raw content, to check the schema before unmarshal to config.
+	var b json.RawMessage
+	d := json.NewDecoder(NewReader(r))
+	if err := d.Decode(&b); err != nil {
+		return fmt.Errorf("loads config from %v failed, err is %w", source, err)
+	}
+
+	// the schema of including file is also applied to the included files.
+	if err := checkSchema(source, b, c.Schema); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, c); err != nil {
+		return fmt.Errorf("loads config from %v failed, err is %w", source, err)
+	}
+
+	// the include of config from reader is relative to the work dir.
+	dir := "."
+	if len(parents) > 0 || source != "reader" {
+		dir = filepath.Dir(source)
+		parents = append(parents, source)
+	}
+
+	includes := c.Include
+	defer func() {
+		c.Include = includes
+	}()
+
+	for _, include := range includes {
+		pattern := include
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return errors.New(fmt.Sprintf("include %v of %v is invalid, err is %v", include, source, err))
+		}
+		if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return errors.New(fmt.Sprintf("include %v of %v not found", include, source))
+		}
+
+		for _, file := range files {
+			if err := c.decodeInclude(ctx, file, parents); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// decode the included file, fail when included by itself or its parents.
+func (c *Config) decodeInclude(ctx context.Context, file string, parents []string) error {
+	for _, v := range parents {
+		if sameFile(v, file) {
+			return errors.New(fmt.Sprintf("circular include %v by %v", file, strings.Join(parents, " > ")))
+		}
+	}
+
+	b, _, err := readConfig(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	return c.decode(ctx, file, bytes.NewReader(b), parents)
+}
+
+// whether the paths are the same file.
+func sameFile(a, b string) bool {
+	if fa, err := os.Stat(a); err == nil {
+		if fb, err := os.Stat(b); err == nil {
+			return os.SameFile(fa, fb)
+		}
+	}
+	return filepath.Clean(a) == filepath.Clean(b)
+}
+
+// override the config by env, the env wins the config file:
+//      GO_ORYX_WORKERS, the workers, int.
+//      GO_ORYX_LISTEN, the listen, int.
+//      GO_ORYX_DAEMON, the daemon, bool.
+//      GO_ORYX_PID_FILE, the pid_file, string.
+//      GO_ORYX_LOG_TANK, the log.tank, string.
+//      GO_ORYX_LOG_LEVEL, the log.level, string.
+//      GO_ORYX_LOG_FILE, the log.file, string.
+//      GO_ORYX_HEARTBEAT_ENABLED, the heartbeat.enabled, bool.
+//      GO_ORYX_HEARTBEAT_URL, the heartbeat.url, string.
+//      GO_ORYX_HEARTBEAT_DEVICE_ID, the heartbeat.device_id, string.
+//      GO_ORYX_HEARTBEAT_INTERVAL, the heartbeat.interval, float.
+//      GO_ORYX_STATSD_ADDR, the statsd.addr, string.
+// @remark the empty env is ignored.
+func (c *Config) ApplyEnv() (err error) {
+	envs := []struct {
+		name string
+		v    interface{}
+	}{
+		{"GO_ORYX_WORKERS", &c.Workers},
+		{"GO_ORYX_LISTEN", &c.Listen},
+		{"GO_ORYX_DAEMON", &c.Daemon},
+		{"GO_ORYX_PID_FILE", &c.PidFile},
+		{"GO_ORYX_LOG_TANK", &c.Log.Tank},
+		{"GO_ORYX_LOG_LEVEL", &c.Log.Level},
+		{"GO_ORYX_LOG_FILE", &c.Log.File},
+		{"GO_ORYX_HEARTBEAT_ENABLED", &c.Heartbeat.Enabled},
+		{"GO_ORYX_HEARTBEAT_URL", &c.Heartbeat.Url},
+		{"GO_ORYX_HEARTBEAT_DEVICE_ID", &c.Heartbeat.DeviceId},
+		{"GO_ORYX_HEARTBEAT_INTERVAL", &c.Heartbeat.Interval},
+		{"GO_ORYX_STATSD_ADDR", &c.Statsd.Addr},
+	}
+
+	for _, e := range envs {
+		str := os.Getenv(e.name)
+		if len(str) == 0 {
+			continue
+		}
+
+		switch v := e.v.(type) {
+		case *int:
+			*v, err = strconv.Atoi(str)
+		case *bool:
+			*v, err = strconv.ParseBool(str)
+		case *float64:
+			*v, err = strconv.ParseFloat(str, 64)
+		case *string:
+			*v = str
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("env %v=%v is invalid, err is %v", e.name, str, err))
+		}
+		core.Trace.Println("config override by env", e.name, "=", str)
+	}
+
+	return
+}
+
+// the problems of config, each is an error of a field.
+type ConfigErrors []error
+
+func (v ConfigErrors) Error() string {
+	var msgs []string
+	for _, err := range v {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// validate the config whether ok,
+// all problems are collected to ConfigErrors, nil when ok.
 func (c *Config) Validate() error {
+	var errs ConfigErrors
+
 	if c.Log.Level == "info" {
 		core.Warn.Println("info level hurts performance")
 	}
@@ -322,26 +797,161 @@ func (c *Config) Validate() error {
 	}
 
 	if c.Workers < 0 || c.Workers > 64 {
-		return errors.New(fmt.Sprintf("workers must in [0, 64], actual is %v", c.Workers))
+		errs = append(errs, errors.New(fmt.Sprintf("workers must in [0, 64], actual is %v", c.Workers)))
 	}
 	if c.Listen <= 0 || c.Listen > 65535 {
-		return errors.New(fmt.Sprintf("listen must in (0, 65535], actual is %v", c.Listen))
+		errs = append(errs, errors.New(fmt.Sprintf("listen must in (0, 65535], actual is %v", c.Listen)))
+	}
+
+	if c.Go.GcInterval < 0 || c.Go.GcInterval > 24*3600 {
+		errs = append(errs, errors.New(fmt.Sprintf("go gc_interval must in [0, 24*3600], actual is %v", c.Go.GcInterval)))
+	}
+
+	if c.Go.LivenessMs < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("go liveness_ms must >= 0, actual is %v", c.Go.LivenessMs)))
+	}
+
+	if c.Go.MaxLifetime < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("go max_lifetime must >= 0, actual is %v", c.Go.MaxLifetime)))
+	}
+
+	if c.Go.WorkersRampMs < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("go workers_ramp_ms must >= 0, actual is %v", c.Go.WorkersRampMs)))
+	}
+
+	if v := c.Go.PanicPolicy; v != "quit" && v != "crash" && v != "restart" {
+		errs = append(errs, errors.New(fmt.Sprintf("go panic_policy must be quit/crash/restart, actual is %v", v)))
+	}
+	if c.Shutdown.Policy != "wait" && c.Shutdown.Policy != "abandon" {
+		errs = append(errs, errors.New(fmt.Sprintf("shutdown.policy must be wait/abandon, actual is %v", c.Shutdown.Policy)))
+	}
+
+	if c.Shutdown.GraceMs < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("shutdown.grace_ms must not be negative, actual is %v", c.Shutdown.GraceMs)))
+	}
+	if c.Shutdown.WatchdogMs < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("shutdown.watchdog_ms must not be negative, actual is %v", c.Shutdown.WatchdogMs)))
+	}
+
+	if c.Reloader.Concurrency < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("reload.concurrency must not be negative, actual is %v", c.Reloader.Concurrency)))
+	}
+	if c.Reloader.History < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("reload.history must not be negative, actual is %v", c.Reloader.History)))
+	}
+	if c.Reloader.DebounceMs < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("reload.debounce_ms must not be negative, actual is %v", c.Reloader.DebounceMs)))
+	}
+
+	if c.Heartbeat.Interval <= 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("heartbeat.interval must be positive, actual is %v", c.Heartbeat.Interval)))
+	}
+	if c.Heartbeat.Retries < 0 || c.Heartbeat.RetryBackoffMs < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("heartbeat.retries and retry_backoff_ms must not be negative, actual is %v/%v", c.Heartbeat.Retries, c.Heartbeat.RetryBackoffMs)))
+	}
+	if c.Heartbeat.ErrorThreshold <= 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("heartbeat.error_threshold must be positive, actual is %v", c.Heartbeat.ErrorThreshold)))
+	}
+	if c.Heartbeat.Enabled && len(c.Heartbeat.Url) == 0 {
+		errs = append(errs, errors.New("heartbeat.url must not be empty when enabled"))
+	}
+	if c.Heartbeat.TimeoutMs <= 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("heartbeat.timeout_ms must be positive, actual is %v", c.Heartbeat.TimeoutMs)))
+	}
+	if c.Heartbeat.DiscoveryIntervalMs <= 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("heartbeat.discovery_interval_ms must be positive, actual is %v", c.Heartbeat.DiscoveryIntervalMs)))
+	}
+
+	if c.Slow.ReloadMs < 0 || c.Slow.HeartbeatMs < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("slow thresholds must not be negative, actual is %v/%v", c.Slow.ReloadMs, c.Slow.HeartbeatMs)))
+	}
+
+	if c.Stat.Network < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("stats.network must not be negative, actual is %v", c.Stat.Network)))
+	}
+
+	if strings.HasPrefix(c.Api.Listen, apiUnixPrefix) {
+		if len(strings.TrimPrefix(c.Api.Listen, apiUnixPrefix)) == 0 {
+			errs = append(errs, errors.New(fmt.Sprintf("api.listen must be unix:path, actual is %v", c.Api.Listen)))
+		}
+	} else if len(c.Api.Listen) > 0 {
+		if err := core.ValidateListen(c.Api.Listen); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("api.listen must be host:port, err is %v", err)))
+		}
+	}
+	if v, err := strconv.ParseUint(c.Api.SocketPerm, 8, 32); err != nil || v > 0777 {
+		errs = append(errs, errors.New(fmt.Sprintf("api.socket_perm must be octal in [0, 0777], actual is %v", c.Api.SocketPerm)))
 	}
 
-	if c.Go.GcInterval <= 0 || c.Go.GcInterval > 24*3600 {
-		return errors.New(fmt.Sprintf("go gc_interval must in (0, 24*3600], actual is %v", c.Go.GcInterval))
+	if len(c.Statsd.Addr) > 0 {
+		if err := core.ValidateListen(c.Statsd.Addr); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("statsd.addr must be host:port, err is %v", err)))
+		}
+	}
+	if c.Statsd.IntervalMs <= 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("statsd.interval_ms must be positive, actual is %v", c.Statsd.IntervalMs)))
 	}
 
 	if c.Log.Level != "info" && c.Log.Level != "trace" && c.Log.Level != "warn" && c.Log.Level != "error" {
-		return errors.New(fmt.Sprintf("log.leve must be info/trace/warn/error, actual is %v", c.Log.Level))
+		errs = append(errs, errors.New(fmt.Sprintf("log.level must be info/trace/warn/error, actual is %v", c.Log.Level)))
 	}
-	if c.Log.Tank != "console" && c.Log.Tank != "file" {
-		return errors.New(fmt.Sprintf("log.tank must be console/file, actual is %v", c.Log.Tank))
+	for k, v := range c.Log.Modules {
+		if _, ok := core.ParseLogLevel(v); !ok {
+			errs = append(errs, errors.New(fmt.Sprintf("log.modules.%v must be info/trace/warn/error, actual is %v", k, v)))
+		}
+	}
+	if c.Log.Tank != "console" && c.Log.Tank != "file" && c.Log.Tank != "syslog" {
+		errs = append(errs, errors.New(fmt.Sprintf("log.tank must be console/file/syslog, actual is %v", c.Log.Tank)))
+	}
+	if (c.Log.Tank == "syslog" || c.Log.ErrorTank == "syslog") && len(c.Log.Syslog.Tag) == 0 {
+		errs = append(errs, errors.New("log.syslog.tag must not be empty for syslog tank"))
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs = append(errs, errors.New(fmt.Sprintf("log.format must be text/json, actual is %v", c.Log.Format)))
 	}
 	if c.Log.Tank == "file" && len(c.Log.File) == 0 {
-		return errors.New("log.file must not be empty for file tank")
+		errs = append(errs, errors.New("log.file must not be empty for file tank"))
+	}
+	if c.Log.ErrorTank != "" && c.Log.ErrorTank != "console" && c.Log.ErrorTank != "file" && c.Log.ErrorTank != "syslog" {
+		errs = append(errs, errors.New(fmt.Sprintf("log.error_tank must be console/file/syslog, actual is %v", c.Log.ErrorTank)))
+	}
+	if c.Log.ErrorTank == "file" && len(c.Log.ErrorFile) == 0 {
+		errs = append(errs, errors.New("log.error_file must not be empty for file error tank"))
+	}
+	if c.Log.MaxSizeMB < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("log.max_size_mb must not be negative, actual is %v", c.Log.MaxSizeMB)))
+	}
+	if c.Log.MaxLinesPerSec < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("log.max_lines_per_sec must not be negative, actual is %v", c.Log.MaxLinesPerSec)))
+	}
+	if c.Log.BufferSize <= 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("log.buffer_size must be positive, actual is %v", c.Log.BufferSize)))
+	}
+	if c.Log.OverflowPolicy != "block" && c.Log.OverflowPolicy != "drop" {
+		errs = append(errs, errors.New(fmt.Sprintf("log.overflow_policy must be block/drop, actual is %v", c.Log.OverflowPolicy)))
+	}
+	if v, err := strconv.ParseUint(c.Log.DirPerm, 8, 32); err != nil || v > 0777 {
+		errs = append(errs, errors.New(fmt.Sprintf("log.dir_perm must be octal in [0, 0777], actual is %v", c.Log.DirPerm)))
+	}
+	if c.Log.OpenRetries < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("log.open_retries must not be negative, actual is %v", c.Log.OpenRetries)))
+	}
+	if c.Log.TailSize < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("log.tail_size must not be negative, actual is %v", c.Log.TailSize)))
+	}
+	if c.Log.CoalesceMs < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("log.coalesce_ms must not be negative, actual is %v", c.Log.CoalesceMs)))
+	}
+	if c.Log.MaxBackups < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("log.max_backups must not be negative, actual is %v", c.Log.MaxBackups)))
+	}
+	if _, err := parseLogTemplate(c.Log.PrefixTemplate); err != nil {
+		errs = append(errs, errors.New(fmt.Sprintf("log.prefix_template is invalid, err is %v", err)))
 	}
 
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
@@ -350,38 +960,63 @@ func (c *Config) LogToFile() bool {
 	return c.Log.Tank == "file"
 }
 
+// the permission to create the dir of log files, 0755 when invalid.
+func (c *Config) logDirPerm() os.FileMode {
+	return parsePerm(c.Log.DirPerm, 0755)
+}
+
+// the permission of api unix domain socket, 0660 when invalid.
+func (c *Config) apiSocketPerm() os.FileMode {
+	return parsePerm(c.Api.SocketPerm, 0660)
+}
+
+// parse the permission in octal, the dv when invalid.
+func parsePerm(v string, dv os.FileMode) os.FileMode {
+	if v, err := strconv.ParseUint(v, 8, 32); err == nil && v <= 0777 {
+		return os.FileMode(v)
+	}
+	return dv
+}
+
+// whether log tank is syslog
+func (c *Config) LogToSyslog() bool {
+	return c.Log.Tank == "syslog"
+}
+
 // get the log tank writer for specified level.
 // the param dw is the default writer.
 func (c *Config) LogTank(level string, dw io.Writer) io.Writer {
-	if c.Log.Level == "info" {
-		return dw
-	}
-	if c.Log.Level == "trace" {
-		if level == "info" {
-			return ioutil.Discard
-		}
-		return dw
-	}
-	if c.Log.Level == "warn" {
-		if level == "info" || level == "trace" {
-			return ioutil.Discard
-		}
-		return dw
+	min, ok := core.ParseLogLevel(c.Log.Level)
+	if !ok {
+		return ioutil.Discard
 	}
-	if c.Log.Level == "error" {
-		if level != "error" {
-			return ioutil.Discard
+
+	// the module maybe more verbose than the level.
+	for _, v := range c.Log.Modules {
+		if lv, ok := core.ParseLogLevel(v); ok && lv < min {
+			min = lv
 		}
-		return dw
 	}
 
-	return ioutil.Discard
+	if lv, _ := core.ParseLogLevel(level); lv < min {
+		return ioutil.Discard
+	}
+	return dw
 }
 
 // subscribe the reload event,
 // when got reload event, notify all handlers.
 func (c *Config) Subscribe(h ReloadHandler) {
-	// ignore exists.
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	c.subscribe(h)
+}
+
+// subscribe the handler, the reloadLock must be held.
+func (c *Config) subscribe(h ReloadHandler) {
+	// ignore exists, which subscribes all scopes.
+	delete(c.reloadScopes, h)
 	for _, v := range c.reloadHandlers {
 		if v == h {
 			return
@@ -391,37 +1026,419 @@ func (c *Config) Subscribe(h ReloadHandler) {
 	c.reloadHandlers = append(c.reloadHandlers, h)
 }
 
+// subscribe the reload event of the scopes only, defined in const ReloadXXX,
+// the handler is notified and checked only when any of the scopes changed.
+func (c *Config) SubscribeScopes(h ReloadHandler, scopes ...int) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	c.subscribe(h)
+	c.reloadScopes[h] = append([]int{}, scopes...)
+}
+
 func (c *Config) Unsubscribe(h ReloadHandler) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
 	for i, v := range c.reloadHandlers {
 		if v == h {
 			c.reloadHandlers = append(c.reloadHandlers[:i], c.reloadHandlers[i+1:]...)
+			delete(c.reloadScopes, h)
+			return
+		}
+	}
+}
+
+// the snapshot of handlers, to notify without lock, for the handler may subscribe or unsubscribe.
+func (c *Config) handlers() []ReloadHandler {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	return append([]ReloadHandler{}, c.reloadHandlers...)
+}
+
+// the copy of config with the handlers, to modify and swap, for the config is shared.
+func (c *Config) clone() *Config {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	v := *c
+	v.reloadHandlers = append([]ReloadHandler{}, c.reloadHandlers...)
+	v.reloadScopes = make(map[ReloadHandler][]int)
+	for h, scopes := range c.reloadScopes {
+		v.reloadScopes[h] = scopes
+	}
+	return &v
+}
+
+// whether the handler subscribed any of the scopes.
+func (c *Config) subscribed(h ReloadHandler, scopes []int) bool {
+	reloadLock.Lock()
+	v, ok := c.reloadScopes[h]
+	reloadLock.Unlock()
+	if !ok {
+		return true
+	}
+
+	for _, scope := range scopes {
+		for _, e := range v {
+			if scope == e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the event of reload, for the channel subscribers.
+type ReloadEvent struct {
+	Time time.Time
+	// the changed scopes, defined in const ReloadXXX.
+	Scopes []int
+	Ok     bool
+	// the error when reload failed.
+	Err error
+}
+
+// the channel subscriber of reload events, subscribed as a handler,
+// so the fresh config inherits it as the other handlers.
+type reloadEvents struct {
+	events  chan ReloadEvent
+	dropped int64
+}
+
+// interface ReloadHandler
+func (v *reloadEvents) OnReloadGlobal(scope int, cc, pc *Config) error {
+	return nil
+}
+
+// notify the event, drop it when channel is full, never block the reload.
+func (v *reloadEvents) notify(e ReloadEvent) {
+	select {
+	case v.events <- e:
+	default:
+		atomic.AddInt64(&v.dropped, 1)
+		core.Warn.Println("drop reload event at", e.Time, "for channel full, dropped", atomic.LoadInt64(&v.dropped))
+	}
+}
+
+// subscribe the reload events in a channel buffered size events,
+// the event is dropped when the channel is full, see DroppedEvents.
+// @remark the channel is never closed, even when unsubscribed.
+func (c *Config) SubscribeEvents(size int) <-chan ReloadEvent {
+	v := &reloadEvents{events: make(chan ReloadEvent, size)}
+	c.Subscribe(v)
+	return v.events
+}
+
+// unsubscribe the channel of reload events.
+func (c *Config) UnsubscribeEvents(events <-chan ReloadEvent) {
+	for _, h := range c.handlers() {
+		if v, ok := h.(*reloadEvents); ok && v.events == events {
+			c.Unsubscribe(h)
 			return
 		}
 	}
 }
 
+// the total dropped reload events of all channel subscribers.
+func (c *Config) DroppedEvents() (n int64) {
+	for _, h := range c.handlers() {
+		if v, ok := h.(*reloadEvents); ok {
+			n += atomic.LoadInt64(&v.dropped)
+		}
+	}
+	return
+}
+
 func (pc *Config) Reload(cc *Config) (err error) {
+	// notify the result after all handlers processed the reload.
+	starttime := time.Now()
+	defer func() {
+		cc.complete(ReloadEvent{Time: starttime, Scopes: pc.Diff(cc), Ok: err == nil, Err: err})
+	}()
+
+	// the immutable settings can not apply when running, reject the whole reload,
+	// the previous config is kept and requires restart to apply.
+	if names := pc.immutableChanges(cc); len(names) > 0 {
+		core.Warn.Println("reload rejected for", strings.Join(names, ","), "changed, which requires restart")
+		return errors.New(fmt.Sprintf("reload rejected for immutable %v changed, requires restart", strings.Join(names, ",")))
+	}
+
+	// dry-run all handlers, nothing is applied when any rejected.
+	if err = cc.canReload(cc, pc); err != nil {
+		return
+	}
+
+	// rollback the applied scopes when any handler failed to apply,
+	// for the handlers maybe left in a half-applied state.
+	if err = cc.apply(cc, pc); err != nil {
+		core.Warn.Println("reload rollback to previous config, err is", err)
+		if err := cc.apply(pc, cc); err != nil {
+			core.Error.Println("reload rollback failed. err is", err)
+		}
+		return
+	}
+
+	return
+}
+
+// the settings can not apply when running, for example, the daemon and listen,
+// the reload is rejected when any changed.
+var immutableSettings = []struct {
+	name  string
+	value func(c *Config) interface{}
+}{
+	{"daemon", func(c *Config) interface{} { return c.Daemon }},
+	{"listen", func(c *Config) interface{} { return c.Listen }},
+	{"pid_file", func(c *Config) interface{} { return c.PidFile }},
+	{"log.async", func(c *Config) interface{} { return c.Log.Async }},
+	{"log.buffer_size", func(c *Config) interface{} { return c.Log.BufferSize }},
+	{"api.listen", func(c *Config) interface{} { return c.Api.Listen }},
+}
+
+// the names of immutable settings changed from pc to cc.
+func (pc *Config) immutableChanges(cc *Config) (names []string) {
+	for _, v := range immutableSettings {
+		if v.value(cc) != v.value(pc) {
+			names = append(names, v.name)
+		}
+	}
+	return
+}
+
+// the previous config before reload, nil when never reloaded.
+func (c *Config) Previous() *Config {
+	return c.previous
+}
+
+// the changed scopes from pc to cc, in the order to apply,
+// only the changed scopes are notified to the handlers when reload.
+func (pc *Config) Diff(cc *Config) (scopes []int) {
 	if cc.Workers != pc.Workers {
-		for _, h := range cc.reloadHandlers {
-			if err = h.OnReloadGlobal(ReloadWorkers, cc, pc); err != nil {
-				return
+		scopes = append(scopes, ReloadWorkers)
+	}
+	if !reflect.DeepEqual(cc.Log, pc.Log) {
+		scopes = append(scopes, ReloadLog)
+	}
+	if !reflect.DeepEqual(cc.Heartbeat, pc.Heartbeat) {
+		scopes = append(scopes, ReloadHeartbeat)
+	}
+	if cc.Go.GcInterval != pc.Go.GcInterval || cc.Go.GcPercent != pc.Go.GcPercent {
+		scopes = append(scopes, ReloadGc)
+	}
+	return
+}
+
+// apply the changed scopes of cc to all handlers of c.
+func (c *Config) apply(cc, pc *Config) (err error) {
+	scopes := pc.Diff(cc)
+	if len(scopes) == 0 {
+		core.Info.Println("reload ignore all scopes")
+	}
+
+	for _, scope := range scopes {
+		if err = c.notify(scope, cc, pc); err != nil {
+			return
+		}
+		core.Trace.Println("reload apply", reloadScopeName(scope), "ok")
+	}
+
+	return
+}
+
+// notify the handlers which implements the ReloadCompleter,
+// and the channel subscribers of reload events.
+func (c *Config) complete(e ReloadEvent) {
+	for _, h := range c.handlers() {
+		if v, ok := h.(ReloadCompleter); ok {
+			v.OnReloadComplete(e.Ok)
+		}
+		if v, ok := h.(*reloadEvents); ok {
+			v.notify(e)
+		}
+	}
+}
+
+// dry-run the handlers which implements the ReloadChecker,
+// stop at the first handler which rejected.
+func (c *Config) canReload(cc, pc *Config) (err error) {
+	scopes := pc.Diff(cc)
+	for _, h := range c.handlers() {
+		if !c.subscribed(h, scopes) {
+			continue
+		}
+
+		if v, ok := h.(ReloadChecker); ok {
+			if err = v.CanReload(cc, pc); err != nil {
+				core.Warn.Println(fmt.Sprintf("reload rejected by %T, err is %v", h, err))
+				return errors.New(fmt.Sprintf("reload rejected by %T, err is %v", h, err))
 			}
 		}
-		core.Trace.Println("reload apply workers ok")
-	} else {
-		core.Info.Println("reload ignore workers")
 	}
 
-	if cc.Log.File != pc.Log.File || cc.Log.Level != pc.Log.Level || cc.Log.Tank != pc.Log.Tank {
-		for _, h := range cc.reloadHandlers {
-			if err = h.OnReloadGlobal(ReloadLog, cc, pc); err != nil {
-				return
+	return
+}
+
+// notify all handlers the reload scope, tier by tier in ascending order.
+// in each tier, when reload.concurrency is 0 or 1 or it's the log tier, notify in subscribe order,
+// otherwise notify at most concurrency handlers in parallel without any order.
+// all handlers of a tier are notified and the errors are collected,
+// the tiers after the failed tier are not notified.
+func (c *Config) notify(scope int, cc, pc *Config) (err error) {
+	for _, hs := range reloadTiers(c.handlers()) {
+		if err = c.notifyTier(hs, scope, cc, pc); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// group the handlers by tier in ascending order, keep the subscribe order in tier.
+func reloadTiers(handlers []ReloadHandler) (tiers [][]ReloadHandler) {
+	groups := map[int][]ReloadHandler{}
+	keys := []int{}
+	for _, h := range handlers {
+		tier := ReloadTierDefault
+		if v, ok := h.(ReloadTier); ok {
+			tier = v.ReloadTier()
+		}
+
+		if _, ok := groups[tier]; !ok {
+			keys = append(keys, tier)
+		}
+		groups[tier] = append(groups[tier], h)
+	}
+
+	sort.Ints(keys)
+	for _, tier := range keys {
+		tiers = append(tiers, groups[tier])
+	}
+	return
+}
+
+// notify the handlers of a tier, collect the errors of all handlers.
+func (c *Config) notifyTier(hs []ReloadHandler, scope int, cc, pc *Config) (err error) {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	errs := []error{}
+
+	concurrency := c.Reloader.Concurrency
+	if v, ok := hs[0].(ReloadTier); ok && v.ReloadTier() == ReloadTierLog {
+		concurrency = 1
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	tokens := make(chan bool, concurrency)
+	for _, h := range hs {
+		tokens <- true
+		wg.Add(1)
+
+		do := func(h ReloadHandler) {
+			defer wg.Done()
+			defer func() {
+				<-tokens
+			}()
+
+			if err := c.onReload(h, scope, cc, pc); err != nil {
+				lock.Lock()
+				defer lock.Unlock()
+				errs = append(errs, err)
 			}
 		}
-		core.Trace.Println("reload apply log ok")
-	} else {
-		core.Info.Println("reload ignore log")
+
+		if concurrency == 1 {
+			do(h)
+		} else {
+			go do(h)
+		}
+	}
+	wg.Wait()
+
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	if len(errs) > 1 {
+		msgs := []string{}
+		for _, e := range errs {
+			msgs = append(msgs, e.Error())
+		}
+		return errors.New(fmt.Sprintf("reload %v handlers failed, errs are %v", len(errs), strings.Join(msgs, "; ")))
+	}
+	return
+}
+
+// notify the handler and log when slow.
+func (c *Config) onReload(h ReloadHandler, scope int, cc, pc *Config) error {
+	if !c.subscribed(h, []int{scope}) {
+		return nil
+	}
+
+	defer logSlow(fmt.Sprintf("reload %T scope %v", h, scope), c.Slow.ReloadMs, time.Now())
+	return h.OnReloadGlobal(scope, cc, pc)
+}
+
+// parse and validate the fresh config for reload,
+// nothing is applied when config is invalid.
+func (c *Config) parseReload() (cc *Config, err error) {
+	if len(c.conf) == 0 {
+		return nil, errors.New("config not loads from file, does not support reload")
 	}
 
+	cc = NewConfig()
+	// copy the handlers, for unsubscribe shift the slice in place.
+	reloadLock.Lock()
+	cc.reloadHandlers = append([]ReloadHandler{}, c.reloadHandlers...)
+	for h, scopes := range c.reloadScopes {
+		cc.reloadScopes[h] = scopes
+	}
+	reloadLock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), configReadTimeout)
+	defer cancel()
+	if err = cc.LoadsContext(ctx, c.conf); err != nil {
+		core.Error.Println("reload config failed. err is", err)
+		return
+	}
+	core.Info.Println("reload parse fresh config ok")
+
+	return
+}
+
+// reload the config file, apply to all handlers and use it as the global config,
+// the previous config is kept when the fresh one is invalid or failed to apply.
+func (pc *Config) Reloads() (err error) {
+	var cc *Config
+	if cc, err = pc.parseReload(); err != nil {
+		return
+	}
+
+	return pc.applyReload(cc)
+}
+
+// apply the fresh config to all handlers and use it as the global config.
+func (pc *Config) applyReload(cc *Config) (err error) {
+	if err = pc.reloadTo(cc); err != nil {
+		return
+	}
+	SetConfig(cc)
+	core.Trace.Println("reload config ok")
+
+	return
+}
+
+// apply the fresh config to all handlers and retain the previous config.
+func (pc *Config) reloadTo(cc *Config) (err error) {
+	if err = pc.Reload(cc); err != nil {
+		core.Error.Println("apply reload failed. err is", err)
+		return
+	}
+	core.Info.Println("reload completed work")
+
+	// retain the previous config, drop the older ones.
+	cc.previous, pc.previous = pc, nil
+
 	return
 }
@@ -0,0 +1,110 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// the mount point of cgroups, to detect the cpu quota in containers.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// the default workers when config is 0, the cpu quota of cgroups,
+// for runtime.NumCPU() is the cores of host in container.
+// use runtime.NumCPU() when no quota, and never exceed it.
+func defaultWorkers() (workers int, reason string) {
+	n := runtime.NumCPU()
+
+	quota, source, err := cgroupCpuQuota()
+	if err != nil {
+		return n, fmt.Sprintf("NumCPU %v, no cpu quota, %v", n, err)
+	}
+
+	// round up the quota, for 1.5 cpus is able to run 2 workers.
+	workers = int(math.Ceil(quota))
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		return n, fmt.Sprintf("NumCPU %v, less than %v cpu quota %.2f", n, source, quota)
+	}
+	return workers, fmt.Sprintf("%v cpu quota %.2f, NumCPU %v", source, quota, n)
+}
+
+// get the cpu quota in cpus of cgroups, the cgroup v2 then v1.
+// error when no cgroups or no quota.
+func cgroupCpuQuota() (quota float64, source string, err error) {
+	// for cgroup v2, the cpu.max is "$MAX $PERIOD", where $MAX is max for no quota.
+	if b, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cpu.max")); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) != 2 {
+			return 0, "", errors.New(fmt.Sprintf("invalid cgroup v2 cpu.max %v", string(b)))
+		}
+		if fields[0] == "max" {
+			return 0, "", errors.New("cgroup v2 cpu.max is max")
+		}
+		quota, err := parseCpuQuota(fields[0], fields[1])
+		return quota, "cgroup v2", err
+	}
+
+	// for cgroup v1, the cfs quota in us of each period, -1 for no quota.
+	for _, dir := range []string{"cpu", "cpu,cpuacct"} {
+		q, err := ioutil.ReadFile(filepath.Join(cgroupRoot, dir, "cpu.cfs_quota_us"))
+		if err != nil {
+			continue
+		}
+		p, err := ioutil.ReadFile(filepath.Join(cgroupRoot, dir, "cpu.cfs_period_us"))
+		if err != nil {
+			return 0, "", err
+		}
+		if v := strings.TrimSpace(string(q)); v == "-1" {
+			return 0, "", errors.New("cgroup v1 cpu.cfs_quota_us is -1")
+		}
+		quota, err := parseCpuQuota(strings.TrimSpace(string(q)), strings.TrimSpace(string(p)))
+		return quota, "cgroup v1", err
+	}
+
+	return 0, "", errors.New("cgroup cpu controller not found")
+}
+
+// parse the quota and period in us to cpus.
+func parseCpuQuota(quota, period string) (float64, error) {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if q <= 0 || p <= 0 {
+		return 0, errors.New(fmt.Sprintf("invalid cpu quota %v and period %v", quota, period))
+	}
+	return float64(q) / float64(p), nil
+}
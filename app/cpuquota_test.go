@@ -0,0 +1,92 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCgroupCpuQuota(t *testing.T) {
+	pv := cgroupRoot
+	defer func() {
+		cgroupRoot = pv
+	}()
+
+	write := func(name, v string) {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal("mkdir failed, err is", err)
+		}
+		if err := ioutil.WriteFile(name, []byte(v), 0644); err != nil {
+			t.Fatal("write failed, err is", err)
+		}
+	}
+
+	cgroupRoot = t.TempDir()
+	if _, _, err := cgroupCpuQuota(); err == nil {
+		t.Error("should fail when no cgroup")
+	}
+	if n, _ := defaultWorkers(); n != runtime.NumCPU() {
+		t.Error("should use NumCPU when no cgroup, actual is", n)
+	}
+
+	// cgroup v1
+	write(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_quota_us"), "-1\n")
+	write(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_period_us"), "100000\n")
+	if _, _, err := cgroupCpuQuota(); err == nil {
+		t.Error("should fail when v1 no quota")
+	}
+	write(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_quota_us"), "50000\n")
+	if v, source, err := cgroupCpuQuota(); err != nil || v != 0.5 || source != "cgroup v1" {
+		t.Error("invalid v1 quota", v, source, err)
+	}
+	if n, _ := defaultWorkers(); n != 1 {
+		t.Error("should round up the quota, actual is", n)
+	}
+
+	// cgroup v2 wins v1.
+	write(filepath.Join(cgroupRoot, "cpu.max"), "max 100000\n")
+	if _, _, err := cgroupCpuQuota(); err == nil {
+		t.Error("should fail when v2 no quota")
+	}
+	write(filepath.Join(cgroupRoot, "cpu.max"), "150000 100000\n")
+	if v, source, err := cgroupCpuQuota(); err != nil || v != 1.5 || source != "cgroup v2" {
+		t.Error("invalid v2 quota", v, source, err)
+	}
+	if n, _ := defaultWorkers(); n != 2 && n != runtime.NumCPU() {
+		t.Error("should round up the quota, actual is", n)
+	}
+
+	// never exceed the NumCPU.
+	write(filepath.Join(cgroupRoot, "cpu.max"), "100000000 100000\n")
+	if n, _ := defaultWorkers(); n != runtime.NumCPU() {
+		t.Error("should not exceed NumCPU, actual is", n)
+	}
+
+	write(filepath.Join(cgroupRoot, "cpu.max"), "invalid\n")
+	if _, _, err := cgroupCpuQuota(); err == nil {
+		t.Error("should fail for invalid cpu.max")
+	}
+}
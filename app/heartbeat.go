@@ -23,28 +23,132 @@ package app
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/ossrs/go-oryx/core"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"reflect"
 	"sync"
 	"time"
 )
 
+// the interval to log the same discovery and resolve failure, for the dns maybe down for hours.
+const heartbeatLogInterval = time.Minute
+
+// the timeout of the final beat when quit, never delay the shutdown.
+const heartbeatFinalTimeout = 1 * time.Second
+
 type Heartbeat struct {
 	ips      []string
 	exportIp string
-	lock     sync.Mutex
+	// the host of collector url and its resolved ip,
+	// the beat always dial the resolved ip, for the dns may changed.
+	host      string
+	collector string
+	// the resolver for collector host, default to net.LookupHost.
+	resolver func(host string) ([]string, error)
+	// the client to post, reconfigured when tls or timeout changed.
+	transport *http.Transport
+	client    *http.Client
+	// the tls and timeout of client.
+	insecure bool
+	timeout  time.Duration
+	// the reloaded config to apply by beat cycle.
+	reloads chan *Config
+	// the health of heartbeat.
+	lastError   error
+	lastSuccess time.Time
+	failures    int
+	// the total heartbeats ok and failed.
+	oks, fails int64
+	// the time when server run, for uptime.
+	runTime time.Time
+	// the config of server, default to the global config.
+	config func() *Config
+	// the clock of beat and retry timers, default to core.RealClock.
+	clock core.Clock
+	// the locker for ips, collector and health.
+	lock sync.Mutex
 }
 
 func NewHeartbeat() *Heartbeat {
-	return &Heartbeat{
-		ips: []string{},
+	h := &Heartbeat{
+		ips:      []string{},
+		resolver: net.LookupHost,
+		reloads:  make(chan *Config, 1),
+		clock:    core.RealClock,
+	}
+	h.config = func() *Config {
+		return GetConfig()
+	}
+
+	h.configure(h.config())
+
+	return h
+}
+
+// create the client when tls or timeout of config changed,
+// and close the idle connections of the stale one.
+func (h *Heartbeat) configure(c *Config) {
+	insecure := c.Heartbeat.InsecureSkipVerify
+	timeout := time.Duration(c.Heartbeat.TimeoutMs) * time.Millisecond
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.client != nil && insecure == h.insecure && timeout == h.timeout {
+		return
+	}
+
+	if h.transport != nil {
+		h.transport.CloseIdleConnections()
+		core.Trace.Println("heartbeat client insecure", h.insecure, "to", insecure, "timeout", h.timeout, "to", timeout)
 	}
+
+	h.insecure, h.timeout = insecure, timeout
+	h.transport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           h.dial,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: insecure},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: timeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          4,
+	}
+	h.client = &http.Client{Transport: h.transport, Timeout: timeout}
+}
+
+// initialize the heartbeat when enabled, check the url to report to.
+func (h *Heartbeat) initialize(c *Config) (err error) {
+	if !c.Heartbeat.Enabled {
+		return
+	}
+
+	var u *url.URL
+	if u, err = url.Parse(c.Heartbeat.Url); err != nil {
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New(fmt.Sprintf("heartbeat url scheme must be http/https, actual is %v", u.Scheme))
+	}
+	if len(u.Host) == 0 {
+		return errors.New(fmt.Sprintf("heartbeat url host must not be empty, url is %v", c.Heartbeat.Url))
+	}
+	if c.Heartbeat.InsecureSkipVerify && u.Scheme == "https" {
+		core.Warn.Println("heartbeat skip to verify the tls certificate of", u.Host)
+	}
+
+	return
 }
 
 func (h *Heartbeat) discoveryCycle(w WorkerContainer) {
+	ctx := w.Context()
 	interval := time.Duration(0)
 	for {
 		select {
@@ -52,17 +156,25 @@ func (h *Heartbeat) discoveryCycle(w WorkerContainer) {
 			w.Quit()
 			return
 		case <-time.After(interval):
-			core.Info.Println("start to discovery network every", interval)
+			core.Ctx(ctx, core.Info).Println("start to discovery network every", interval)
 
 			if err := h.discovery(); err != nil {
-				core.Warn.Println("heartbeat discovery failed, err is", err)
+				core.Ctx(ctx, core.Every(core.Warn, heartbeatLogInterval, "heartbeat.discovery")).Println("heartbeat discovery failed, err is", err)
 			} else {
 				if len(h.ips) <= 0 {
 					interval = 3 * time.Second
 					continue
 				}
-				core.Trace.Println("local ip is", h.ips, "exported", h.exportIp)
-				interval = 300 * time.Second
+				core.Ctx(ctx, core.Trace).Println("local ip is", h.ips, "exported", h.exportIp)
+				interval = time.Millisecond * time.Duration(h.config().Heartbeat.DiscoveryIntervalMs)
+			}
+
+			if !h.config().Heartbeat.Enabled {
+				continue
+			}
+
+			if err := h.resolve(h.config().Heartbeat.Url); err != nil {
+				core.Ctx(ctx, core.Every(core.Warn, heartbeatLogInterval, "heartbeat.resolve")).Println("heartbeat resolve", h.config().Heartbeat.Url, "failed, err is", err)
 			}
 		}
 	}
@@ -71,27 +183,167 @@ func (h *Heartbeat) discoveryCycle(w WorkerContainer) {
 }
 
 func (h *Heartbeat) beatCycle(w WorkerContainer) {
+	ctx := w.Context()
+	c := h.config()
 	for {
-		c := &Conf.Heartbeat
-
 		select {
 		case <-w.QC():
 			w.Quit()
+
+			// notify the collector the server quit gracefully.
+			if c.Heartbeat.Enabled && c.Heartbeat.FinalBeat {
+				h.finalBeat(c)
+			}
 			return
-		case <-time.After(time.Millisecond * time.Duration(1000*c.Interval)):
-			if !c.Enabled {
-				continue
+		case cc := <-h.reloads:
+			// the reloading config is not the global one yet,
+			// use it to apply the fresh interval and url from now.
+			c = cc
+			continue
+		case <-h.clock.After(time.Millisecond * time.Duration(1000*c.Heartbeat.Interval)):
+			if c.Heartbeat.Enabled {
+				core.Ctx(ctx, core.Info).Println("start to heartbeat every", c.Heartbeat.Interval)
+				h.heartbeat(ctx, c)
 			}
+		}
+		c = h.config()
+	}
+}
 
-			core.Info.Println("start to heartbeat every", c.Interval)
+// heartbeat with retries, and log error once when failed continuously.
+func (h *Heartbeat) heartbeat(ctx context.Context, c *Config) {
+	err := h.reportRetry(ctx, c)
 
-			if err := h.beat(); err != nil {
-				core.Warn.Println("heartbeat to", c.Url, "every", c.Interval, "failed, err is", err)
-			} else {
-				core.Info.Println("heartbeat to", c.Url, "every", c.Interval)
-			}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// for the error of api server maybe last for hours,
+	// never log the error every beat.
+	if err != nil {
+		h.lastError = err
+		h.failures++
+		h.fails++
+
+		if h.failures < c.Heartbeat.ErrorThreshold {
+			core.Ctx(ctx, core.Warn).Println("heartbeat to", c.Heartbeat.Url, "every", c.Heartbeat.Interval, "failed, err is", err)
+		} else if h.failures == c.Heartbeat.ErrorThreshold {
+			core.Ctx(ctx, core.Error).Println("heartbeat to", c.Heartbeat.Url, "failed", h.failures, "times, err is", err)
+		} else {
+			core.Ctx(ctx, core.Info).Println("heartbeat to", c.Heartbeat.Url, "failed", h.failures, "times, err is", err)
 		}
+		return
 	}
+
+	if h.failures >= c.Heartbeat.ErrorThreshold {
+		core.Ctx(ctx, core.Trace).Println("heartbeat to", c.Heartbeat.Url, "recovered after", h.failures, "failures")
+	}
+	h.lastError, h.lastSuccess, h.failures = nil, h.clock.Now(), 0
+	h.oks++
+	core.Ctx(ctx, core.Info).Println("heartbeat to", c.Heartbeat.Url, "every", c.Heartbeat.Interval)
+}
+
+// report with at most retries, the backoff is doubled for each retry,
+// abort when context cancelled, for example, the server quit.
+func (h *Heartbeat) reportRetry(ctx context.Context, c *Config) (err error) {
+	backoff := time.Duration(c.Heartbeat.RetryBackoffMs) * time.Millisecond
+	for i := 0; ; i++ {
+		if err = h.report(ctx, c, ""); err == nil || i >= c.Heartbeat.Retries {
+			return
+		}
+
+		core.Ctx(ctx, core.Info).Println("heartbeat retry", i+1, "in", backoff, "err is", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.clock.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// notify the heartbeat that server is running.
+func (h *Heartbeat) running(t time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.runTime = t
+}
+
+// the duration since server running, 0 when not running.
+func (h *Heartbeat) Uptime() time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.runTime.IsZero() {
+		return 0
+	}
+	return h.clock.Now().Sub(h.runTime)
+}
+
+// the error of last heartbeat, nil when ok.
+func (h *Heartbeat) LastError() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.lastError
+}
+
+// the continuous failures of heartbeat, 0 when last heartbeat ok.
+func (h *Heartbeat) Failures() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.failures
+}
+
+// the total heartbeats ok and failed.
+func (h *Heartbeat) Totals() (oks, fails int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.oks, h.fails
+}
+
+// the time of last heartbeat ok, zero when never ok.
+func (h *Heartbeat) LastSuccess() time.Time {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.lastSuccess
+}
+
+// interface ReloadChecker
+func (h *Heartbeat) CanReload(cc, pc *Config) (err error) {
+	return h.initialize(cc)
+}
+
+// interface ReloadHandler
+func (h *Heartbeat) OnReloadGlobal(scope int, cc, pc *Config) (err error) {
+	if scope != ReloadHeartbeat {
+		return
+	}
+
+	if err = h.initialize(cc); err != nil {
+		return
+	}
+	h.configure(cc)
+
+	// resolve the fresh url, the discovery will retry when failed.
+	if cc.Heartbeat.Enabled && cc.Heartbeat.Url != pc.Heartbeat.Url {
+		if err := h.resolve(cc.Heartbeat.Url); err != nil {
+			core.Warn.Println("heartbeat resolve", cc.Heartbeat.Url, "failed, err is", err)
+		}
+	}
+
+	// wakeup the beat cycle, drop the stale one not applied.
+	select {
+	case <-h.reloads:
+	default:
+	}
+	h.reloads <- cc
+	core.Trace.Println("reload heartbeat enabled", cc.Heartbeat.Enabled, "interval", cc.Heartbeat.Interval, "url", cc.Heartbeat.Url)
+
+	return
 }
 
 func (h *Heartbeat) discovery() (err error) {
@@ -131,7 +383,7 @@ func (h *Heartbeat) discovery() (err error) {
 			if v, ok := ipf(addr); ok {
 				core.Trace.Println("iface", iface.Name, "ip is", v)
 				h.ips = append(h.ips, v)
-			} else {
+			} else if core.LogEnabled(core.LogLevelInfo) {
 				core.Info.Println("iface", iface.Name, addr, reflect.TypeOf(addr))
 			}
 		}
@@ -139,35 +391,121 @@ func (h *Heartbeat) discovery() (err error) {
 
 	// choose one as exported network address.
 	if len(h.ips) > 0 {
-		h.exportIp = h.ips[Conf.Stat.Network%len(h.ips)]
+		h.exportIp = h.ips[h.config().Stat.Network%len(h.ips)]
 	}
 	return
 }
 
-func (h *Heartbeat) beat() (err error) {
+// resolve the host of collector url,
+// and the beat will use the fresh ip for the dns maybe changed.
+func (h *Heartbeat) resolve(collector string) (err error) {
+	var u *url.URL
+	if u, err = url.Parse(collector); err != nil {
+		return
+	}
+
+	// resolve without lock, for dns maybe slow.
+	host := u.Hostname()
+	var ips []string
+	if ips, err = h.resolver(host); err != nil {
+		return
+	}
+	if len(ips) <= 0 {
+		core.Warn.Println("heartbeat resolve", host, "empty")
+		return
+	}
+
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
-	if len(h.exportIp) <= 0 {
+	// the collector is changed, drop the connections to the stale ip.
+	if host != h.host || ips[0] != h.collector {
+		if h.host == host && len(h.collector) > 0 {
+			core.Trace.Println("heartbeat collector", host, "changed from", h.collector, "to", ips[0])
+		} else {
+			core.Trace.Println("heartbeat collector", host, "resolved to", ips[0])
+		}
+		h.transport.CloseIdleConnections()
+	}
+
+	h.host, h.collector = host, ips[0]
+	return
+}
+
+// dial the collector by the resolved ip,
+// or use the address when not resolved.
+func (h *Heartbeat) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		h.lock.Lock()
+		if host == h.host && len(h.collector) > 0 {
+			addr = net.JoinHostPort(h.collector, port)
+		}
+		h.lock.Unlock()
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func (h *Heartbeat) beat() (err error) {
+	return h.report(context.Background(), h.config(), "")
+}
+
+// the best-effort final beat with status shutting_down, in a short timeout.
+func (h *Heartbeat) finalBeat(c *Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), heartbeatFinalTimeout)
+	defer cancel()
+
+	if err := h.report(ctx, c, "shutting_down"); err != nil {
+		core.Warn.Println("final heartbeat to", c.Heartbeat.Url, "failed, err is", err)
+		return
+	}
+	core.Trace.Println("final heartbeat to", c.Heartbeat.Url, "ok")
+}
+
+// report to collector of config with the status, empty status is ignored.
+func (h *Heartbeat) report(ctx context.Context, cc *Config, status string) (err error) {
+	// never lock when post to collector,
+	// for the dial need to fetch the resolved ip.
+	h.lock.Lock()
+	exportIp, runTime, client := h.exportIp, h.runTime, h.client
+	h.lock.Unlock()
+
+	if len(exportIp) <= 0 {
 		core.Info.Println("heartbeat not ready.")
 		return
 	}
 
-	v := struct {
-		DeviceId string      `json:"device_id"`
-		Ip       string      `json:"ip"`
-		Summary  interface{} `json:"summaries,omitempty"`
-	}{}
+	// the extra fields, never override the standard fields.
+	c := &cc.Heartbeat
+	v := map[string]interface{}{}
+	for k, e := range c.Extra {
+		v[k] = e
+	}
+
+	v["device_id"] = c.DeviceId
+	if len(c.DeviceId) == 0 {
+		v["device_id"], _ = os.Hostname()
+	}
+	v["ip"] = exportIp
+	v["port"] = cc.Listen
+	v["pid"] = os.Getpid()
+	v["version"] = core.FullVersion()
 
-	c := &Conf.Heartbeat
-	v.DeviceId = c.DeviceId
-	v.Ip = h.exportIp
+	v["uptime"] = 0
+	if !runTime.IsZero() {
+		v["uptime"] = int64(h.clock.Now().Sub(runTime) / time.Second)
+	}
+
+	if len(status) > 0 {
+		v["status"] = status
+	}
 
 	if c.Summary {
-		s := NewSummary()
+		s := NewSummary(cc)
 		s.Ok = true
 
-		v.Summary = struct {
+		v["summaries"] = struct {
 			Code int      `json:"code"`
 			Data *Summary `json:"data"`
 		}{
@@ -180,14 +518,41 @@ func (h *Heartbeat) beat() (err error) {
 	if b, err = json.Marshal(&v); err != nil {
 		return
 	}
-	core.Info.Println("heartbeat info is", string(b))
+	if core.LogEnabled(core.LogLevelInfo) {
+		core.Info.Println("heartbeat info is", string(b))
+	}
 
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, "POST", c.Url, bytes.NewReader(b)); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", core.HttpJson)
+
+	// never log the token, for the url in log is the config url.
+	if len(c.Token) > 0 && len(c.TokenParam) > 0 {
+		q := req.URL.Query()
+		q.Set(c.TokenParam, c.Token)
+		req.URL.RawQuery = q.Encode()
+	} else if len(c.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	defer logSlow("heartbeat to "+c.Url, cc.Slow.HeartbeatMs, time.Now())
+
+	// the url of error maybe has the token in query, use the config url.
 	var resp *http.Response
-	if resp, err = http.Post(c.Url, core.HttpJson, bytes.NewReader(b)); err != nil {
+	if resp, err = client.Do(req); err != nil {
+		if v, ok := err.(*url.Error); ok {
+			err = &url.Error{Op: v.Op, URL: c.Url, Err: v.Err}
+		}
 		return
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode/100 != 2 {
+		return errors.New(fmt.Sprintf("heartbeat response status %v", resp.Status))
+	}
+
 	core.Info.Println("heartbeat to", c.Url, "ok")
 	return
 }
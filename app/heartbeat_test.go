@@ -0,0 +1,450 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/ossrs/go-oryx/core"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatResolve(t *testing.T) {
+	var hits int
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer svr.Close()
+
+	_, port, err := net.SplitHostPort(svr.Listener.Addr().String())
+	if err != nil {
+		t.Fatal("parse server addr failed, err is", err)
+	}
+
+	// the collector dns is changed from a stale ip to the server.
+	ip := "127.0.0.2"
+	h := NewHeartbeat()
+	h.exportIp = "192.168.1.100"
+	h.resolver = func(host string) ([]string, error) {
+		if host != "collector.oryx" {
+			t.Error("resolve invalid host", host)
+		}
+		return []string{ip}, nil
+	}
+
+	pc := GetConfig()
+	defer func() {
+		SetConfig(pc)
+	}()
+	SetConfig(NewConfig())
+	GetConfig().Heartbeat.Url = "http://collector.oryx:" + port + "/api/v1/servers"
+
+	if err := h.resolve(GetConfig().Heartbeat.Url); err != nil {
+		t.Error("resolve failed, err is", err)
+	}
+	if h.host != "collector.oryx" || h.collector != "127.0.0.2" {
+		t.Error("resolve invalid collector", h.host, h.collector)
+	}
+
+	ip = "127.0.0.1"
+	if err := h.resolve(GetConfig().Heartbeat.Url); err != nil {
+		t.Error("resolve failed, err is", err)
+	}
+	if h.collector != "127.0.0.1" {
+		t.Error("collector not changed, actual is", h.collector)
+	}
+
+	if err := h.beat(); err != nil {
+		t.Error("beat to changed collector failed, err is", err)
+	}
+	if hits != 1 {
+		t.Error("beat should hit the server, actual is", hits)
+	}
+}
+
+func TestHeartbeatFinalBeat(t *testing.T) {
+	status := make(chan string, 1)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := struct {
+			Status string `json:"status"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&v)
+		status <- v.Status
+	}))
+	defer svr.Close()
+
+	pc := GetConfig()
+	defer func() {
+		SetConfig(pc)
+	}()
+	SetConfig(NewConfig())
+	GetConfig().Heartbeat.Enabled = true
+	GetConfig().Heartbeat.FinalBeat = true
+	GetConfig().Heartbeat.Interval = 3600
+	GetConfig().Heartbeat.Url = svr.URL + "/api/v1/servers"
+
+	h := NewHeartbeat()
+	h.exportIp = "192.168.1.100"
+
+	s := NewServer()
+	defer s.Close()
+
+	s.GFork("htbt(main)", h.beatCycle)
+	s.Quit()
+	s.waitWorkers()
+
+	select {
+	case v := <-status:
+		if v != "shutting_down" {
+			t.Error("invalid final status", v)
+		}
+	default:
+		t.Error("should final beat before worker stop")
+	}
+}
+
+func TestHeartbeatReload(t *testing.T) {
+	hits := make(chan string, 1)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case hits <- r.URL.Path:
+		default:
+		}
+	}))
+	defer svr.Close()
+
+	pc := GetConfig()
+	defer func() {
+		SetConfig(pc)
+	}()
+	SetConfig(NewConfig())
+	GetConfig().Heartbeat.Interval = 3600
+
+	h := NewHeartbeat()
+	h.exportIp = "192.168.1.100"
+
+	s := NewServer()
+	defer s.Close()
+	s.GFork("htbt(main)", h.beatCycle)
+
+	// invalid url is rejected.
+	cc := NewConfig()
+	cc.Heartbeat.Enabled = true
+	cc.Heartbeat.Url = "ftp://127.0.0.1"
+	if err := h.OnReloadGlobal(ReloadHeartbeat, cc, GetConfig()); err == nil {
+		t.Error("should reject invalid url")
+	}
+
+	// enable and apply the fresh interval without waiting the previous one.
+	cc.Heartbeat.Interval = 0.01
+	cc.Heartbeat.Url = svr.URL + "/api/v2/servers"
+	if err := h.OnReloadGlobal(ReloadHeartbeat, cc, GetConfig()); err != nil {
+		t.Error("reload failed, err is", err)
+	}
+
+	select {
+	case v := <-hits:
+		if v != "/api/v2/servers" {
+			t.Error("should beat to fresh url, actual is", v)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("should beat in fresh interval")
+	}
+
+	s.Quit()
+	s.waitWorkers()
+}
+
+func TestHeartbeatTls(t *testing.T) {
+	auths := make(chan string, 1)
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths <- r.Header.Get("Authorization") + r.URL.Query().Get("token")
+	}))
+	defer svr.Close()
+
+	pc := GetConfig()
+	defer func() {
+		SetConfig(pc)
+	}()
+	SetConfig(NewConfig())
+	GetConfig().Heartbeat.Enabled = true
+	GetConfig().Heartbeat.Url = svr.URL + "/api/v1/servers"
+
+	h := NewHeartbeat()
+	h.exportIp = "192.168.1.100"
+
+	// the self-signed certificate is rejected by default.
+	if err := h.report(context.Background(), GetConfig(), ""); err == nil {
+		t.Error("should reject the self-signed certificate")
+	}
+
+	// reload to skip verify and auth by bearer token.
+	cc := NewConfig()
+	cc.Heartbeat = GetConfig().Heartbeat
+	cc.Heartbeat.InsecureSkipVerify = true
+	cc.Heartbeat.Token = "t0k"
+	if err := h.OnReloadGlobal(ReloadHeartbeat, cc, GetConfig()); err != nil {
+		t.Fatal("reload failed, err is", err)
+	}
+	if err := h.report(context.Background(), cc, ""); err != nil {
+		t.Error("heartbeat failed, err is", err)
+	} else if v := <-auths; v != "Bearer t0k" {
+		t.Error("should auth by bearer, actual is", v)
+	}
+
+	// auth by query param.
+	cc.Heartbeat.TokenParam = "token"
+	if err := h.report(context.Background(), cc, ""); err != nil {
+		t.Error("heartbeat failed, err is", err)
+	} else if v := <-auths; v != "t0k" {
+		t.Error("should auth by query, actual is", v)
+	}
+}
+
+func TestHeartbeatTokenLeak(t *testing.T) {
+	defer restoreGlobals()()
+	var b bytes.Buffer
+	core.Info = log.New(&b, core.LogInfoLabel, 0)
+	core.Warn = log.New(&b, core.LogWarnLabel, 0)
+	core.Error = log.New(&b, core.LogErrorLabel, 0)
+
+	// the closed server to fail the request.
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	svr.Close()
+
+	SetConfig(NewConfig())
+	c := GetConfig()
+	c.Heartbeat.Enabled = true
+	c.Heartbeat.Url = svr.URL + "/api/v1/servers"
+	c.Heartbeat.Retries = 0
+	c.Heartbeat.Token, c.Heartbeat.TokenParam = "s3cr3t", "token"
+
+	h := NewHeartbeat()
+	h.exportIp = "192.168.1.100"
+	h.heartbeat(context.Background(), c)
+
+	if err := h.LastError(); err == nil {
+		t.Fatal("heartbeat should fail")
+	} else if strings.Contains(err.Error(), "s3cr3t") || !strings.Contains(err.Error(), c.Heartbeat.Url) {
+		t.Error("should use the config url in error, actual is", err)
+	}
+	if v := b.String(); strings.Contains(v, "s3cr3t") || !strings.Contains(v, "failed") {
+		t.Error("should never log the token, actual is", v)
+	}
+}
+
+func TestHeartbeatClock(t *testing.T) {
+	hits := make(chan bool, 1)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits <- true
+	}))
+	defer svr.Close()
+
+	pc := GetConfig()
+	defer func() {
+		SetConfig(pc)
+	}()
+	SetConfig(NewConfig())
+	GetConfig().Heartbeat.Enabled = true
+	GetConfig().Heartbeat.Interval = 10
+	GetConfig().Heartbeat.Url = svr.URL + "/api/v1/servers"
+
+	clock := core.NewFakeClock(time.Unix(1000, 0))
+	h := NewHeartbeat()
+	h.exportIp = "192.168.1.100"
+	h.clock = clock
+
+	s := NewServer()
+	defer s.Close()
+	s.GFork("htbt(main)", h.beatCycle)
+
+	for i := 0; i < 100 && clock.Timers() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(9 * time.Second)
+	select {
+	case <-hits:
+		t.Error("should not beat before the interval")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-hits:
+	case <-time.After(3 * time.Second):
+		t.Error("should beat on the interval")
+	}
+
+	s.Quit()
+	s.waitWorkers()
+}
+
+func TestHeartbeatRetry(t *testing.T) {
+	var lock sync.Mutex
+	var requests, fails int
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if requests++; requests <= fails {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer svr.Close()
+
+	var tank bytes.Buffer
+	defer restoreGlobals()()
+	core.Error = log.New(&tank, core.LogErrorLabel, log.LstdFlags)
+
+	SetConfig(NewConfig())
+	GetConfig().Heartbeat.Url = svr.URL + "/api/v1/servers"
+	GetConfig().Heartbeat.RetryBackoffMs = 1
+	GetConfig().Heartbeat.ErrorThreshold = 2
+
+	h := NewHeartbeat()
+	h.exportIp = "192.168.1.100"
+	ctx := context.Background()
+
+	// ok after retries.
+	fails = 2
+	h.heartbeat(ctx, GetConfig())
+	if h.LastError() != nil || h.LastSuccess().IsZero() || requests != 3 {
+		t.Error("should ok after retries, requests", requests, "err is", h.LastError())
+	}
+
+	// failed continuously, log error once.
+	requests, fails = 0, 100
+	for i := 0; i < 4; i++ {
+		h.heartbeat(ctx, GetConfig())
+	}
+	if h.LastError() == nil || requests != 12 {
+		t.Error("should failed, requests", requests, "err is", h.LastError())
+	}
+	if v := tank.String(); strings.Count(v, "failed 2 times") != 1 || strings.Count(v, "[oryx][error]") != 1 {
+		t.Error("should log error once, actual is", v)
+	}
+
+	// never wait for backoff when quit.
+	GetConfig().Heartbeat.RetryBackoffMs = 3600 * 1000
+	ctx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	starttime := time.Now()
+	if err := h.reportRetry(ctx, GetConfig()); err == nil {
+		t.Error("should failed")
+	}
+	if d := time.Since(starttime); d > 3*time.Second {
+		t.Error("should abort the backoff when quit, cost", d)
+	}
+}
+
+func TestHeartbeatPayload(t *testing.T) {
+	body := make(chan map[string]interface{}, 1)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&v)
+		body <- v
+	}))
+	defer svr.Close()
+
+	c := NewConfig()
+	c.Heartbeat.Url = svr.URL + "/api/v1/servers"
+	c.Heartbeat.DeviceId = ""
+	c.Heartbeat.Extra = map[string]string{"region": "sh", "pid": "override"}
+
+	h := NewHeartbeat()
+	h.exportIp = "192.168.1.100"
+	h.running(time.Now().Add(-10 * time.Second))
+
+	if err := h.report(context.Background(), c, ""); err != nil {
+		t.Fatal("report failed, err is", err)
+	}
+
+	v := <-body
+	host, _ := os.Hostname()
+	if v["device_id"] != host || v["ip"] != "192.168.1.100" || v["port"] != float64(c.Listen) {
+		t.Error("invalid standard fields", v)
+	}
+	if v["pid"] != float64(os.Getpid()) || v["uptime"].(float64) < 10 {
+		t.Error("invalid pid or uptime", v)
+	}
+	if v["version"] != core.FullVersion() {
+		t.Error("invalid version", v)
+	}
+	if v["region"] != "sh" {
+		t.Error("invalid extra fields", v)
+	}
+	if _, ok := v["status"]; ok {
+		t.Error("should no status", v)
+	}
+}
+
+func TestHeartbeatSummaryInjected(t *testing.T) {
+	defer restoreGlobals()()
+
+	body := make(chan map[string]interface{}, 1)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&v)
+		body <- v
+	}))
+	defer svr.Close()
+
+	// the global config and the injected config loads from different files.
+	SetConfig(NewConfig())
+	if err := GetConfig().Loads(writeTestConfig(t, `{"workers": 1}`)); err != nil {
+		t.Fatal("loads global failed, err is", err)
+	}
+	f := writeTestConfig(t, `{"workers": 2}`)
+	c := NewConfig()
+	if err := c.Loads(f); err != nil {
+		t.Fatal("loads injected failed, err is", err)
+	}
+	c.Heartbeat.Url = svr.URL + "/api/v1/servers"
+	c.Heartbeat.Summary = true
+
+	s := NewServerWithConfig(c)
+	defer s.Close()
+	s.htbt.exportIp = "192.168.1.100"
+
+	if err := s.htbt.report(context.Background(), s.config(), ""); err != nil {
+		t.Fatal("report failed, err is", err)
+	}
+
+	v := <-body
+	summaries, _ := v["summaries"].(map[string]interface{})
+	data, _ := summaries["data"].(map[string]interface{})
+	config, _ := data["config"].(map[string]interface{})
+	if config["path"] != f {
+		t.Error("summary should be the injected config, actual is", v["summaries"])
+	}
+}
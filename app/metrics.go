@@ -0,0 +1,114 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync"
+)
+
+// the metric in prometheus text format,
+// the value is fetched when scrape, never cached.
+type metric struct {
+	name  string
+	typ   string // counter or gauge.
+	help  string
+	value func() float64
+}
+
+// the registry of metrics, write in prometheus text format.
+type metricsRegistry struct {
+	metrics []*metric
+	lock    sync.Mutex
+}
+
+// register the metric, the value fetched when scrape.
+func (r *metricsRegistry) register(name, typ, help string, value func() float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.metrics = append(r.metrics, &metric{name: name, typ: typ, help: help, value: value})
+}
+
+// write all metrics in prometheus text format, in register order.
+func (r *metricsRegistry) WriteTo(w io.Writer) (n int64, err error) {
+	r.lock.Lock()
+	metrics := append([]*metric{}, r.metrics...)
+	r.lock.Unlock()
+
+	for _, m := range metrics {
+		var nn int
+		if nn, err = fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v %v\n", m.name, m.help, m.name, m.typ, m.name, m.value()); err != nil {
+			return
+		}
+		n += int64(nn)
+	}
+
+	return
+}
+
+// the metrics of server.
+func newMetrics(s *Server) *metricsRegistry {
+	r := &metricsRegistry{}
+
+	workers := func(f func() int) func() float64 {
+		return func() float64 {
+			s.workersLock.Lock()
+			defer s.workersLock.Unlock()
+			return float64(f())
+		}
+	}
+	r.register("oryx_workers", "gauge", "The running workers.", workers(func() int {
+		return len(s.workers)
+	}))
+	r.register("oryx_worker_panics_total", "counter", "The total panics of workers.", workers(func() int {
+		return s.panics
+	}))
+	r.register("oryx_worker_restarts_total", "counter", "The total restarts of workers.", workers(func() int {
+		return s.restarts
+	}))
+
+	r.register("oryx_heartbeat_success_total", "counter", "The total heartbeats ok.", func() float64 {
+		v, _ := s.htbt.Totals()
+		return float64(v)
+	})
+	r.register("oryx_heartbeat_failure_total", "counter", "The total heartbeats failed.", func() float64 {
+		_, v := s.htbt.Totals()
+		return float64(v)
+	})
+
+	r.register("oryx_last_gc_timestamp_seconds", "gauge", "The time of last gc, 0 when never gc.", func() float64 {
+		var stats debug.GCStats
+		debug.ReadGCStats(&stats)
+		if stats.LastGC.IsZero() {
+			return 0
+		}
+		return float64(stats.LastGC.UnixNano()) / 1e9
+	})
+	r.register("oryx_gomaxprocs", "gauge", "The GOMAXPROCS.", func() float64 {
+		return float64(s.gomaxprocs(0))
+	})
+
+	return r
+}
@@ -0,0 +1,93 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	r := &metricsRegistry{}
+
+	var v float64
+	r.register("oryx_test", "gauge", "The test.", func() float64 {
+		return v
+	})
+
+	for _, e := range []struct {
+		v      float64
+		expect string
+	}{
+		{1, "oryx_test 1\n"},
+		{2.5, "oryx_test 2.5\n"},
+	} {
+		v = e.v
+
+		var b bytes.Buffer
+		if _, err := r.WriteTo(&b); err != nil {
+			t.Fatal("write failed, err is", err)
+		}
+		if b.String() != "# HELP oryx_test The test.\n# TYPE oryx_test gauge\n"+e.expect {
+			t.Error("invalid metrics", b.String())
+		}
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	svr := NewServer()
+	defer svr.Close()
+	svr.gomaxprocs = func(n int) int {
+		return 3
+	}
+
+	svr.GFork("worker", func(wc WorkerContainer) {
+		<-wc.QC()
+		wc.Quit()
+	})
+	svr.htbt.oks, svr.htbt.fails = 10, 2
+	runtime.GC()
+
+	var b bytes.Buffer
+	svr.metrics.WriteTo(&b)
+	v := b.String()
+	for _, m := range []string{"\noryx_workers 1\n", "\noryx_worker_panics_total 0\n", "\noryx_worker_restarts_total 0\n",
+		"\noryx_heartbeat_success_total 10\n", "\noryx_heartbeat_failure_total 2\n", "\noryx_gomaxprocs 3\n"} {
+		if !strings.Contains(v, m) {
+			t.Error("should contains", strings.TrimSpace(m), "actual is", v)
+		}
+	}
+	if strings.Contains(v, "\noryx_last_gc_timestamp_seconds 0\n") {
+		t.Error("should report the last gc, actual is", v)
+	}
+
+	// the live value when scrape.
+	svr.Quit()
+	svr.waitWorkers()
+	b.Reset()
+	svr.metrics.WriteTo(&b)
+	if v := b.String(); !strings.Contains(v, "\noryx_workers 0\n") {
+		t.Error("should report the live workers, actual is", v)
+	}
+}
@@ -0,0 +1,76 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ossrs/go-oryx/core"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// write the pid of current process to file,
+// fail when the file exists and the pid in it is alive,
+// except the parent when upgrading, which quit after this process ready.
+func writePidFile(file string) (err error) {
+	if b, err := ioutil.ReadFile(file); err == nil {
+		if pid := readPid(b); pid > 0 && pid != os.Getpid() && processAlive(pid) {
+			if !Upgrading() || pid != os.Getppid() {
+				return errors.New(fmt.Sprintf("pid file %v exists and process %v is alive", file, pid))
+			}
+		}
+		core.Warn.Println("overwrite stale pid file", file)
+	}
+
+	if err = ioutil.WriteFile(file, []byte(fmt.Sprintf("%v\n", os.Getpid())), 0644); err != nil {
+		return
+	}
+	core.Trace.Println("write pid", os.Getpid(), "to", file)
+
+	return
+}
+
+// parse the pid in file, 0 when invalid.
+func readPid(b []byte) int {
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+		return pid
+	}
+	return 0
+}
+
+// remove the pid file written by writePidFile,
+// ignore when overwritten by others, for example, the upgraded process.
+func removePidFile(file string) {
+	if b, err := ioutil.ReadFile(file); err == nil && readPid(b) != os.Getpid() {
+		core.Trace.Println("ignore pid file", file, "overwritten by pid", readPid(b))
+		return
+	}
+
+	if err := os.Remove(file); err != nil {
+		core.Warn.Println("remove pid file", file, "failed, err is", err)
+		return
+	}
+	core.Trace.Println("remove pid file", file, "ok")
+}
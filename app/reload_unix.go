@@ -26,54 +26,21 @@
 package app
 
 import (
-	"github.com/ossrs/go-oryx/core"
 	"os"
-	"os/signal"
 	"syscall"
 )
 
-func (c *Config) reloadCycle(wc WorkerContainer) {
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGHUP)
+// whether support reload by signal.
+const reloadBySignal = true
 
-	core.Trace.Println("wait for reload signals: kill -1", os.Getpid())
-	for {
-		select {
-		case signal := <-signals:
-			core.Trace.Println("start reload by", signal)
+// the signal to reopen the log files, for logrotate.
+var reopenSignal os.Signal = syscall.SIGUSR1
 
-			if err := c.doReload(); err != nil {
-				core.Error.Println("quit for reload failed. err is", err)
-				wc.Quit()
-				return
-			}
+// the signal to upgrade the binary without downtime.
+var upgradeSignal os.Signal = syscall.SIGUSR2
 
-		case <-wc.QC():
-			core.Warn.Println("user stop reload")
-			wc.Quit()
-			return
-		}
-	}
-}
+// the signals to handle, others are not notified.
+var serverSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, reopenSignal, upgradeSignal}
 
-func (c *Config) doReload() (err error) {
-	pc := c
-	cc := NewConfig()
-	cc.reloadHandlers = pc.reloadHandlers[:]
-	if err = cc.Loads(c.conf); err != nil {
-		core.Error.Println("reload config failed. err is", err)
-		return
-	}
-	core.Info.Println("reload parse fresh config ok")
-
-	if err = pc.Reload(cc); err != nil {
-		core.Error.Println("apply reload failed. err is", err)
-		return
-	}
-	core.Info.Println("reload completed work")
-
-	Conf = cc
-	core.Trace.Println("reload config ok")
-
-	return
-}
+// the signals to ignore, for example, SIGPIPE when write to the closed socket.
+var ignoreSignals = []os.Signal{syscall.SIGPIPE}
@@ -24,13 +24,21 @@
 package app
 
 import (
-	"github.com/ossrs/go-oryx/core"
+	"os"
+	"syscall"
 )
 
-func (c *Config) reloadCycle(wc WorkerContainer) {
-	core.Warn.Println("windows does not support reload with signal.")
+// whether support reload by signal.
+const reloadBySignal = false
 
-	// wait for server to quit.
-	<-wc.QC()
-	wc.Quit()
-}
+// windows does not support reopen the log files by signal.
+var reopenSignal os.Signal
+
+// windows does not support upgrade by signal.
+var upgradeSignal os.Signal
+
+// the signals to handle, others are not notified.
+var serverSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// windows has no signals to ignore.
+var ignoreSignals []os.Signal
@@ -0,0 +1,330 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// the json schema of config, to validate the config files when schema is true.
+// @remark update it when add or change the fields of Config, see TestConfigSchemaFields.
+const configSchema = `{
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "workers": {"type": "integer", "minimum": 0, "maximum": 64},
+    "listen": {"type": "integer", "minimum": 1, "maximum": 65535},
+    "daemon": {"type": "boolean"},
+    "strict": {"type": "boolean"},
+    "schema": {"type": "boolean"},
+    "pid_file": {"type": "string"},
+    "include": {"type": "array", "items": {"type": "string"}},
+    "go": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "gc_interval": {"type": "integer", "minimum": 0, "maximum": 86400},
+        "gc_after_init": {"type": "boolean"},
+        "gc_percent": {"type": "integer"},
+        "workers_ramp_ms": {"type": "integer", "minimum": 0},
+        "panic_policy": {"type": "string", "enum": ["quit", "crash", "restart"]},
+        "liveness_ms": {"type": "integer", "minimum": 0},
+        "liveness_panic": {"type": "boolean"},
+        "max_lifetime": {"type": "integer", "minimum": 0}
+      }
+    },
+    "shutdown": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "policy": {"type": "string", "enum": ["wait", "abandon"]},
+        "watchdog_ms": {"type": "integer", "minimum": 0},
+        "grace_ms": {"type": "integer", "minimum": 0}
+      }
+    },
+    "slow": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "reload_ms": {"type": "integer", "minimum": 0},
+        "heartbeat_ms": {"type": "integer", "minimum": 0}
+      }
+    },
+    "debug": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "assert_clean_shutdown": {"type": "boolean"}
+      }
+    },
+    "reload": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "concurrency": {"type": "integer", "minimum": 0},
+        "history": {"type": "integer", "minimum": 0},
+        "watch": {"type": "boolean"},
+        "debounce_ms": {"type": "integer", "minimum": 0}
+      }
+    },
+    "log": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "tank": {"type": "string", "enum": ["console", "file", "syslog"]},
+        "level": {"type": "string", "enum": ["info", "trace", "warn", "error"]},
+        "file": {"type": "string"},
+        "format": {"type": "string", "enum": ["text", "json"]},
+        "prefix_template": {"type": "string"},
+        "time_format": {"type": "string"},
+        "utc": {"type": "boolean"},
+        "error_tank": {"type": "string", "enum": ["", "console", "file", "syslog"]},
+        "error_file": {"type": "string"},
+        "error_tank_warn": {"type": "boolean"},
+        "max_size_mb": {"type": "integer", "minimum": 0},
+        "daily": {"type": "boolean"},
+        "max_backups": {"type": "integer", "minimum": 0},
+        "max_lines_per_sec": {"type": "integer", "minimum": 0},
+        "coalesce_ms": {"type": "integer", "minimum": 0},
+        "modules": {"type": "object", "additionalProperties": {"type": "string", "enum": ["info", "trace", "warn", "error"]}},
+        "async": {"type": "boolean"},
+        "buffer_size": {"type": "integer", "minimum": 1},
+        "overflow_policy": {"type": "string", "enum": ["block", "drop"]},
+        "tail_size": {"type": "integer", "minimum": 0},
+        "dir_perm": {"type": "string"},
+        "open_retries": {"type": "integer", "minimum": 0},
+        "syslog": {
+          "type": "object",
+          "additionalProperties": false,
+          "properties": {
+            "facility": {"type": "string"},
+            "tag": {"type": "string"}
+          }
+        }
+      }
+    },
+    "heartbeat": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "enabled": {"type": "boolean"},
+        "interval": {"type": "number"},
+        "url": {"type": "string"},
+        "device_id": {"type": "string"},
+        "summaries": {"type": "boolean"},
+        "discovery_interval_ms": {"type": "integer", "minimum": 1},
+        "final_beat": {"type": "boolean"},
+        "extra": {"type": "object", "additionalProperties": {"type": "string"}},
+        "retries": {"type": "integer", "minimum": 0},
+        "retry_backoff_ms": {"type": "integer", "minimum": 0},
+        "error_threshold": {"type": "integer", "minimum": 1},
+        "token": {"type": "string"},
+        "token_param": {"type": "string"},
+        "insecure_skip_verify": {"type": "boolean"},
+        "timeout_ms": {"type": "integer", "minimum": 1}
+      }
+    },
+    "stats": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "network": {"type": "integer", "minimum": 0},
+        "disk": {"type": "array", "items": {"type": "string"}}
+      }
+    },
+    "api": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "listen": {"type": "string"},
+        "socket_perm": {"type": "string"}
+      }
+    },
+    "statsd": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "addr": {"type": "string"},
+        "prefix": {"type": "string"},
+        "interval_ms": {"type": "integer", "minimum": 1}
+      }
+    }
+  }
+}`
+
+// the subset of json schema, for the config schema only.
+type jsonSchema struct {
+	Type       string                 `json:"type"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	// false to deny the unknown properties, or the schema of them, nil to allow any.
+	Additional json.RawMessage `json:"additionalProperties"`
+	Items      *jsonSchema     `json:"items"`
+	Enum       []interface{}   `json:"enum"`
+	Minimum    *float64        `json:"minimum"`
+	Maximum    *float64        `json:"maximum"`
+}
+
+// parse the schema from json.
+func parseSchema(s string) (*jsonSchema, error) {
+	v := &jsonSchema{}
+	if err := json.Unmarshal([]byte(s), v); err != nil {
+		return nil, errors.New(fmt.Sprintf("parse schema failed, err is %v", err))
+	}
+	return v, nil
+}
+
+// validate the config content b of source against the config schema,
+// when enabled by the including file or the schema of content.
+// the errors are ConfigErrors of all violations, with the path of field.
+func checkSchema(source string, b []byte, enabled bool) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("loads config from %v failed, err is %w", source, err)
+	}
+
+	if m, ok := v.(map[string]interface{}); ok && m["schema"] == true {
+		enabled = true
+	}
+	if !enabled {
+		return nil
+	}
+
+	s, err := parseSchema(configSchema)
+	if err != nil {
+		return err
+	}
+
+	if errs := s.validate("", v); len(errs) > 0 {
+		return fmt.Errorf("config %v violates schema, %w", source, errs)
+	}
+	return nil
+}
+
+// validate the value v at path, return the violations.
+func (s *jsonSchema) validate(path string, v interface{}) (errs ConfigErrors) {
+	name := path
+	if len(name) == 0 {
+		name = "config"
+	}
+
+	if actual := schemaType(v); len(s.Type) > 0 && actual != s.Type && !(s.Type == "number" && actual == "integer") {
+		return append(errs, errors.New(fmt.Sprintf("%v must be %v, actual is %v", name, s.Type, actual)))
+	}
+
+	if len(s.Enum) > 0 {
+		ok := false
+		for _, e := range s.Enum {
+			ok = ok || reflect.DeepEqual(e, v)
+		}
+		if !ok {
+			var enums []string
+			for _, e := range s.Enum {
+				enums = append(enums, fmt.Sprint(e))
+			}
+			errs = append(errs, errors.New(fmt.Sprintf("%v must be %v, actual is %v", name, strings.Join(enums, "/"), v)))
+		}
+	}
+
+	if f, ok := v.(float64); ok {
+		if s.Minimum != nil && f < *s.Minimum {
+			errs = append(errs, errors.New(fmt.Sprintf("%v must >= %v, actual is %v", name, *s.Minimum, f)))
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			errs = append(errs, errors.New(fmt.Sprintf("%v must <= %v, actual is %v", name, *s.Maximum, f)))
+		}
+	}
+
+	switch v := v.(type) {
+	case []interface{}:
+		if s.Items != nil {
+			for i, e := range v {
+				errs = append(errs, s.Items.validate(fmt.Sprintf("%v[%v]", name, i), e)...)
+			}
+		}
+	case map[string]interface{}:
+		// the sorted keys, for the errors in stable order.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			field := k
+			if len(path) > 0 {
+				field = path + "." + k
+			}
+
+			if p, ok := s.Properties[k]; ok {
+				errs = append(errs, p.validate(field, v[k])...)
+			} else if err := s.validateAdditional(field, v[k]); err != nil {
+				errs = append(errs, err...)
+			}
+		}
+	}
+
+	return
+}
+
+// validate the unknown property by additionalProperties.
+func (s *jsonSchema) validateAdditional(path string, v interface{}) ConfigErrors {
+	if len(s.Additional) == 0 || string(s.Additional) == "true" {
+		return nil
+	}
+	if string(s.Additional) == "false" {
+		return ConfigErrors{errors.New(fmt.Sprintf("%v is unknown", path))}
+	}
+
+	a, err := parseSchema(string(s.Additional))
+	if err != nil {
+		return ConfigErrors{err}
+	}
+	return a.validate(path, v)
+}
+
+// the json schema type of value decoded by json.
+func schemaType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
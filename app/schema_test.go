@@ -0,0 +1,134 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigSchemaFields(t *testing.T) {
+	s, err := parseSchema(configSchema)
+	if err != nil {
+		t.Fatal("parse schema failed, err is", err)
+	}
+
+	// each json field of config must in schema with the same type.
+	var check func(path string, tp reflect.Type, s *jsonSchema)
+	check = func(path string, tp reflect.Type, s *jsonSchema) {
+		expect := map[reflect.Kind]string{
+			reflect.Struct: "object", reflect.Map: "object", reflect.Slice: "array",
+			reflect.String: "string", reflect.Bool: "boolean", reflect.Int: "integer", reflect.Float64: "number",
+		}[tp.Kind()]
+		if s.Type != expect {
+			t.Error("schema of", path, "should be", expect, "actual is", s.Type)
+			return
+		}
+
+		switch tp.Kind() {
+		case reflect.Slice:
+			check(path+"[]", tp.Elem(), s.Items)
+		case reflect.Map:
+			a, err := parseSchema(string(s.Additional))
+			if err != nil {
+				t.Error("schema of", path, "invalid, err is", err)
+				return
+			}
+			check(path+".*", tp.Elem(), a)
+		case reflect.Struct:
+			fields := 0
+			for i := 0; i < tp.NumField(); i++ {
+				f := tp.Field(i)
+				name := strings.Split(f.Tag.Get("json"), ",")[0]
+				if len(f.PkgPath) > 0 || name == "-" {
+					continue
+				}
+				if len(name) == 0 {
+					name = strings.ToLower(f.Name)
+				}
+				fields++
+
+				if p, ok := s.Properties[name]; !ok {
+					t.Error("schema should have", path+"."+name)
+				} else {
+					check(path+"."+name, f.Type, p)
+				}
+			}
+			if fields != len(s.Properties) {
+				t.Error("schema of", path, "should have", fields, "properties, actual is", len(s.Properties))
+			}
+		}
+	}
+	check("config", reflect.TypeOf(Config{}), s)
+}
+
+func TestConfigSchema(t *testing.T) {
+	f, err := os.Open("../conf/full.json")
+	if err != nil {
+		t.Fatal("open full config failed, err is", err)
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(NewReader(f))
+	if err != nil {
+		t.Fatal("read full config failed, err is", err)
+	}
+	if err := checkSchema("full.json", b, true); err != nil {
+		t.Error("full config should match schema, err is", err)
+	}
+
+	// the schema is disabled by default.
+	conf := `{"workers": 2, "log": {"levle": "warn"}}`
+	if err := NewConfig().LoadsFrom(strings.NewReader(conf)); err != nil {
+		t.Error("should ignore unknown field without schema, err is", err)
+	}
+
+	conf = `{"schema": true, "workers": 128, "listen": "1935", "log": {"levle": "warn", "tank": "disk", "modules": {"api": "debug"}}}`
+	err = NewConfig().LoadsFrom(strings.NewReader(conf))
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 5 {
+		t.Fatal("should report 5 schema errors, actual is", err)
+	}
+	for _, v := range []string{
+		"config reader violates schema",
+		"listen must be integer, actual is string",
+		"log.levle is unknown",
+		"log.modules.api must be info/trace/warn/error, actual is debug",
+		"log.tank must be console/file/syslog, actual is disk",
+		"workers must <= 64, actual is 128",
+	} {
+		if !strings.Contains(err.Error(), v) {
+			t.Error("should report", v, "actual is", err)
+		}
+	}
+
+	// the include is also validated.
+	inc := writeTestConfig(t, `{"go": {"panic_policy": "ignore"}}`)
+	conf = `{"schema": true, "include": ["` + inc + `"]}`
+	if err := NewConfig().LoadsFrom(strings.NewReader(conf)); err == nil || !strings.Contains(err.Error(), "go.panic_policy must be quit/crash/restart") {
+		t.Error("should validate the included file, actual is", err)
+	}
+}
@@ -22,12 +22,20 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/ossrs/go-oryx/core"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -49,96 +57,582 @@ type WorkerContainer interface {
 	// the param f can be a global func or object method.
 	// the param name is the goroutine name.
 	GFork(name string, f func(WorkerContainer))
+	// get the draining channel, closed when server is draining,
+	// the worker should stop accepting new work, and serve the existing until QC.
+	Draining() <-chan bool
+	// the context of worker, with the worker name to log,
+	// for example, core.Ctx(wc.Context(), core.Trace).Println("...")
+	// @remark the context is cancelled when Quit(), use it for blocking calls.
+	Context() context.Context
+	// report the worker is alive, for the long-running worker to call periodically,
+	// the worker not called in go.liveness_ms is flagged as stuck, see livenessCycle.
+	// @remark the worker never called is not checked, and it's not the discovery heartbeat.
+	Heartbeat()
+}
+
+// the container for worker forked by server, with the context of worker.
+type workerContainer struct {
+	*Server
+	ctx context.Context
+	// the ordered group of worker, nil to use the server.
+	group *workerGroup
+	// the worker forked.
+	w *worker
+}
+
+// interface WorkerContainer
+func (v *workerContainer) Heartbeat() {
+	atomic.StoreInt64(&v.w.beat, v.Server.clock.Now().UnixNano())
+}
+
+// interface WorkerContainer
+func (v *workerContainer) Context() context.Context {
+	return v.ctx
+}
+
+// interface WorkerContainer
+func (v *workerContainer) QC() <-chan bool {
+	if v.group != nil {
+		return v.group.quit
+	}
+	if v.w.quit != nil {
+		return v.w.quit
+	}
+	return v.Server.QC()
+}
+
+// interface WorkerContainer
+// notify the others in group, and the server to quit.
+// @remark ignored when the worker is restarting by RestartWorker, the server keeps running.
+func (v *workerContainer) Quit() {
+	if v.restarting(v.w) {
+		return
+	}
+
+	if v.group != nil {
+		select {
+		case v.group.quit <- true:
+		default:
+		}
+	}
+	v.Server.Quit()
 }
 
 // the state of server, state graph:
-//      Init => Normal(Ready => Running)
+//      Init => Normal(Ready => Running => Draining)
 //      Init/Normal => Closed
+// @remark the Draining is transited by the run loop, the lifecycle methods treat it as Running.
 type ServerState int
 
 const (
 	StateInit ServerState = 1 << iota
 	StateReady
 	StateRunning
+	StateDraining
 	StateClosed
 )
 
+// whether running, the draining is still running for the lifecycle methods.
+func (v ServerState) running() bool {
+	return v == StateRunning || v == StateDraining
+}
+
+// the name of state, for example, "running".
+func (v ServerState) String() string {
+	switch v {
+	case StateInit:
+		return "init"
+	case StateReady:
+		return "ready"
+	case StateRunning:
+		return "running"
+	case StateDraining:
+		return "draining"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(v))
+	}
+}
+
+// the phase of server lifecycle to hook, in order:
+//      ParseConfig => BeforeLogger => PrepareLogger => AfterLogger
+//      => Initialize => BeforeWorkers => fork workers => Run => AfterRunning
+// @remark the hook is called in the lifecycle method with lock,
+//      so never call the lifecycle methods of server in hook.
+type ServerHook int
+
+const (
+	HookBeforeLogger ServerHook = iota
+	HookAfterLogger
+	HookBeforeWorkers
+	HookAfterRunning
+)
+
+// the unit of go.gc_interval.
+var gcIntervalUnit = time.Second
+
+// the error when server not closed in timeout.
+var ErrShutdownTimeout = errors.New("server shutdown timeout")
+
+// the error when call the lifecycle method in invalid state,
+// for example, Run before Initialize.
+var ErrInvalidState = errors.New("server invalid state")
+
+// the invalid state error with the expect and actual state.
+func invalidState(expect, actual ServerState) error {
+	return fmt.Errorf("%w, expect %v, actual %v", ErrInvalidState, expect, actual)
+}
+
+// the worker goroutine forked by container.
+type worker struct {
+	name string
+	// the time when forked.
+	starttime time.Time
+	// the shutdown deadline, 0 to wait forever.
+	timeout time.Duration
+	// closed when worker terminated.
+	done chan bool
+	// whether abandoned for not quit in timeout.
+	abandoned bool
+	// the restarts of GForkRestart, reset when run cleanly for a while.
+	restarts int
+	// the ordered group of GForkOrdered, nil for the others.
+	group *workerGroup
+	// the last liveness heartbeat in unix nano, 0 when never called.
+	beat int64
+	// the beat when flagged as stuck, to flag once until beat again.
+	stuck int64
+	// the worker function and quit of GFork, to restart by RestartWorker, nil for the others.
+	f      func(WorkerContainer)
+	quit   chan bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	// whether notified to quit by RestartWorker, respawn when terminated.
+	restarting bool
+}
+
+// the workers of GForkOrdered in the same priority, quit in group before the lower.
+type workerGroup struct {
+	priority int
+	quit     chan bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// the info of running worker, for operational introspection.
+type WorkerInfo struct {
+	// the name of worker, suffixed by #index when duplicated, for example, conn#2.
+	Name      string    `json:"name"`
+	StartTime time.Time `json:"start_time"`
+	Restarts  int       `json:"restarts"`
+}
+
+// the stats of server, for operational introspection.
+type ServerStats struct {
+	// the running workers.
+	Workers int `json:"workers"`
+	// the total panics of workers.
+	Panics int `json:"panics"`
+	// the restarts of each named worker forked by GForkRestart.
+	Restarts map[string]int `json:"restarts"`
+	// the optional features, whether enabled for the current config, see Features.
+	Features map[string]bool `json:"features"`
+	// the info of the current config file, see ConfigInfo.
+	Config *ConfigInfo `json:"config"`
+}
+
+// the record of a reload, for audit and debug.
+type ReloadRecord struct {
+	Time time.Time `json:"time"`
+	// the changed scopes, for example, workers and log.
+	Scopes []string `json:"scopes"`
+	Ok     bool     `json:"ok"`
+	// the error when reload failed.
+	Error      string `json:"error"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
 type Server struct {
+	// the injected config, nil to use the global config.
+	conf     *Config
+	confLock sync.RWMutex
 	// signal handler.
 	sigs chan os.Signal
-	// whether closed.
-	closed  ServerState
+	// the pending signals to handle by run loop, the identical signals are coalesced,
+	// and notify the run loop by signaled.
+	signals     []os.Signal
+	signalsLock sync.Mutex
+	signaled    chan bool
+	// the state of server, the ServerState, see transit.
+	state   int32
 	closing chan bool
+	// the time in ns when run, 0 before run.
+	startedAt int64
+	// whether ready to serve, 1 when running and config applied, 0 when quit.
+	ready int32
 	// for system internal to notify quit.
 	quit chan bool
-	wg   sync.WaitGroup
+	// closed when draining, and quit when drained, only for the run loop.
+	draining  chan bool
+	drained   <-chan time.Time
+	drainedBy string
+	// the root context of workers, cancelled when quit.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// the running workers forked by GFork.
+	workers     map[*worker]bool
+	panics      int // the total panics of workers.
+	restarts    int // the total restarts of workers.
+	workersLock sync.Mutex
+	// the groups of ordered workers by priority, locked by workersLock.
+	groups map[int]*workerGroup
+	// the ramp of workers in progress, nil when not ramping, locked by workersLock.
+	ramp *workersRamp
+	// the state to quit the groups, 0 not start, 1 quitting, 2 done.
+	groupsQuit int
+	// the hooks of lifecycle phase.
+	hooks map[ServerHook][]func() error
+	// the reason to quit, the first cause, for example, the signal.
+	reason     string
+	reasonLock sync.Mutex
+	// the api listener opened by initialize, nil when disabled.
+	apiListener net.Listener
+	// the pid file written by initialize, removed when closed.
+	pidFile string
+	// the recent reloads, the oldest first.
+	history     []ReloadRecord
+	historyLock sync.Mutex
+	// the fresh gc interval when reload.
+	gcReloads chan int
+	// the token of upgrade, only one upgrade at a time.
+	upgrading chan bool
+	// the setter of max procs, default to runtime.GOMAXPROCS.
+	gomaxprocs func(n int) int
+	// the setter of gc percent, default to debug.SetGCPercent.
+	gcPercent func(percent int) int
+	// the forced gc, default to runtime.GC.
+	gc func()
+	// the clock of gc timer and uptime, default to core.RealClock.
+	clock core.Clock
+	// the metrics for /metrics.
+	metrics *metricsRegistry
 	// core components.
 	htbt   *Heartbeat
 	logger *simpleLogger
-	// the locker for state, for instance, the closed.
+	// the locker for lifecycle, for instance, the transit of state.
 	lock sync.Mutex
 }
 
+// create the server over the global config.
 func NewServer() *Server {
+	return newServer(nil)
+}
+
+// create the server over the config c instead of the global config,
+// for example, to run multiple servers in a process.
+// @remark the loggers of core, the gomaxprocs and gc are global for process.
+func NewServerWithConfig(c *Config) *Server {
+	return newServer(c)
+}
+
+func newServer(c *Config) *Server {
 	svr := &Server{
-		sigs:    make(chan os.Signal, 1),
-		closed:  StateInit,
-		closing: make(chan bool, 1),
-		quit:    make(chan bool, 1),
-		htbt:    NewHeartbeat(),
-		logger:  &simpleLogger{},
+		conf:     c,
+		sigs:     make(chan os.Signal, 8),
+		signaled: make(chan bool, 1),
+		state:    int32(StateInit),
+		closing:  make(chan bool, 1),
+		quit:     make(chan bool, 1),
+		draining: make(chan bool),
+		htbt:     NewHeartbeat(),
+		logger:   &simpleLogger{},
+		hooks:    make(map[ServerHook][]func() error),
+		workers:  make(map[*worker]bool),
+		groups:   make(map[int]*workerGroup),
+		// only one upgrade at a time.
+		upgrading: make(chan bool, 1),
+		gcReloads: make(chan int, 1),
 	}
+	svr.gomaxprocs = runtime.GOMAXPROCS
+	svr.gcPercent = debug.SetGCPercent
+	svr.gc = runtime.GC
+	svr.clock = core.RealClock
+	svr.metrics = newMetrics(svr)
+	svr.htbt.config = svr.config
+	svr.ctx, svr.cancel = context.WithCancel(context.Background())
 
-	Conf.Subscribe(svr)
+	svr.config().Subscribe(svr)
+	svr.config().SubscribeScopes(svr.logger, ReloadLog)
+	svr.config().SubscribeScopes(svr.htbt, ReloadHeartbeat)
 
 	return svr
 }
 
-// notify server to stop and wait for cleanup.
+// notify server to stop and wait for cleanup, it's ok to close again.
+// @remark it blocks until the workers quit, so never close in worker, use Stop instead.
 func (s *Server) Close() {
+	s.CloseTimeout(0)
+}
+
+// notify server to stop and return immediately, the Run cleanup the workers then return,
+// it's ok to stop again and safe to stop in any goroutine, for example, the worker.
+func (s *Server) Stop() {
+	s.quitFor("stop")
+}
+
+// notify server to stop and wait for cleanup in timeout, 0 to wait forever.
+// when timeout, log the running workers and return ErrShutdownTimeout,
+// the server is not closed and user can close it again.
+func (s *Server) CloseTimeout(timeout time.Duration) (err error) {
 	// wait for stopped.
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	// closed?
-	if s.closed == StateClosed {
+	if s.State() == StateClosed {
 		core.Info.Println("server already closed.")
 		return
 	}
 
 	// notify to close.
-	if s.closed == StateRunning {
+	if state := s.State(); state.running() || state == StateReady {
 		core.Info.Println("notify server to stop.")
-		select {
-		case s.quit <- true:
-		default:
-		}
+		s.quitFor("close")
+	}
+
+	// wait for closed, the run loop when running,
+	// or the workers forked by initialize when ready.
+	var closed <-chan bool
+	if s.State().running() {
+		closed = s.closing
+	} else if s.State() == StateReady {
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			s.waitWorkers()
+		}()
+		closed = done
 	}
 
-	// wait for closed.
-	if s.closed == StateRunning {
-		<-s.closing
+	if closed != nil {
+		var deadline <-chan time.Time
+		if timeout > 0 {
+			deadline = time.After(timeout)
+		}
+
+		select {
+		case <-closed:
+		case <-deadline:
+			core.Warn.Println("server not closed in", timeout, "running workers are", s.runningWorkers())
+			return ErrShutdownTimeout
+		}
 	}
 
 	// do cleanup when stopped.
-	Conf.Unsubscribe(s)
+	s.config().Unsubscribe(s)
+	s.config().Unsubscribe(s.logger)
+	s.config().Unsubscribe(s.htbt)
+	if len(s.pidFile) > 0 {
+		removePidFile(s.pidFile)
+		s.pidFile = ""
+	}
+	if s.apiListener != nil {
+		removeApiSocket(s.apiListener)
+	}
 
 	// ok, closed.
-	s.closed = StateClosed
-	core.Info.Println("server closed")
+	reason := "close"
+	if s.State().running() {
+		reason = s.quitReason()
+	}
+	s.transit(StateClosed, reason)
+	core.Trace.Println("server closed")
+
+	// flush and close the logger at last, when all workers quit,
+	// so the server closed is the last line of the log tank.
+	s.logger.close(s.config())
+
+	return
+}
+
+// the config of server, the injected config or the global config.
+func (s *Server) Config() *Config {
+	return s.config()
+}
+
+// the info of the current config file.
+func (s *Server) ConfigInfo() *ConfigInfo {
+	return s.config().Info()
+}
+
+// the stats of server, safe for user to poll.
+func (s *Server) Stats() *ServerStats {
+	features, ci := s.Features(), s.ConfigInfo()
+
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	v := &ServerStats{Workers: len(s.workers), Panics: s.panics, Restarts: make(map[string]int), Features: features, Config: ci}
+	for w := range s.workers {
+		if w.restarts > 0 {
+			v.Restarts[w.name] += w.restarts
+		}
+	}
+
+	return v
+}
+
+// the running workers, the oldest first, safe for user to poll.
+func (s *Server) Workers() (infos []WorkerInfo) {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	for w := range s.workers {
+		infos = append(infos, WorkerInfo{Name: w.name, StartTime: w.starttime, Restarts: w.restarts})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].StartTime.Equal(infos[j].StartTime) {
+			return infos[i].StartTime.Before(infos[j].StartTime)
+		}
+		return infos[i].Name < infos[j].Name
+	})
+
+	// the duplicated names are suffixed by index, from the second one.
+	names := make(map[string]int)
+	for i := range infos {
+		name := infos[i].Name
+		if names[name]++; names[name] > 1 {
+			infos[i].Name = fmt.Sprintf("%v#%v", name, names[name])
+		}
+	}
+
+	return
+}
+
+// the recent reloads, the oldest first, at most reload.history records.
+func (s *Server) ReloadHistory() []ReloadRecord {
+	s.historyLock.Lock()
+	defer s.historyLock.Unlock()
+
+	return append([]ReloadRecord{}, s.history...)
+}
+
+// reload the config and record it in history.
+func (s *Server) reload() (err error) {
+	starttime := time.Now()
+
+	pc := s.config()
+	var cc *Config
+	var scopes []int
+	if cc, err = pc.parseReload(); err == nil {
+		scopes = pc.Diff(cc)
+		err = s.applyReload(pc, cc)
+	}
+
+	r := ReloadRecord{
+		Time:       starttime,
+		Scopes:     []string{},
+		Ok:         err == nil,
+		DurationMs: int64(time.Since(starttime) / time.Millisecond),
+	}
+	for _, scope := range scopes {
+		r.Scopes = append(r.Scopes, reloadScopeName(scope))
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	s.historyLock.Lock()
+	defer s.historyLock.Unlock()
+
+	s.history = append(s.history, r)
+	if n := s.config().Reloader.History; len(s.history) > n {
+		s.history = append([]ReloadRecord{}, s.history[len(s.history)-n:]...)
+	}
+
+	return
+}
+
+// the duration since server run, 0 before run, safe for user to poll.
+func (s *Server) Uptime() time.Duration {
+	if v := atomic.LoadInt64(&s.startedAt); v > 0 {
+		return s.clock.Now().Sub(time.Unix(0, v))
+	}
+	return 0
+}
+
+// the current state of server, safe for user to poll.
+// @remark never lock, for close holds the lock when wait for the workers.
+func (s *Server) State() ServerState {
+	return ServerState(atomic.LoadInt32(&s.state))
+}
+
+// whether ready to serve, true only after run and the config applied,
+// false when quit, safe for user to poll, for instance, the readiness probe.
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// whether the server is alive, true unless closed,
+// safe for user to poll, for instance, the liveness probe.
+func (s *Server) Live() bool {
+	return ServerState(atomic.LoadInt32(&s.state)) != StateClosed
+}
+
+// register the hook to the lifecycle phase,
+// the error of hook abort the lifecycle method.
+func (s *Server) Hook(phase ServerHook, h func() error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.hooks[phase] = append(s.hooks[phase], h)
+}
+
+// call the hooks of phase in registered order, stop at the first error.
+func (s *Server) callHooks(phase ServerHook) (err error) {
+	for _, h := range s.hooks[phase] {
+		if err = h(); err != nil {
+			return
+		}
+	}
+	return
 }
 
 func (s *Server) ParseConfig(conf string) (err error) {
+	// read the config file before lock, for the read maybe hang,
+	// which should never block the Close, and fail after timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), configReadTimeout)
+	defer cancel()
+
+	var b []byte
+	var modTime time.Time
+	var readErr error
+	if conf != "-" {
+		core.Trace.Println("start to read config file", conf)
+		b, modTime, readErr = readConfig(ctx, conf)
+	}
+
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	if s.closed != StateInit {
-		panic("server invalid state.")
+	if s.State() != StateInit {
+		return invalidState(StateInit, s.State())
+	}
+	s.transit(StateReady, "parse config "+conf)
+
+	// the "-" to parse config from stdin.
+	if conf == "-" {
+		core.Trace.Println("start to parse config from stdin")
+		return s.config().LoadsFrom(os.Stdin)
+	}
+
+	if readErr != nil {
+		return readErr
 	}
-	s.closed = StateReady
 
 	core.Trace.Println("start to parse config file", conf)
-	if err = Conf.Loads(conf); err != nil {
+	if err = s.config().loadsContent(ctx, conf, b, modTime); err != nil {
 		return
 	}
 
@@ -149,11 +643,19 @@ func (s *Server) PrepareLogger() (err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	if s.closed != StateReady {
-		panic("server invalid state.")
+	if s.State() != StateReady {
+		return invalidState(StateReady, s.State())
+	}
+
+	if err = s.callHooks(HookBeforeLogger); err != nil {
+		return
+	}
+
+	if err = s.logger.prepare(s.config()); err != nil {
+		return
 	}
 
-	if err = s.applyLogger(Conf); err != nil {
+	if err = s.callHooks(HookAfterLogger); err != nil {
 		return
 	}
 
@@ -164,41 +666,159 @@ func (s *Server) Initialize() (err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	if s.closed != StateReady {
-		panic("server invalid state.")
+	if s.State() != StateReady {
+		return invalidState(StateReady, s.State())
+	}
+
+	if err = s.callHooks(HookBeforeWorkers); err != nil {
+		return
+	}
+	c := s.config()
+
+	// initialize the optional subsystems,
+	// fatal for strict mode, otherwise disable it.
+	if err = s.htbt.initialize(c); err != nil {
+		if c.Strict {
+			core.Error.Println("strict mode, initialize heartbeat failed, err is", err)
+			return
+		}
+		core.Warn.Println("disable heartbeat for initialize failed, err is", err)
+
+		// copy-on-write, never modify the shared config in place.
+		c = c.clone()
+		c.Heartbeat.Enabled, err = false, nil
+		s.setConfig(c)
+	}
+	s.htbt.configure(c)
+
+	// tune the go gc pressure.
+	if c.Go.GcPercent != 0 {
+		s.applyGcPercent(c.Go.GcPercent)
+	}
+
+	// write pid file, removed when closed.
+	if len(c.PidFile) > 0 {
+		if err = writePidFile(c.PidFile); err != nil {
+			core.Error.Println("write pid file failed, err is", err)
+			return
+		}
+		s.pidFile = c.PidFile
+	}
+
+	// listen the api after the pid file, fatal for strict mode, otherwise disable it.
+	// @remark close the listener and remove the unix socket when initialize failed.
+	defer func() {
+		if err != nil && s.apiListener != nil {
+			s.apiListener.Close()
+			removeApiSocket(s.apiListener)
+			s.apiListener = nil
+		}
+	}()
+	if len(c.Api.Listen) > 0 {
+		if s.apiListener, err = listenApi(c.Api.Listen, c.apiSocketPerm()); err != nil {
+			if c.Strict {
+				core.Error.Println("strict mode, listen api", c.Api.Listen, "failed, err is", err)
+				return
+			}
+			core.Warn.Println("disable api for listen", c.Api.Listen, "failed, err is", err)
+			err = nil
+		}
+	}
+
+	// install signals, drained to pending signals when run.
+	signal.Notify(s.sigs, serverSignals...)
+	if len(ignoreSignals) > 0 {
+		signal.Ignore(ignoreSignals...)
+	}
+
+	// reload by signal SIGHUP.
+	if reloadBySignal {
+		core.Trace.Println("wait for reload signals: kill -1", os.Getpid())
+		core.Trace.Println("wait for upgrade signals: kill -USR2", os.Getpid())
+	} else {
+		core.Warn.Println("reload by signal is not supported.")
+	}
+
+	// log goroutine, fork first to write the logs of others.
+	if c.Log.Async {
+		s.GFork("log", s.logger.asyncCycle)
+	}
+
+	// heartbeat goroutine, the beat quits first for the final beat.
+	s.GForkRestart("htbt(discovery)", 3, s.htbt.discoveryCycle)
+	s.GForkOrdered("htbt(main)", 1, s.htbt.beatCycle)
+
+	// reload goroutine, watch the config file.
+	if c.Reloader.Watch && len(c.Info().Path) > 0 {
+		s.GFork("reload", s.reloadCycle)
 	}
 
-	// install signals.
-	// TODO: FIXME: when process the current signal, others may drop.
-	signal.Notify(s.sigs)
+	// api goroutine
+	if s.apiListener != nil {
+		s.GFork("api", s.apiCycle)
+	}
+
+	// statsd goroutine, the addr is applied when reload.
+	s.GFork("statsd", s.statsdCycle)
 
-	// reload goroutine
-	s.GFork("reload", Conf.reloadCycle)
-	// heartbeat goroutine
-	s.GFork("htbt(discovery)", s.htbt.discoveryCycle)
-	s.GFork("htbt(main)", s.htbt.beatCycle)
+	// liveness goroutine, the timeout is applied when reload.
+	s.GFork("liveness", s.livenessCycle)
 
-	c := Conf
 	l := fmt.Sprintf("%v(%v/%v)", c.Log.Tank, c.Log.Level, c.Log.File)
 	if !c.LogToFile() {
 		l = fmt.Sprintf("%v(%v)", c.Log.Tank, c.Log.Level)
 	}
-	core.Trace.Println(fmt.Sprintf("init server ok, conf=%v, log=%v, workers=%v/%v, gc=%v, daemon=%v",
-		c.conf, l, c.Workers, runtime.NumCPU(), c.Go.GcInterval, c.Daemon))
+	core.Trace.Println(fmt.Sprintf("init server ok, version=%v, conf=%v, log=%v, workers=%v/%v, gc=%v, daemon=%v, features=%v",
+		core.FullVersion(), c.conf, l, c.Workers, runtime.NumCPU(), c.Go.GcInterval, c.Daemon, s.enabledFeatures()))
+	core.Trace.Println("effective config is", c.Dump())
 
 	return
 }
 
+// the optional features of server, for example, the heartbeat,
+// whether the feature is enabled for the current config.
+func (s *Server) Features() map[string]bool {
+	c := s.config()
+	return map[string]bool{
+		"daemon":    c.Daemon,
+		"reload":    reloadBySignal,
+		"log.file":  c.LogToFile(),
+		"heartbeat": c.Heartbeat.Enabled,
+		"summaries": c.Heartbeat.Enabled && c.Heartbeat.Summary,
+	}
+}
+
+// the sorted names of enabled features, for example, "heartbeat,reload".
+func (s *Server) enabledFeatures() string {
+	fs := []string{}
+	for k, v := range s.Features() {
+		if v {
+			fs = append(fs, k)
+		}
+	}
+	sort.Strings(fs)
+
+	return strings.Join(fs, ",")
+}
+
 func (s *Server) Run() (err error) {
-	func() {
+	var hooks []func() error
+	if err = func() error {
 		s.lock.Lock()
 		defer s.lock.Unlock()
 
-		if s.closed != StateReady {
-			panic("server invalid state.")
+		if s.State() != StateReady {
+			return invalidState(StateReady, s.State())
 		}
-		s.closed = StateRunning
-	}()
+		s.transit(StateRunning, "run")
+		atomic.StoreInt64(&s.startedAt, s.clock.Now().UnixNano())
+
+		// call the hooks without lock, for close maybe waiting.
+		hooks = append(hooks, s.hooks[HookAfterRunning]...)
+		return nil
+	}(); err != nil {
+		return
+	}
 
 	// when terminated, notify the chan.
 	defer func() {
@@ -208,100 +828,1063 @@ func (s *Server) Run() (err error) {
 		}
 	}()
 
-	core.Info.Println("server running")
+	for _, h := range hooks {
+		if err = h(); err != nil {
+			// quit all workers forked by initialize.
+			s.quitFor(fmt.Sprintf("hook failed, err is %v", err))
+			s.waitWorkers()
+			return
+		}
+	}
+
+	startedAt := time.Unix(0, atomic.LoadInt64(&s.startedAt))
+	core.Trace.Println("server running, started at", startedAt.Format(time.RFC3339))
+	s.htbt.running(startedAt)
 
 	// run server, apply settings.
-	s.applyMultipleProcesses(Conf.Workers)
+	s.applyMultipleProcesses(s.config().Workers, 0)
+
+	// reclaim the garbage of initialize before serving.
+	if s.config().Go.GcAfterInit {
+		s.gc()
+		core.Trace.Println("go runtime gc after initialized")
+	}
+
+	// ready to serve, the logger and heartbeat applied the config.
+	atomic.StoreInt32(&s.ready, 1)
+	core.Trace.Println("server ready")
+
+	// the parent quit when we ready, if started by upgrade.
+	s.upgradeReady()
+
+	// the forced gc, disabled when interval is 0.
+	gcInterval := s.config().Go.GcInterval
+	if gcInterval == 0 {
+		core.Trace.Println("go runtime gc disabled, use the go gc only")
+	}
+
+	// drain the signals to pending, never drop when run loop is busy.
+	go s.signalCycle()
+
+	// the scheduled restart, quit when reached for the supervisor to restart.
+	var lifetime <-chan time.Time
+	maxLifetime := time.Duration(s.config().Go.MaxLifetime) * time.Second
+	if maxLifetime > 0 {
+		core.Trace.Println("server max lifetime is", maxLifetime)
+		lifetime = s.clock.After(maxLifetime)
+	}
 
 	var wc WorkerContainer = s
 	for {
+		var gc <-chan time.Time
+		if gcInterval > 0 {
+			gc = s.clock.After(gcIntervalUnit * time.Duration(gcInterval))
+		}
+
 		select {
-		case signal := <-s.sigs:
-			core.Trace.Println("got signal", signal)
-			switch signal {
-			case os.Interrupt, syscall.SIGTERM:
-				// SIGINT, SIGTERM
-				wc.Quit()
+		case <-s.signaled:
+			for _, signal := range s.takeSignals() {
+				s.onSignal(signal)
+			}
+		case <-s.drained:
+			s.drained = nil
+			s.quitFor(s.drainedBy)
+		case <-lifetime:
+			lifetime = nil
+			core.Warn.Println("server reached max lifetime", maxLifetime, "quit for the supervisor to restart, not a crash")
+			if reason := fmt.Sprintf("max lifetime %v reached", maxLifetime); !s.drain(reason) {
+				s.quitFor(reason)
 			}
 		case <-wc.QC():
 			wc.Quit()
 
+			// not ready when quit, for the lb to drain.
+			atomic.StoreInt32(&s.ready, 0)
+
 			// wait for all goroutines quit.
-			s.wg.Wait()
-			core.Warn.Println("server quit")
+			if unclean := s.waitWorkers(); len(unclean) > 0 {
+				err = errors.New(fmt.Sprintf("workers %v not quit clean", unclean))
+			}
+			core.Warn.Println("server quit, reason is", s.quitReason())
 			return
-		case <-time.After(time.Second * time.Duration(Conf.Go.GcInterval)):
-			runtime.GC()
-			core.Info.Println("go runtime gc every", Conf.Go.GcInterval, "seconds")
+		case gcInterval = <-s.gcReloads:
+			if gcInterval == 0 {
+				core.Trace.Println("reload go runtime gc disabled, use the go gc only")
+			} else {
+				core.Trace.Println("reload go runtime gc every", gcInterval, "seconds")
+			}
+		case <-gc:
+			s.gc()
+			core.Info.Println("go runtime gc every", gcInterval, "seconds")
 		}
 	}
 
 	return
 }
 
-// interface WorkContainer
-func (s *Server) QC() <-chan bool {
-	return s.quit
-}
+// self check the whole wiring then close, for smoke test or container health,
+// prepare logger, initialize and transit to running without the run loop,
+// confirm the subscribers accept the config, then quit all workers.
+// @remark the config must be parsed, and the server is closed when return.
+func (s *Server) SelfCheck() (err error) {
+	defer s.Close()
 
-func (s *Server) Quit() {
-	select {
-	case s.quit <- true:
-	default:
+	if err = s.PrepareLogger(); err != nil {
+		return
 	}
-}
 
-func (s *Server) GFork(name string, f func(WorkerContainer)) {
-	s.wg.Add(1)
-	go func() {
-		defer s.wg.Done()
+	if err = s.Initialize(); err != nil {
+		return
+	}
+
+	if err = func() (err error) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		if s.State() != StateReady {
+			return invalidState(StateReady, s.State())
+		}
+		s.transit(StateRunning, "self check")
 
+		// never enter the run loop, so quit the workers and notify the close.
 		defer func() {
-			if r := recover(); r != nil {
-				core.Error.Println(name, "worker panic:", r)
-				s.Quit()
+			s.quitFor("self check")
+			if unclean := s.waitWorkers(); len(unclean) > 0 && err == nil {
+				err = errors.New(fmt.Sprintf("workers %v not quit clean", unclean))
 			}
+			s.closing <- true
 		}()
 
-		f(s)
-		core.Trace.Println(name, "worker terminated.")
-	}()
-}
-
-// interface ReloadHandler
-func (s *Server) OnReloadGlobal(scope int, cc, pc *Config) (err error) {
-	if scope == ReloadWorkers {
-		s.applyMultipleProcesses(cc.Workers)
-	} else if scope == ReloadLog {
-		s.applyLogger(cc)
+		c := s.config()
+		return c.canReload(c, c)
+	}(); err != nil {
+		core.Error.Println("self check failed, err is", err)
+		return
 	}
+	core.Trace.Println("self check ok")
 
 	return
 }
 
-func (s *Server) applyMultipleProcesses(workers int) {
-	if workers < 0 {
-		panic("should not be negative workers")
-	}
-
-	if workers == 0 {
-		workers = runtime.NumCPU()
+// drain the signals to pending, the identical pending signals are coalesced,
+// so a signal is never dropped when the run loop is busy, for example, reloading.
+func (s *Server) signalCycle() {
+	for {
+		select {
+		case signal := <-s.sigs:
+			s.pendSignal(signal)
+		case <-s.ctx.Done():
+			return
+		}
 	}
-	pv := runtime.GOMAXPROCS(workers)
-
-	core.Trace.Println("apply workers", workers, "and previous is", pv)
 }
 
-func (s *Server) applyLogger(c *Config) (err error) {
-	if err = s.logger.close(c); err != nil {
-		return
+// pend the signal and notify the run loop, ignore the signal already pending.
+func (s *Server) pendSignal(signal os.Signal) {
+	s.signalsLock.Lock()
+	defer s.signalsLock.Unlock()
+
+	for _, v := range s.signals {
+		if v == signal {
+			core.Info.Println("coalesce signal", signal)
+			return
+		}
 	}
-	core.Info.Println("close logger ok")
+	s.signals = append(s.signals, signal)
 
-	if err = s.logger.open(c); err != nil {
-		return
+	select {
+	case s.signaled <- true:
+	default:
 	}
-	core.Info.Println("open logger ok")
+}
+
+// take the pending signals in order.
+func (s *Server) takeSignals() (signals []os.Signal) {
+	s.signalsLock.Lock()
+	defer s.signalsLock.Unlock()
 
+	signals, s.signals = s.signals, nil
 	return
 }
+
+// handle the signal in run loop.
+func (s *Server) onSignal(signal os.Signal) {
+	core.Trace.Println("got signal", signal)
+	switch signal {
+	case os.Interrupt, syscall.SIGTERM:
+		// SIGINT, SIGTERM, drain in shutdown grace, quit immediately when draining.
+		if reason := fmt.Sprintf("signal %v", signal); !s.drain(reason) {
+			s.quitFor(reason)
+		}
+	case syscall.SIGHUP:
+		// SIGHUP, never quit for reload failed.
+		if err := s.reload(); err != nil {
+			core.Error.Println("reload failed, keep the previous config. err is", err)
+		}
+	case reopenSignal:
+		// SIGUSR1, reopen the log files moved by logrotate.
+		if err := s.logger.reopen(); err != nil {
+			core.Error.Println("reopen log failed, err is", err)
+		}
+	case upgradeSignal:
+		// SIGUSR2, upgrade to the new binary, quit when the new process ready.
+		s.startUpgrade()
+	}
+}
+
+// start to drain in shutdown grace then quit for reason, in the run loop,
+// return false when no grace or already draining, the caller should quit.
+func (s *Server) drain(reason string) bool {
+	grace := time.Duration(s.config().Shutdown.GraceMs) * time.Millisecond
+	if grace <= 0 || s.drained != nil {
+		return false
+	}
+
+	// not ready when draining, for the lb to drain.
+	atomic.StoreInt32(&s.ready, 0)
+	s.transit(StateDraining, reason)
+
+	core.Warn.Println("server draining in", grace, "then quit, reason is", reason)
+	close(s.draining)
+	s.drained, s.drainedBy = s.clock.After(grace), reason
+	return true
+}
+
+// interface WorkerContainer
+func (s *Server) Draining() <-chan bool {
+	return s.draining
+}
+
+// interface WorkerContainer
+// the server is not a worker, ignore.
+func (s *Server) Heartbeat() {
+}
+
+// the config of server, the global config when not injected.
+func (s *Server) config() *Config {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+
+	if s.conf != nil {
+		return s.conf
+	}
+	return GetConfig()
+}
+
+// use the config c as the injected config or the global config.
+func (s *Server) setConfig(c *Config) {
+	s.confLock.Lock()
+	defer s.confLock.Unlock()
+
+	if s.conf != nil {
+		s.conf = c
+		return
+	}
+	SetConfig(c)
+}
+
+// apply the fresh config, use it as the injected config or the global config.
+// @remark never lock when reload, for the handlers may use the config.
+func (s *Server) applyReload(pc, cc *Config) (err error) {
+	s.confLock.RLock()
+	injected := s.conf != nil
+	s.confLock.RUnlock()
+
+	if !injected {
+		return pc.applyReload(cc)
+	}
+
+	if err = pc.reloadTo(cc); err != nil {
+		return
+	}
+
+	s.confLock.Lock()
+	s.conf = cc
+	s.confLock.Unlock()
+	core.Trace.Println("reload config ok")
+
+	return
+}
+
+// interface WorkContainer
+func (s *Server) Context() context.Context {
+	return s.ctx
+}
+
+func (s *Server) QC() <-chan bool {
+	return s.quit
+}
+
+func (s *Server) Quit() {
+	// quit the ordered workers first.
+	if s.quitGroups() {
+		return
+	}
+
+	s.cancel()
+
+	select {
+	case s.quit <- true:
+	default:
+	}
+
+	// notify the workers of GFork, which wait on its own quit.
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+	for w := range s.workers {
+		if w.quit == nil {
+			continue
+		}
+		select {
+		case w.quit <- true:
+		default:
+		}
+	}
+}
+
+// start to quit the ordered workers once, in order of priority,
+// wait for the higher to terminate before notify the lower,
+// then notify the server and other workers to quit.
+// return false when no ordered workers or they are done.
+func (s *Server) quitGroups() bool {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	if s.groupsQuit == 1 {
+		return true
+	}
+	if s.groupsQuit == 2 || len(s.groups) == 0 {
+		return false
+	}
+	s.groupsQuit = 1
+
+	groups := []*workerGroup{}
+	for _, g := range s.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].priority > groups[j].priority
+	})
+
+	go func() {
+		for _, g := range groups {
+			core.Trace.Println("quit ordered workers of priority", g.priority)
+			g.cancel()
+			select {
+			case g.quit <- true:
+			default:
+			}
+			s.waitGroup(g)
+		}
+
+		s.workersLock.Lock()
+		s.groupsQuit = 2
+		s.workersLock.Unlock()
+
+		s.Quit()
+	}()
+
+	return true
+}
+
+// wait for the workers of group to terminate.
+func (s *Server) waitGroup(g *workerGroup) {
+	s.workersLock.Lock()
+	ws := []*worker{}
+	for w := range s.workers {
+		if w.group == g {
+			ws = append(ws, w)
+		}
+	}
+	s.workersLock.Unlock()
+
+	for _, w := range ws {
+		if w.timeout <= 0 {
+			<-w.done
+			continue
+		}
+
+		select {
+		case <-w.done:
+		case <-time.After(w.timeout):
+			core.Warn.Println("ordered worker", w.name, "not quit in", w.timeout)
+		}
+	}
+}
+
+// notify server to quit for the reason,
+// only the first reason is kept, for others are the quit notify of workers.
+func (s *Server) quitFor(reason string) {
+	func() {
+		s.reasonLock.Lock()
+		defer s.reasonLock.Unlock()
+
+		if len(s.reason) == 0 {
+			s.reason = reason
+		}
+	}()
+
+	s.Quit()
+}
+
+// the reason to quit, "quit" when notified by Quit() directly.
+func (s *Server) quitReason() string {
+	s.reasonLock.Lock()
+	defer s.reasonLock.Unlock()
+
+	if len(s.reason) == 0 {
+		return "quit"
+	}
+	return s.reason
+}
+
+// transit the state to the state for reason, the lock must be held,
+// except the run loop transit running to draining, for close holds the lock to wait for it,
+// and the lifecycle methods treat the draining as running.
+func (s *Server) transit(state ServerState, reason string) {
+	pv := ServerState(atomic.SwapInt32(&s.state, int32(state)))
+	core.Trace.Println(fmt.Sprintf("server state %v => %v, reason is %v", pv, state, reason))
+}
+
+func (s *Server) GFork(name string, f func(WorkerContainer)) {
+	s.GForkTimeout(name, 0, f)
+}
+
+// fork a new goroutine like GFork, with the shutdown deadline timeout,
+// when the worker not quit in timeout after notified to quit,
+// the server log the slow worker and abandon it when shutdown.policy is abandon.
+// the param timeout 0 to wait for the worker to quit forever.
+func (s *Server) GForkTimeout(name string, timeout time.Duration, f func(WorkerContainer)) {
+	s.gfork(s.addWorker(name, timeout), f)
+}
+
+// fork a new goroutine like GFork, quit in order of priority when server quit,
+// the higher priority quits first, and the lower is notified when all higher terminated,
+// the workers forked by GFork quit after all ordered workers.
+// for example, the heartbeat quits before the network to send the final beat.
+// @remark the priority 0 or negative is the same as GFork.
+func (s *Server) GForkOrdered(name string, priority int, f func(WorkerContainer)) {
+	w := s.addWorker(name, 0)
+
+	if priority > 0 {
+		s.workersLock.Lock()
+		g, ok := s.groups[priority]
+		if !ok {
+			g = &workerGroup{priority: priority, quit: make(chan bool, 1)}
+			g.ctx, g.cancel = context.WithCancel(s.ctx)
+			s.groups[priority] = g
+		}
+		w.group = g
+		s.workersLock.Unlock()
+	}
+
+	s.gfork(w, f)
+}
+
+func (s *Server) gfork(w *worker, f func(WorkerContainer)) {
+	name := w.name
+
+	// the ordered worker quit in group, never restart alone.
+	if w.group == nil {
+		s.workersLock.Lock()
+		w.f, w.quit = f, make(chan bool, 1)
+		w.ctx, w.cancel = context.WithCancel(s.ctx)
+		// the server already quit, notify the late worker.
+		if s.ctx.Err() != nil {
+			w.quit <- true
+		}
+		s.workersLock.Unlock()
+	}
+
+	go func() {
+		defer s.removeWorker(w)
+
+		starttime := time.Now()
+		for {
+			if r := s.safeRun(w, f); r != nil {
+				break
+			}
+			if !s.respawnWorker(w) {
+				core.Trace.Println(name, "worker terminated.")
+				return
+			}
+			core.Trace.Println(name, "worker restarted.")
+			starttime = time.Now()
+		}
+
+		// the panic worker never respawn, reset the restarting for the policy.
+		s.respawnWorker(w)
+
+		// the crash policy already exit in recover.
+		if s.config().Go.PanicPolicy == "restart" {
+			s.restartWorker(w, panicRestarts, starttime, f)
+			return
+		}
+		s.quitFor(fmt.Sprintf("worker %v panic", name))
+	}()
+}
+
+// gracefully restart the worker forked by GFork or GForkTimeout of name,
+// notify the worker to quit by its QC and context, then run the same function again,
+// while the server and other workers keep running.
+// for example, restart the heartbeat to resolve the discovery endpoint again.
+// @remark return immediately without wait, error when no such worker or it's restarting.
+func (s *Server) RestartWorker(name string) error {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	if s.ctx.Err() != nil {
+		return errors.New(fmt.Sprintf("restart worker %v failed, server is quit", name))
+	}
+
+	var w *worker
+	for v := range s.workers {
+		if v.name == name && v.f != nil && (w == nil || v.starttime.Before(w.starttime)) {
+			w = v
+		}
+	}
+	if w == nil {
+		return errors.New(fmt.Sprintf("restart worker %v failed, no such worker", name))
+	}
+	if w.restarting {
+		return errors.New(fmt.Sprintf("restart worker %v failed, it's restarting", name))
+	}
+
+	core.Trace.Println("restart worker", name)
+	w.restarting = true
+	w.cancel()
+	select {
+	case w.quit <- true:
+	default:
+	}
+	return nil
+}
+
+// whether the worker is restarting by RestartWorker.
+func (s *Server) restarting(w *worker) bool {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	return w.restarting
+}
+
+// reset the quit and context of worker terminated by RestartWorker,
+// return false when not restarting or the server is quit, the worker should terminate.
+func (s *Server) respawnWorker(w *worker) bool {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	if !w.restarting || s.ctx.Err() != nil {
+		return false
+	}
+	w.restarting = false
+
+	select {
+	case <-w.quit:
+	default:
+	}
+	w.ctx, w.cancel = context.WithCancel(s.ctx)
+	return true
+}
+
+// fork a new goroutine like GFork, which can fail at startup,
+// the returned channel got nil when the worker notified ready by NotifyReady or returned nil,
+// otherwise the error returned or the panic of worker before ready, then closed.
+// for example, the api listener which fails to bind, the server should refuse to start.
+// @remark the error returned after ready is logged.
+func (s *Server) GForkWithReady(name string, f func(WorkerContainer) error) <-chan error {
+	w := s.addWorker(name, 0)
+	r := &workerReady{ready: make(chan error, 1)}
+
+	go func() {
+		defer s.removeWorker(w)
+
+		var err error
+		if v := s.safeRun(w, func(wc WorkerContainer) {
+			err = f(&readyContainer{WorkerContainer: wc, r: r})
+		}); v != nil {
+			r.notify(errors.New(fmt.Sprintf("worker %v panic: %v", name, v)))
+			s.quitFor(fmt.Sprintf("worker %v panic", name))
+			return
+		}
+
+		if err != nil && !r.notify(err) {
+			core.Error.Println(name, "worker failed after ready, err is", err)
+		}
+		r.notify(nil)
+		core.Trace.Println(name, "worker terminated.")
+	}()
+
+	return r.ready
+}
+
+// notify the worker forked by GForkWithReady is ready, ignored for other workers.
+func NotifyReady(wc WorkerContainer) {
+	if v, ok := wc.(*readyContainer); ok {
+		v.r.notify(nil)
+	}
+}
+
+// the readiness of worker, notified once.
+type workerReady struct {
+	ready chan error
+	once  sync.Once
+}
+
+// notify the ready channel and close it, false when already notified.
+func (v *workerReady) notify(err error) (ok bool) {
+	v.once.Do(func() {
+		v.ready <- err
+		close(v.ready)
+		ok = true
+	})
+	return
+}
+
+// the container for worker forked by GForkWithReady.
+type readyContainer struct {
+	WorkerContainer
+	r *workerReady
+}
+
+// the initial backoff to restart the panic worker, double for each restart.
+var workerRestartBackoff = 100 * time.Millisecond
+
+// the restarts is reset when worker run without panic in this interval.
+var workerRestartReset = 30 * time.Second
+
+// the max restarts of worker forked by GFork when go.panic_policy is restart.
+var panicRestarts = 3
+
+// exit the process when worker panic and go.panic_policy is crash.
+var panicExit = os.Exit
+
+// fork a new goroutine like GFork, restart the worker when panic,
+// at most maxRestarts times with exponential backoff then quit the server.
+func (s *Server) GForkRestart(name string, maxRestarts int, f func(WorkerContainer)) {
+	w := s.addWorker(name, 0)
+
+	go func() {
+		defer s.removeWorker(w)
+
+		starttime := time.Now()
+		if r := s.safeRun(w, f); r == nil {
+			core.Trace.Println(name, "worker terminated.")
+			return
+		}
+		s.restartWorker(w, maxRestarts, starttime, f)
+	}()
+}
+
+// restart the worker which panic after run from starttime,
+// at most maxRestarts times with exponential backoff then quit the server.
+func (s *Server) restartWorker(w *worker, maxRestarts int, starttime time.Time, f func(WorkerContainer)) {
+	name := w.name
+
+	restarts, backoff := 0, workerRestartBackoff
+	for {
+		// the worker run cleanly for a while, reset the restarts.
+		if time.Since(starttime) > workerRestartReset {
+			restarts, backoff = 0, workerRestartBackoff
+		}
+
+		if restarts >= maxRestarts {
+			s.quitFor(fmt.Sprintf("worker %v panic, restarts %v", name, restarts))
+			return
+		}
+		restarts++
+		s.setRestarts(w, restarts)
+
+		core.Warn.Println(name, "worker restart", restarts, "of", maxRestarts, "in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-s.QC():
+			s.Quit()
+			return
+		}
+		backoff *= 2
+
+		starttime = time.Now()
+		if r := s.safeRun(w, f); r == nil {
+			core.Trace.Println(name, "worker terminated.")
+			return
+		}
+	}
+}
+
+// fork a new goroutine like GFork, locked to an OS thread until terminated,
+// for the latency-critical worker, for example, the writer loop.
+// @remark never block the locked worker for long, for instance, wait for a lock or chan,
+//      for the OS thread is wasted and the go runtime starts another thread.
+func (s *Server) GForkLocked(name string, f func(WorkerContainer)) {
+	s.GFork(name, func(wc WorkerContainer) {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		f(wc)
+	})
+}
+
+// run the worker function, recover and return the panic.
+func (s *Server) safeRun(w *worker, f func(WorkerContainer)) (r interface{}) {
+	name := w.name
+	defer func() {
+		if r = recover(); r != nil {
+			core.Error.Println(name, "worker panic:", r)
+
+			// crash for the supervisor to restart, flush the logs before exit.
+			if s.config().Go.PanicPolicy == "crash" {
+				core.Error.Println(name, "worker crash, stack is\n"+string(debug.Stack()))
+				if s.logger.async != nil {
+					s.logger.async.flush()
+				}
+				panicExit(1)
+			}
+
+			s.workersLock.Lock()
+			defer s.workersLock.Unlock()
+			s.panics++
+		}
+	}()
+
+	ctx := s.Context()
+	if w.group != nil {
+		ctx = w.group.ctx
+	} else if v := s.workerContext(w); v != nil {
+		ctx = v
+	}
+	f(&workerContainer{Server: s, ctx: core.WithWorker(ctx, name), group: w.group, w: w})
+	return
+}
+
+// the context of worker forked by GFork, renewed when restart, nil for the others.
+func (s *Server) workerContext(w *worker) context.Context {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	return w.ctx
+}
+
+func (s *Server) addWorker(name string, timeout time.Duration) *worker {
+	w := &worker{name: name, starttime: time.Now(), timeout: timeout, done: make(chan bool)}
+
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	s.workers[w] = true
+	return w
+}
+
+func (s *Server) setRestarts(w *worker, restarts int) {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	w.restarts = restarts
+	s.restarts++
+}
+
+func (s *Server) removeWorker(w *worker) {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	delete(s.workers, w)
+	close(w.done)
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
+
+// the deadline for worker without timeout to quit, when assert clean shutdown.
+var cleanShutdownTimeout = 3 * time.Second
+
+// the interval to log the running workers, when wait workers exceed the watchdog grace.
+var watchdogInterval = 3 * time.Second
+
+// wait for all workers to quit,
+// when worker not quit in its timeout, log it and abandon when policy is abandon.
+// when debug assert clean shutdown, return the workers not quit in deadline.
+func (s *Server) waitWorkers() (unclean []string) {
+	s.workersLock.Lock()
+	ws := make([]*worker, 0, len(s.workers))
+	for w := range s.workers {
+		ws = append(ws, w)
+	}
+	s.workersLock.Unlock()
+
+	c := s.config()
+
+	// diagnose the hang shutdown, never force the workers to quit.
+	if c.Shutdown.WatchdogMs > 0 {
+		done, exited := make(chan bool), make(chan bool)
+		defer func() {
+			close(done)
+			<-exited
+		}()
+		go func() {
+			defer close(exited)
+			s.watchdog(done, time.Duration(c.Shutdown.WatchdogMs)*time.Millisecond)
+		}()
+	}
+
+	starttime := time.Now()
+	for _, w := range ws {
+		timeout := w.timeout
+		if timeout <= 0 && c.Debug.AssertCleanShutdown {
+			timeout = cleanShutdownTimeout
+		}
+		if timeout <= 0 {
+			continue
+		}
+
+		// check the done first, for the deadline maybe already passed.
+		select {
+		case <-w.done:
+			continue
+		default:
+		}
+
+		select {
+		case <-w.done:
+			continue
+		case <-time.After(timeout - time.Since(starttime)):
+		}
+
+		if c.Debug.AssertCleanShutdown {
+			core.Error.Println("assert clean shutdown failed, worker", w.name, "not quit in", timeout)
+			unclean = append(unclean, w.name)
+		}
+
+		core.Warn.Println("worker", w.name, "not quit in", timeout, "policy is", c.Shutdown.Policy)
+		if c.Shutdown.Policy == "abandon" {
+			w.abandoned = true
+		}
+	}
+
+	for _, w := range ws {
+		if !w.abandoned {
+			<-w.done
+		}
+	}
+
+	return
+}
+
+// log the running workers every watchdogInterval after grace, until done.
+func (s *Server) watchdog(done chan bool, grace time.Duration) {
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+	}
+
+	starttime := time.Now().Add(-grace)
+	for {
+		core.Warn.Println("wait workers for", time.Since(starttime).Round(time.Millisecond), "running workers are", s.runningWorkers())
+
+		select {
+		case <-done:
+			return
+		case <-time.After(watchdogInterval):
+		}
+	}
+}
+
+// the interval to check the liveness of workers.
+var livenessInterval = time.Second
+
+// check the liveness of workers periodically, see checkLiveness.
+func (s *Server) livenessCycle(wc WorkerContainer) {
+	for {
+		select {
+		case <-s.clock.After(livenessInterval):
+		case <-wc.QC():
+			wc.Quit()
+			return
+		}
+
+		s.checkLiveness(s.config())
+	}
+}
+
+// flag the workers which called Heartbeat but not in go.liveness_ms, once until beat again,
+// apply the panic policy when go.liveness_panic, crash or quit for the stuck can not restart.
+func (s *Server) checkLiveness(c *Config) {
+	if c.Go.LivenessMs <= 0 {
+		return
+	}
+	timeout := time.Duration(c.Go.LivenessMs) * time.Millisecond
+	now := s.clock.Now()
+
+	var stuck []string
+	func() {
+		s.workersLock.Lock()
+		defer s.workersLock.Unlock()
+
+		for w := range s.workers {
+			beat := atomic.LoadInt64(&w.beat)
+			if beat == 0 || beat == w.stuck {
+				continue
+			}
+
+			if d := now.Sub(time.Unix(0, beat)); d > timeout {
+				core.Error.Println("worker", w.name, "stuck, no heartbeat in", d, "timeout is", timeout)
+				w.stuck = beat
+				stuck = append(stuck, w.name)
+			}
+		}
+	}()
+
+	if len(stuck) == 0 || !c.Go.LivenessPanic {
+		return
+	}
+	sort.Strings(stuck)
+
+	// crash with the stacks of all goroutines, for the stuck one.
+	if c.Go.PanicPolicy == "crash" {
+		b := make([]byte, 1024*1024)
+		b = b[:runtime.Stack(b, true)]
+		core.Error.Println("worker", strings.Join(stuck, ","), "crash, stacks are\n"+string(b))
+		if s.logger.async != nil {
+			s.logger.async.flush()
+		}
+		panicExit(1)
+		return
+	}
+
+	s.quitFor(fmt.Sprintf("worker %v stuck", strings.Join(stuck, ",")))
+}
+
+// the sorted names of running workers.
+func (s *Server) runningWorkers() (names []string) {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	for w := range s.workers {
+		names = append(names, w.name)
+	}
+	sort.Strings(names)
+
+	return
+}
+
+// interface ReloadHandler
+func (s *Server) OnReloadGlobal(scope int, cc, pc *Config) (err error) {
+	if scope == ReloadWorkers {
+		s.applyMultipleProcesses(cc.Workers, cc.Go.WorkersRampMs)
+	} else if scope == ReloadGc {
+		if cc.Go.GcPercent != pc.Go.GcPercent {
+			s.applyGcPercent(cc.Go.GcPercent)
+		}
+
+		// apply in the next cycle of run, drop the stale one.
+		if cc.Go.GcInterval != pc.Go.GcInterval {
+			select {
+			case <-s.gcReloads:
+			default:
+			}
+			s.gcReloads <- cc.Go.GcInterval
+		}
+	}
+
+	return
+}
+
+// apply the workers, when ramp is not zero and the workers reduced,
+// step down one worker every ramp ms to avoid the sudden scheduling cliff.
+func (s *Server) applyMultipleProcesses(workers int, ramp int) {
+	if workers < 0 {
+		panic("should not be negative workers")
+	}
+
+	if workers == 0 {
+		var reason string
+		workers, reason = defaultWorkers()
+		core.Trace.Println("use default workers", workers, "by", reason)
+	}
+
+	pv := s.gomaxprocs(0)
+	if workers < pv {
+		core.Trace.Println("reduce workers from", pv, "to", workers, "ramp", ramp, "ms each step")
+	}
+
+	// the fresh workers wins the ramp in progress.
+	s.stopRamp()
+
+	// step down in the ramp worker, never block the run loop.
+	if ramp > 0 && workers < pv-1 {
+		s.rampWorkers(pv, workers, time.Duration(ramp)*time.Millisecond)
+		return
+	}
+	s.gomaxprocs(workers)
+
+	core.Trace.Println("apply workers", workers, "and previous is", pv)
+}
+
+// the ramp of workers, stopped by reload or quit.
+type workersRamp struct {
+	stop chan bool
+	done chan bool
+}
+
+// step down the workers from pv to workers in worker "ramp", one step every interval.
+func (s *Server) rampWorkers(pv, workers int, interval time.Duration) {
+	r := &workersRamp{stop: make(chan bool), done: make(chan bool)}
+
+	s.workersLock.Lock()
+	s.ramp = r
+	s.workersLock.Unlock()
+
+	s.GFork("ramp", func(wc WorkerContainer) {
+		defer close(r.done)
+
+		for n := pv - 1; n > workers; n-- {
+			s.gomaxprocs(n)
+			core.Trace.Println("ramp workers to", n, "target is", workers)
+
+			select {
+			case <-s.clock.After(interval):
+			case <-r.stop:
+				return
+			case <-wc.QC():
+				wc.Quit()
+				return
+			}
+		}
+		s.gomaxprocs(workers)
+
+		core.Trace.Println("apply workers", workers, "and previous is", pv)
+	})
+}
+
+// stop the ramp in progress and wait for it to terminate.
+func (s *Server) stopRamp() {
+	s.workersLock.Lock()
+	r := s.ramp
+	s.ramp = nil
+	s.workersLock.Unlock()
+
+	if r != nil {
+		close(r.stop)
+		<-r.done
+	}
+}
+
+// apply the gc percent, 0 to restore the go default by GOGC.
+func (s *Server) applyGcPercent(percent int) {
+	if percent == 0 {
+		percent = goGcPercent()
+	}
+
+	pv := s.gcPercent(percent)
+	core.Trace.Println("apply go gc percent", percent, "and previous is", pv)
+}
+
+// the default gc percent of go, the GOGC or 100.
+func goGcPercent() int {
+	if v := os.Getenv("GOGC"); v == "off" {
+		return -1
+	} else if n, err := strconv.Atoi(v); err == nil {
+		return n
+	}
+	return 100
+}
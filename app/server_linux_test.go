@@ -0,0 +1,170 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// +build linux
+
+package app
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServerGForkLocked(t *testing.T) {
+	svr := NewServer()
+	defer svr.Close()
+
+	tids := make(chan []int, 1)
+	svr.GForkLocked("writer", func(wc WorkerContainer) {
+		v := []int{}
+		for i := 0; i < 10; i++ {
+			v = append(v, syscall.Gettid())
+			runtime.Gosched()
+			time.Sleep(time.Millisecond)
+		}
+		tids <- v
+	})
+	svr.waitWorkers()
+
+	v := <-tids
+	for _, tid := range v {
+		if tid != v[0] {
+			t.Error("should run on the same thread, actual is", v)
+			break
+		}
+	}
+	if v := svr.runningWorkers(); len(v) != 0 {
+		t.Error("should terminate cleanly, actual is", v)
+	}
+}
+
+func TestServerSignals(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	defer svr.Close()
+
+	f := writeTestConfig(t, `{"daemon": false, "log": {"tank": "console"}, "reload": {"history": 3}}`)
+	if err := svr.ParseConfig(f); err != nil {
+		t.Fatal("parse config failed, err is", err)
+	}
+	if err := svr.Initialize(); err != nil {
+		t.Fatal("initialize failed, err is", err)
+	}
+	if !signal.Ignored(syscall.SIGPIPE) {
+		t.Error("should ignore SIGPIPE")
+	}
+
+	running := make(chan bool)
+	svr.Hook(HookAfterRunning, func() error {
+		close(running)
+		return nil
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- svr.Run()
+	}()
+	<-running
+
+	// the invalid config, to reload without changing the config of running workers.
+	if err := ioutil.WriteFile(f, []byte(`{"workers": -1}`), 0644); err != nil {
+		t.Fatal("write config failed, err is", err)
+	}
+
+	// the SIGTERM never dropped when SIGHUP is handling.
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("should quit for SIGTERM")
+	}
+
+	if v := svr.ReloadHistory(); len(v) != 1 || v[0].Ok {
+		t.Error("should reload for SIGHUP, actual is", v)
+	}
+	if v := svr.quitReason(); v != "signal terminated" {
+		t.Error("should quit for SIGTERM, actual is", v)
+	}
+}
+
+func TestServerSignalsCoalesce(t *testing.T) {
+	svr := NewServer()
+	defer svr.Close()
+
+	for _, v := range []os.Signal{syscall.SIGHUP, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGHUP} {
+		svr.pendSignal(v)
+	}
+	if v := svr.takeSignals(); len(v) != 2 || v[0] != syscall.SIGHUP || v[1] != syscall.SIGTERM {
+		t.Error("should coalesce identical signals, actual is", v)
+	}
+	if v := svr.takeSignals(); len(v) != 0 {
+		t.Error("should take all signals, actual is", v)
+	}
+}
+
+func TestServerParseConfigTimeout(t *testing.T) {
+	defer restoreGlobals()()
+
+	pv := configReadTimeout
+	defer func() {
+		configReadTimeout = pv
+	}()
+	configReadTimeout = 30 * time.Millisecond
+
+	// the read of fifo hangs when no writer, as the stale NFS.
+	f := path.Join(t.TempDir(), "oryx.json")
+	if err := syscall.Mkfifo(f, 0644); err != nil {
+		t.Fatal("mkfifo failed, err is", err)
+	}
+	defer func() {
+		// release the hang read.
+		if w, err := os.OpenFile(f, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+			w.Close()
+		}
+	}()
+
+	svr := NewServer()
+	if err := svr.ParseConfig(f); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("should timeout, actual is", err)
+	}
+
+	closed := make(chan bool, 1)
+	go func() {
+		svr.Close()
+		closed <- true
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Error("close should not block by the hang read")
+	}
+}
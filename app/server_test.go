@@ -22,9 +22,1712 @@
 package app
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ossrs/go-oryx/core"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
 	"time"
 )
 
+func TestServerFeatures(t *testing.T) {
+	pc := GetConfig()
+	defer func() {
+		SetConfig(pc)
+	}()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	defer svr.Close()
+
+	if f := svr.Features(); f["heartbeat"] || f["summaries"] {
+		t.Error("heartbeat should disabled, actual is", f)
+	}
+	if f := svr.Features(); !f["log.file"] || f["reload"] != reloadBySignal {
+		t.Error("invalid default features", f)
+	}
+
+	GetConfig().Heartbeat.Enabled = true
+	if f := svr.Features(); !f["heartbeat"] || f["summaries"] {
+		t.Error("heartbeat should enabled without summaries, actual is", f)
+	}
+
+	GetConfig().Heartbeat.Summary = true
+	if f := svr.Features(); !f["summaries"] {
+		t.Error("summaries should enabled, actual is", f)
+	}
+
+	// the features in stats.
+	if f := svr.Stats().Features; !f["heartbeat"] || !f["summaries"] || len(f) != len(svr.Features()) {
+		t.Error("stats should have the features, actual is", f)
+	}
+	GetConfig().Heartbeat.Enabled = false
+	if f := svr.Stats().Features; f["heartbeat"] || f["summaries"] {
+		t.Error("stats features should toggle with config, actual is", f)
+	}
+}
+
+func TestServerShutdownWatchdog(t *testing.T) {
+	defer restoreGlobals()()
+
+	var b bytes.Buffer
+	var lock sync.Mutex
+	core.SetOutput(&lockedWriter{w: &b, lock: &lock})
+
+	pv := watchdogInterval
+	defer func() {
+		watchdogInterval = pv
+	}()
+	watchdogInterval = 10 * time.Millisecond
+
+	SetConfig(NewConfig())
+	GetConfig().Shutdown.WatchdogMs = 10
+
+	svr := NewServer()
+	defer svr.Close()
+
+	block := make(chan bool)
+	svr.GFork("slow", func(wc WorkerContainer) {
+		<-wc.QC()
+		wc.Quit()
+		<-block
+	})
+
+	svr.Quit()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(block)
+	}()
+	svr.waitWorkers()
+
+	if v := readLocked(&b, &lock); strings.Count(v, "running workers are [slow]") < 2 {
+		t.Error("should log the running workers periodically, actual is", v)
+	}
+
+	// never log when all workers quit in grace.
+	lock.Lock()
+	b.Reset()
+	lock.Unlock()
+	time.Sleep(30 * time.Millisecond)
+	if v := readLocked(&b, &lock); strings.Contains(v, "running workers") {
+		t.Error("should stop the watchdog when workers quit, actual is", v)
+	}
+}
+
+func TestServerShutdownGrace(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+	GetConfig().Shutdown.GraceMs = 5000
+
+	svr := NewServer()
+	defer svr.Close()
+	svr.gomaxprocs = func(n int) int {
+		return 1
+	}
+	clock := core.NewFakeClock(time.Unix(1000, 0))
+	svr.clock = clock
+
+	draining, quit := make(chan bool), make(chan bool)
+	svr.GFork("listener", func(wc WorkerContainer) {
+		<-wc.Draining()
+		close(draining)
+		<-wc.QC()
+		wc.Quit()
+		close(quit)
+	})
+
+	svr.transit(StateReady, "test")
+	running := make(chan bool)
+	svr.Hook(HookAfterRunning, func() error {
+		close(running)
+		return nil
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- svr.Run()
+	}()
+	<-running
+
+	svr.sigs <- syscall.SIGTERM
+	<-draining
+	if v := svr.State(); v != StateDraining || svr.Ready() {
+		t.Error("should draining and not ready, actual is", v, svr.Ready())
+	}
+	select {
+	case <-quit:
+		t.Error("should not quit in grace")
+	default:
+	}
+
+	// quit when grace elapsed.
+	for i := 0; i < 100 && clock.Timers() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(5 * time.Second)
+	select {
+	case <-quit:
+	case <-time.After(3 * time.Second):
+		t.Fatal("should quit after grace")
+	}
+	if err := <-done; err != nil {
+		t.Error("run failed, err is", err)
+	}
+	if v := svr.quitReason(); v != "signal terminated" {
+		t.Error("invalid quit reason", v)
+	}
+
+	// the draining is running for the lifecycle methods.
+	if err := svr.Run(); err == nil || !strings.Contains(err.Error(), "draining") {
+		t.Error("should not run when draining, err is", err)
+	}
+	svr.Close()
+	if v := svr.State(); v != StateClosed {
+		t.Error("should closed, actual is", v)
+	}
+}
+
+func TestServerMaxLifetime(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+	GetConfig().Go.GcInterval = 0
+	GetConfig().Go.MaxLifetime = 3600
+	GetConfig().Shutdown.GraceMs = 5000
+
+	svr := NewServer()
+	defer svr.Close()
+	svr.gomaxprocs = func(n int) int {
+		return 1
+	}
+	clock := core.NewFakeClock(time.Unix(1000, 0))
+	svr.clock = clock
+
+	draining := make(chan bool)
+	svr.GFork("listener", func(wc WorkerContainer) {
+		<-wc.Draining()
+		close(draining)
+		<-wc.QC()
+		wc.Quit()
+	})
+
+	svr.transit(StateReady, "test")
+	done := make(chan error, 1)
+	go func() {
+		done <- svr.Run()
+	}()
+
+	// drain when max lifetime reached.
+	for i := 0; i < 100 && clock.Timers() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Hour)
+	select {
+	case <-draining:
+	case <-time.After(3 * time.Second):
+		t.Fatal("should drain when max lifetime reached")
+	}
+
+	// quit when grace elapsed.
+	for i := 0; i < 100 && clock.Timers() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(5 * time.Second)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("run failed, err is", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("should quit after grace")
+	}
+	if v := svr.quitReason(); v != "max lifetime 1h0m0s reached" {
+		t.Error("invalid quit reason", v)
+	}
+}
+
+func TestServerWorkerTimeout(t *testing.T) {
+	var tank bytes.Buffer
+	pw, pc := core.Warn, GetConfig()
+	defer func() {
+		core.Warn = pw
+		SetConfig(pc)
+	}()
+	core.Warn = log.New(&tank, core.LogWarnLabel, log.LstdFlags)
+	SetConfig(NewConfig())
+	GetConfig().Shutdown.Policy = "abandon"
+
+	svr := NewServer()
+	defer svr.Close()
+
+	block := make(chan bool)
+	defer close(block)
+
+	svr.GForkTimeout("slow", 10*time.Millisecond, func(wc WorkerContainer) {
+		<-wc.QC()
+		wc.Quit()
+		<-block
+	})
+	for i := 0; i < 3; i++ {
+		svr.GForkTimeout("fast", 10*time.Millisecond, func(wc WorkerContainer) {
+			<-wc.QC()
+			wc.Quit()
+		})
+	}
+
+	svr.Quit()
+	svr.waitWorkers()
+
+	if v := tank.String(); !strings.Contains(v, "worker slow not quit in 10ms") {
+		t.Error("should log the slow worker, actual is", v)
+	} else if strings.Contains(v, "worker fast") {
+		t.Error("should not log the fast worker, actual is", v)
+	}
+}
+
+func TestServerCloseTimeout(t *testing.T) {
+	var tank bytes.Buffer
+	defer restoreGlobals()()
+	core.Warn = log.New(&tank, core.LogWarnLabel, log.LstdFlags)
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	svr.transit(StateReady, "test")
+
+	block := make(chan bool)
+	svr.GFork("stuck", func(wc WorkerContainer) {
+		<-block
+	})
+	svr.GFork("normal", func(wc WorkerContainer) {
+		<-wc.QC()
+		wc.Quit()
+	})
+
+	running := make(chan bool)
+	svr.Hook(HookAfterRunning, func() error {
+		close(running)
+		return nil
+	})
+
+	go svr.Run()
+	<-running
+
+	if err := svr.CloseTimeout(10 * time.Millisecond); err != ErrShutdownTimeout {
+		t.Error("should timeout, err is", err)
+	}
+	if v := tank.String(); !strings.Contains(v, "running workers are [stuck]") {
+		t.Error("should log the stuck worker, actual is", v)
+	}
+
+	close(block)
+	if err := svr.CloseTimeout(0); err != nil {
+		t.Error("should closed, err is", err)
+	}
+}
+
+func TestServerGForkWithReady(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	defer svr.Close()
+
+	// ready then work until quit.
+	ready := svr.GForkWithReady("ready", func(wc WorkerContainer) error {
+		NotifyReady(wc)
+		<-wc.QC()
+		wc.Quit()
+		return errors.New("mock failed after ready")
+	})
+	if err := <-ready; err != nil {
+		t.Error("should ready, err is", err)
+	}
+
+	// fail at startup.
+	if err := <-svr.GForkWithReady("listener", func(wc WorkerContainer) error {
+		return errors.New("mock bind failed")
+	}); err == nil || err.Error() != "mock bind failed" {
+		t.Error("should fail at startup, actual is", err)
+	}
+
+	// quit without error is ready.
+	if err, ok := <-svr.GForkWithReady("oneshot", func(wc WorkerContainer) error {
+		return nil
+	}); err != nil || !ok {
+		t.Error("should ready when return nil, actual is", err, ok)
+	}
+
+	// the panic is reported, and the server quits.
+	if err := <-svr.GForkWithReady("panic", func(wc WorkerContainer) error {
+		panic("mock panic")
+	}); err == nil || !strings.Contains(err.Error(), "worker panic panic: mock panic") {
+		t.Error("should report the panic, actual is", err)
+	}
+	svr.waitWorkers()
+
+	if _, ok := <-ready; ok {
+		t.Error("should close the ready channel")
+	}
+}
+
+func TestServerWorkerRestart(t *testing.T) {
+	pb := workerRestartBackoff
+	defer func() {
+		workerRestartBackoff = pb
+	}()
+	workerRestartBackoff = time.Millisecond
+
+	svr := NewServer()
+	defer svr.Close()
+
+	// panic twice then quit normally.
+	var runs int
+	svr.GForkRestart("transient", 2, func(wc WorkerContainer) {
+		if runs++; runs <= 2 {
+			panic("transient")
+		}
+	})
+	svr.waitWorkers()
+
+	if runs != 3 {
+		t.Error("should restart twice, runs is", runs)
+	}
+	select {
+	case <-svr.QC():
+		t.Error("should not quit")
+	default:
+	}
+
+	// always panic, quit after restarts.
+	svr.GForkRestart("broken", 1, func(wc WorkerContainer) {
+		panic("broken")
+	})
+	svr.waitWorkers()
+
+	if v := svr.quitReason(); v != "worker broken panic, restarts 1" {
+		t.Error("should quit for panic, actual is", v)
+	}
+}
+
+func TestServerPanicPolicy(t *testing.T) {
+	pb, pe := workerRestartBackoff, panicExit
+	defer func() {
+		workerRestartBackoff, panicExit = pb, pe
+	}()
+	workerRestartBackoff = time.Millisecond
+
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	// restart the panic worker, then quit normally.
+	GetConfig().Go.PanicPolicy = "restart"
+	svr := NewServer()
+	defer svr.Close()
+
+	var runs int
+	svr.GFork("transient", func(wc WorkerContainer) {
+		if runs++; runs <= 2 {
+			panic("transient")
+		}
+	})
+	svr.waitWorkers()
+
+	if runs != 3 || svr.Stats().Panics != 2 {
+		t.Error("should restart twice, runs is", runs, svr.Stats())
+	}
+	select {
+	case <-svr.QC():
+		t.Error("should not quit")
+	default:
+	}
+
+	// exit with stack when crash.
+	GetConfig().Go.PanicPolicy = "crash"
+	codes := make(chan int, 1)
+	panicExit = func(code int) {
+		codes <- code
+	}
+
+	svr.GFork("broken", func(wc WorkerContainer) {
+		panic("broken")
+	})
+	select {
+	case v := <-codes:
+		if v != 1 {
+			t.Error("should exit 1, actual is", v)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("should exit when crash")
+	}
+	svr.waitWorkers()
+}
+
+func TestServerLiveness(t *testing.T) {
+	defer restoreGlobals()()
+	var tank bytes.Buffer
+	var lock sync.Mutex
+	core.Error = log.New(&lockedWriter{w: &tank, lock: &lock}, core.LogErrorLabel, 0)
+
+	svr := NewServer()
+	defer svr.Close()
+	clock := core.NewFakeClock(time.Unix(1000, 0))
+	svr.clock = clock
+
+	// the worker stuck after beat, the idle never beat.
+	beats := make(chan bool)
+	for _, name := range []string{"stuck", "alive"} {
+		svr.GFork(name, func(wc WorkerContainer) {
+			wc.Heartbeat()
+			beats <- true
+			<-wc.QC()
+			wc.Quit()
+		})
+		<-beats
+	}
+	svr.GFork("idle", func(wc WorkerContainer) {
+		<-wc.QC()
+		wc.Quit()
+	})
+
+	beat := func(name string) {
+		svr.workersLock.Lock()
+		defer svr.workersLock.Unlock()
+		for w := range svr.workers {
+			if w.name == name {
+				atomic.StoreInt64(&w.beat, clock.Now().UnixNano())
+			}
+		}
+	}
+
+	c := NewConfig()
+	c.Go.LivenessMs = 1000
+	clock.Advance(2 * time.Second)
+	beat("alive")
+
+	// log once, without quit.
+	svr.checkLiveness(c)
+	svr.checkLiveness(c)
+	if v := readLocked(&tank, &lock); strings.Count(v, "no heartbeat") != 1 || !strings.Contains(v, "worker stuck stuck") {
+		t.Error("should flag the stuck worker once, actual is", v)
+	}
+	select {
+	case <-svr.QC():
+		t.Error("should not quit")
+	default:
+	}
+
+	// quit when stuck again, by the panic policy.
+	c.Go.LivenessPanic = true
+	beat("stuck")
+	clock.Advance(2 * time.Second)
+	svr.checkLiveness(c)
+	if v := svr.quitReason(); v != "worker alive,stuck stuck" {
+		t.Error("should quit for stuck, actual is", v)
+	}
+	svr.waitWorkers()
+}
+
+func TestServerStats(t *testing.T) {
+	pb := workerRestartBackoff
+	defer func() {
+		workerRestartBackoff = pb
+	}()
+	workerRestartBackoff = time.Millisecond
+
+	svr := NewServer()
+	defer svr.Close()
+
+	// panic 3 times then run until quit.
+	var runs int
+	running := make(chan bool)
+	svr.GForkRestart("flaky", 5, func(wc WorkerContainer) {
+		if runs++; runs <= 3 {
+			panic("flaky")
+		}
+		close(running)
+		<-wc.QC()
+		wc.Quit()
+	})
+	<-running
+
+	v := svr.Stats()
+	if v.Workers != 1 || v.Panics != 3 || v.Restarts["flaky"] != 3 {
+		t.Error("invalid stats", v)
+	}
+
+	svr.Quit()
+	svr.waitWorkers()
+	if v := svr.Stats(); v.Workers != 0 || v.Panics != 3 || len(v.Restarts) != 0 {
+		t.Error("invalid stats after quit", v)
+	}
+}
+
+func TestServerWorkers(t *testing.T) {
+	svr := NewServer()
+	defer svr.Close()
+
+	starttime := time.Now()
+	for _, name := range []string{"conn", "htbt", "conn"} {
+		svr.GFork(name, func(wc WorkerContainer) {
+			<-wc.QC()
+			wc.Quit()
+		})
+	}
+
+	v := svr.Workers()
+	if len(v) != 3 {
+		t.Fatal("should 3 workers, actual is", v)
+	}
+	names := []string{}
+	for _, w := range v {
+		names = append(names, w.Name)
+		if w.StartTime.Before(starttime) || w.Restarts != 0 {
+			t.Error("invalid worker", w)
+		}
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "conn,conn#2,htbt" {
+		t.Error("duplicated names should suffixed, actual is", names)
+	}
+
+	svr.Quit()
+	svr.waitWorkers()
+	if v := svr.Workers(); len(v) != 0 {
+		t.Error("should remove the terminated workers, actual is", v)
+	}
+}
+
+func TestServerAssertCleanShutdown(t *testing.T) {
+	pt := cleanShutdownTimeout
+	defer func() {
+		cleanShutdownTimeout = pt
+	}()
+	cleanShutdownTimeout = 10 * time.Millisecond
+
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+	GetConfig().Debug.AssertCleanShutdown = true
+
+	svr := NewServer()
+	defer svr.Close()
+
+	block := make(chan bool)
+	time.AfterFunc(100*time.Millisecond, func() {
+		close(block)
+	})
+
+	svr.GFork("compliant", func(wc WorkerContainer) {
+		<-wc.QC()
+		wc.Quit()
+	})
+	svr.GFork("ignore", func(wc WorkerContainer) {
+		<-block
+	})
+
+	svr.Quit()
+	if v := svr.waitWorkers(); len(v) != 1 || v[0] != "ignore" {
+		t.Error("should flag the worker ignore quit, actual is", v)
+	}
+}
+
+func TestServerCloseReady(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	svr.transit(StateReady, "test")
+	if err := svr.Initialize(); err != nil {
+		t.Fatal("initialize failed, err is", err)
+	}
+	if v := svr.runningWorkers(); len(v) == 0 {
+		t.Error("should fork workers when initialize")
+	}
+
+	if err := svr.CloseTimeout(time.Second); err != nil {
+		t.Error("close failed, err is", err)
+	}
+	if v := svr.runningWorkers(); len(v) != 0 {
+		t.Error("workers should terminated, actual is", v)
+	}
+	if v := svr.State(); v != StateClosed {
+		t.Error("should closed, actual is", v)
+	}
+}
+
+func TestServerWorkerContext(t *testing.T) {
+	var tank bytes.Buffer
+	defer restoreGlobals()()
+	core.Trace = log.New(&tank, core.LogTraceLabel, log.LstdFlags)
+
+	svr := NewServer()
+	defer svr.Close()
+
+	svr.GFork("htbt(main)", func(wc WorkerContainer) {
+		core.Ctx(wc.Context(), core.Trace).Println("in worker")
+	})
+	svr.waitWorkers()
+	core.Ctx(svr.Context(), core.Trace).Println("out of worker")
+
+	if v := tank.String(); !strings.Contains(v, "[htbt(main)] in worker") {
+		t.Error("should log with worker name, actual is", v)
+	} else if !strings.Contains(v, " out of worker") || strings.Contains(v, "] out of worker") {
+		t.Error("should log without worker name, actual is", v)
+	}
+}
+
+func TestServerContextCancel(t *testing.T) {
+	svr := NewServer()
+	defer svr.Close()
+
+	done := make(chan error, 1)
+	svr.GFork("blocking", func(wc WorkerContainer) {
+		<-wc.Context().Done()
+		done <- wc.Context().Err()
+	})
+
+	select {
+	case <-svr.Context().Done():
+		t.Error("should not cancel before quit")
+	default:
+	}
+
+	svr.Quit()
+	svr.waitWorkers()
+
+	if err := <-done; err != context.Canceled {
+		t.Error("worker context should cancelled, err is", err)
+	}
+	select {
+	case <-svr.QC():
+	default:
+		t.Error("quit channel should not changed")
+	}
+}
+
+func TestServerGcAfterInit(t *testing.T) {
+	pc := GetConfig()
+	defer func() {
+		SetConfig(pc)
+	}()
+
+	for _, enabled := range []bool{true, false} {
+		SetConfig(NewConfig())
+		GetConfig().Go.GcAfterInit = enabled
+
+		svr := NewServer()
+		svr.transit(StateReady, "test")
+
+		var gcs int32
+		svr.gc = func() {
+			atomic.AddInt32(&gcs, 1)
+		}
+
+		svr.Quit()
+		if err := svr.Run(); err != nil {
+			t.Error("run failed, err is", err)
+		}
+		svr.Close()
+
+		if v := atomic.LoadInt32(&gcs); enabled && v != 1 {
+			t.Error("should gc once after init, actual is", v)
+		} else if !enabled && v != 0 {
+			t.Error("should not gc when disabled, actual is", v)
+		}
+	}
+}
+
+// write the config to a temp file, return the path.
+func writeTestConfig(t *testing.T, conf string) string {
+	f := path.Join(t.TempDir(), "oryx.json")
+	if err := ioutil.WriteFile(f, []byte(conf), 0644); err != nil {
+		t.Fatal("write config failed, err is", err)
+	}
+	return f
+}
+
+// restore the global config and loggers which changed by server.
+func restoreGlobals() func() {
+	pc := GetConfig()
+	pi, pt, pw, pe := core.Info, core.Trace, core.Warn, core.Error
+	return func() {
+		SetConfig(pc)
+		core.SetOutput(nil)
+		core.Info, core.Trace, core.Warn, core.Error = pi, pt, pw, pe
+		core.SetLogLevel("trace")
+		core.SetModuleLogLevels(nil)
+	}
+}
+
+func TestServerReloadGc(t *testing.T) {
+	svr := NewServer()
+	defer svr.Close()
+
+	pc, cc := NewConfig(), NewConfig()
+	for _, v := range []int{100, 0} {
+		cc.Go.GcInterval = v
+		if err := svr.OnReloadGlobal(ReloadGc, cc, pc); err != nil {
+			t.Error("reload gc failed, err is", err)
+		}
+	}
+
+	// the stale interval is dropped.
+	if v := <-svr.gcReloads; v != 0 {
+		t.Error("should apply the last interval, actual is", v)
+	}
+	select {
+	case v := <-svr.gcReloads:
+		t.Error("should drop the stale interval, actual is", v)
+	default:
+	}
+
+	if err := NewConfig().LoadsFrom(strings.NewReader(`{"go": {"gc_interval": 0}}`)); err != nil {
+		t.Error("gc interval 0 should disable gc, err is", err)
+	}
+}
+
+func TestServerGcPercent(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+	GetConfig().Go.GcPercent = 200
+
+	svr := NewServer()
+	defer svr.Close()
+	percents := []int{}
+	svr.gcPercent = func(percent int) int {
+		percents = append(percents, percent)
+		return 100
+	}
+
+	svr.transit(StateReady, "test")
+	if err := svr.Initialize(); err != nil {
+		t.Fatal("initialize failed, err is", err)
+	}
+
+	// reload to the go default.
+	cc := NewConfig()
+	if err := svr.OnReloadGlobal(ReloadGc, cc, GetConfig()); err != nil {
+		t.Error("reload gc failed, err is", err)
+	}
+	if len(percents) != 2 || percents[0] != 200 || percents[1] != goGcPercent() {
+		t.Error("should apply gc percent, actual is", percents)
+	}
+	select {
+	case v := <-svr.gcReloads:
+		t.Error("gc interval not changed, actual is", v)
+	default:
+	}
+}
+
+func TestServerGcClock(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+	GetConfig().Go.GcInterval = 60
+
+	svr := NewServer()
+	defer svr.Close()
+	svr.gomaxprocs = func(n int) int {
+		return 1
+	}
+
+	clock := core.NewFakeClock(time.Unix(1000, 0))
+	svr.clock = clock
+	gcs := make(chan bool, 1)
+	svr.gc = func() {
+		gcs <- true
+	}
+
+	svr.transit(StateReady, "test")
+	running := make(chan bool)
+	svr.Hook(HookAfterRunning, func() error {
+		close(running)
+		return nil
+	})
+	go svr.Run()
+	<-running
+
+	// wait for the run loop to wait for the gc timer.
+	for i := 0; i < 100 && clock.Timers() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(59 * time.Second)
+	select {
+	case <-gcs:
+		t.Error("should not gc before the interval")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-gcs:
+	case <-time.After(3 * time.Second):
+		t.Error("should gc on the interval")
+	}
+
+	if v := svr.Uptime(); v != 60*time.Second {
+		t.Error("invalid uptime", v)
+	}
+}
+
+func TestServerReloadGcMode(t *testing.T) {
+	pu := gcIntervalUnit
+	defer func() {
+		gcIntervalUnit = pu
+	}()
+	gcIntervalUnit = 10 * time.Millisecond
+
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+	GetConfig().Go.GcInterval = 1
+
+	svr := NewServer()
+	defer svr.Close()
+	svr.gomaxprocs = func(n int) int {
+		return 1
+	}
+
+	var lock sync.Mutex
+	var gcs int
+	percents := []int{}
+	svr.gc = func() {
+		lock.Lock()
+		defer lock.Unlock()
+		gcs++
+	}
+	svr.gcPercent = func(percent int) int {
+		lock.Lock()
+		defer lock.Unlock()
+		percents = append(percents, percent)
+		return 100
+	}
+	count := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return gcs
+	}
+
+	svr.transit(StateReady, "test")
+	running := make(chan bool)
+	svr.Hook(HookAfterRunning, func() error {
+		close(running)
+		return nil
+	})
+	go svr.Run()
+	<-running
+
+	// the force mode, gc periodically.
+	for i := 0; i < 100 && count() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count() < 2 {
+		t.Fatal("should force gc periodically, actual is", count())
+	}
+
+	// reload to the percent mode, the periodic gc stops.
+	cc := NewConfig()
+	cc.Go.GcInterval, cc.Go.GcPercent = 0, 200
+	if err := svr.OnReloadGlobal(ReloadGc, cc, GetConfig()); err != nil {
+		t.Error("reload gc failed, err is", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	n := count()
+	time.Sleep(100 * time.Millisecond)
+	if v := count(); v != n {
+		t.Error("should stop the periodic gc, actual is", n, v)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(percents) != 1 || percents[0] != 200 {
+		t.Error("should apply gc percent, actual is", percents)
+	}
+}
+
+func TestServerReloadConcurrent(t *testing.T) {
+	pu := gcIntervalUnit
+	defer func() {
+		gcIntervalUnit = pu
+	}()
+	gcIntervalUnit = time.Millisecond
+
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+	GetConfig().Go.GcInterval = 1
+
+	svr := NewServer()
+	defer svr.Close()
+	svr.gomaxprocs = func(n int) int {
+		return 1
+	}
+
+	// the gc loop reads the config, while reload swaps it.
+	gcs := make(chan int, 1)
+	svr.gc = func() {
+		select {
+		case gcs <- svr.config().Go.GcInterval:
+		default:
+		}
+	}
+
+	svr.transit(StateReady, "test")
+	running := make(chan bool)
+	svr.Hook(HookAfterRunning, func() error {
+		close(running)
+		return nil
+	})
+	go svr.Run()
+	<-running
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			pc, cc := GetConfig(), NewConfig()
+			cc.Go.GcInterval = 1 + i%2
+			if err := svr.applyReload(pc, cc); err != nil {
+				t.Error("reload failed, err is", err)
+				return
+			}
+			if err := svr.OnReloadGlobal(ReloadGc, cc, pc); err != nil {
+				t.Error("reload gc failed, err is", err)
+				return
+			}
+		}
+	}()
+
+	for n := 0; n < 10; n++ {
+		select {
+		case v := <-gcs:
+			if v != 1 && v != 2 {
+				t.Error("invalid gc interval", v)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("should gc when reload")
+		}
+	}
+	<-done
+
+	if GetConfig().Go.GcInterval != 2 {
+		t.Error("should use the last config, actual is", GetConfig().Go.GcInterval)
+	}
+}
+
+func TestServerReloadBySignal(t *testing.T) {
+	defer restoreGlobals()()
+
+	f := writeTestConfig(t, `{"workers": 1}`)
+	SetConfig(NewConfig())
+	if err := GetConfig().Loads(f); err != nil {
+		t.Fatal("loads failed, err is", err)
+	}
+	h := &mockReloadHandler{}
+	GetConfig().Subscribe(h)
+
+	svr := NewServer()
+	svr.gomaxprocs = func(n int) int {
+		return 1
+	}
+	svr.transit(StateReady, "test")
+
+	running := make(chan bool)
+	svr.Hook(HookAfterRunning, func() error {
+		close(running)
+		return nil
+	})
+	go svr.Run()
+	<-running
+
+	reload := func(conf string) {
+		if err := ioutil.WriteFile(f, []byte(conf), 0644); err != nil {
+			t.Fatal("write config failed, err is", err)
+		}
+		svr.sigs <- syscall.SIGHUP
+	}
+
+	// the invalid config is ignored, and server is still running.
+	reload(`{"workers": 2, "log": {"level": "verbose"}}`)
+	reload(`{"workers": 3}`)
+
+	for i := 0; i < 100; i++ {
+		h.lock.Lock()
+		n := len(h.scopes)
+		h.lock.Unlock()
+
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	svr.Close()
+
+	if len(h.scopes) != 1 || h.scopes[0] != ReloadWorkers {
+		t.Error("should reload workers once, actual is", h.scopes)
+	}
+	if GetConfig().Workers != 3 {
+		t.Error("should apply the fresh config, workers is", GetConfig().Workers)
+	}
+}
+
+func TestServerPidFile(t *testing.T) {
+	defer restoreGlobals()()
+
+	f := func(pidFile string) (*Server, error) {
+		SetConfig(NewConfig())
+		GetConfig().PidFile = pidFile
+
+		svr := NewServer()
+		svr.transit(StateReady, "test")
+		return svr, svr.Initialize()
+	}
+
+	pidFile := path.Join(t.TempDir(), "oryx.pid")
+	svr, err := f(pidFile)
+	if err != nil {
+		t.Fatal("initialize failed, err is", err)
+	}
+	if b, err := ioutil.ReadFile(pidFile); err != nil || string(b) != fmt.Sprintf("%v\n", os.Getpid()) {
+		t.Error("invalid pid file", string(b), err)
+	}
+
+	svr.Quit()
+	svr.waitWorkers()
+	svr.Close()
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Error("pid file should removed, err is", err)
+	}
+
+	// the stale pid file is overwritten.
+	if err := ioutil.WriteFile(pidFile, []byte("0"), 0644); err != nil {
+		t.Fatal("write pid file failed, err is", err)
+	}
+	if svr, err = f(pidFile); err != nil {
+		t.Error("stale pid file should ok, err is", err)
+	}
+	svr.Quit()
+	svr.waitWorkers()
+
+	// the pid of alive process is rejected.
+	if err := ioutil.WriteFile(pidFile, []byte(fmt.Sprint(os.Getppid())), 0644); err != nil {
+		t.Fatal("write pid file failed, err is", err)
+	}
+	if _, err = f(pidFile); err == nil {
+		t.Error("alive pid file should fail")
+	}
+}
+
+func TestServerConfigInfo(t *testing.T) {
+	defer restoreGlobals()()
+
+	f := writeTestConfig(t, `{"workers": 1}`)
+	SetConfig(NewConfig())
+	if err := GetConfig().Loads(f); err != nil {
+		t.Fatal("loads failed, err is", err)
+	}
+
+	svr := NewServer()
+	defer svr.Close()
+
+	fi, _ := os.Stat(f)
+	ci := svr.ConfigInfo()
+	if ci.Path != f || !ci.ModTime.Equal(fi.ModTime()) || ci.LoadTime.IsZero() {
+		t.Error("invalid config info", ci)
+	}
+	if v := NewSummary(GetConfig()).Config; v == nil || v.Path != f {
+		t.Error("summary should contains config info, actual is", v)
+	}
+	if v := svr.Stats().Config; v == nil || v.Path != f {
+		t.Error("stats should contains config info, actual is", v)
+	}
+
+	// the config changed and reloaded.
+	mt := fi.ModTime().Add(-time.Hour)
+	if err := os.Chtimes(f, mt, mt); err != nil {
+		t.Fatal("change mod time failed, err is", err)
+	}
+	if err := GetConfig().Reloads(); err != nil {
+		t.Fatal("reload failed, err is", err)
+	}
+	if v := svr.ConfigInfo(); !v.ModTime.Equal(mt) || v.LoadTime.Before(ci.LoadTime) {
+		t.Error("config info should updated after reload, actual is", v)
+	}
+}
+
+func TestServerCanReload(t *testing.T) {
+	defer restoreGlobals()()
+
+	svr := NewServer()
+	defer svr.Close()
+
+	pc, cc := NewConfig(), NewConfig()
+	// the missing dir is created, so use a file as the parent dir.
+	parent := path.Join(t.TempDir(), "file")
+	if err := os.WriteFile(parent, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cc.Log.File = path.Join(parent, "oryx.log")
+	if err := svr.config().canReload(cc, pc); err == nil {
+		t.Error("should reject the log file can not open")
+	}
+
+	cc.Log.File = path.Join(t.TempDir(), "oryx.log")
+	if err := svr.config().canReload(cc, pc); err != nil {
+		t.Error("should accept the log file, err is", err)
+	}
+
+	cc = NewConfig()
+	cc.Heartbeat.Enabled = true
+	cc.Heartbeat.Url = "ftp://127.0.0.1/api/v1/servers"
+	if err := svr.config().canReload(cc, pc); err == nil {
+		t.Error("should reject the invalid heartbeat url")
+	}
+}
+
+func TestServerReloadHistory(t *testing.T) {
+	defer restoreGlobals()()
+
+	f := writeTestConfig(t, `{"workers": 1, "reload": {"history": 2}}`)
+	SetConfig(NewConfig())
+	if err := GetConfig().Loads(f); err != nil {
+		t.Fatal("loads failed, err is", err)
+	}
+
+	svr := NewServer()
+	defer svr.Close()
+	svr.gomaxprocs = func(n int) int {
+		return 1
+	}
+
+	reload := func(c string) error {
+		if err := ioutil.WriteFile(f, []byte(c), 0644); err != nil {
+			t.Fatal("write config failed, err is", err)
+		}
+		return svr.reload()
+	}
+
+	if err := reload(`{"workers": 2, "reload": {"history": 2}}`); err != nil {
+		t.Error("reload failed, err is", err)
+	}
+	if err := reload(`{"workers": 2, "reload": {"history": 2}, "log": {"level": "warn", "tank": "console"}}`); err != nil {
+		t.Error("reload failed, err is", err)
+	}
+	if err := reload(`{"workers": -1}`); err == nil {
+		t.Error("reload should failed")
+	}
+
+	// the first one is dropped for history is 2.
+	v := svr.ReloadHistory()
+	if len(v) != 2 {
+		t.Fatal("should keep 2 records, actual is", v)
+	}
+	if r := v[0]; !r.Ok || len(r.Scopes) != 1 || r.Scopes[0] != "log" {
+		t.Error("invalid record", r)
+	}
+	if r := v[1]; r.Ok || len(r.Scopes) != 0 || len(r.Error) == 0 || r.Time.Before(v[0].Time) {
+		t.Error("invalid record", r)
+	}
+}
+
+func TestServerHooks(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	defer svr.Close()
+
+	phases := []ServerHook{}
+	for _, v := range []ServerHook{HookAfterRunning, HookBeforeWorkers, HookAfterLogger, HookBeforeLogger} {
+		phase := v
+		svr.Hook(phase, func() error {
+			phases = append(phases, phase)
+			if phase == HookAfterRunning {
+				svr.Quit()
+			}
+			return nil
+		})
+	}
+
+	conf := writeTestConfig(t, `{"daemon": false, "log": {"tank": "console"}}`)
+	if err := svr.ParseConfig(conf); err != nil {
+		t.Fatal("parse config failed, err is", err)
+	}
+	if err := svr.PrepareLogger(); err != nil {
+		t.Fatal("prepare logger failed, err is", err)
+	}
+	if err := svr.Initialize(); err != nil {
+		t.Fatal("initialize failed, err is", err)
+	}
+	if err := svr.Run(); err != nil {
+		t.Fatal("run failed, err is", err)
+	}
+
+	expect := []ServerHook{HookBeforeLogger, HookAfterLogger, HookBeforeWorkers, HookAfterRunning}
+	if len(phases) != len(expect) {
+		t.Fatal("hooks should fire in order", expect, "actual is", phases)
+	}
+	for i, v := range expect {
+		if phases[i] != v {
+			t.Error("hooks should fire in order", expect, "actual is", phases)
+		}
+	}
+}
+
+func TestServerHookAbort(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	defer svr.Close()
+	svr.transit(StateReady, "test")
+
+	svr.Hook(HookBeforeWorkers, func() error {
+		return errors.New("mock error")
+	})
+	if err := svr.Initialize(); err == nil {
+		t.Error("initialize should abort by hook")
+	}
+	if len(svr.workers) != 0 {
+		t.Error("should not fork workers, actual is", len(svr.workers))
+	}
+}
+
+func TestServerStop(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	svr.transit(StateReady, "test")
+	svr.GFork("stopper", func(wc WorkerContainer) {
+		// never block when stop in worker, and stop again is ok.
+		svr.Stop()
+		svr.Stop()
+
+		<-wc.QC()
+		wc.Quit()
+	})
+
+	ran := make(chan error, 1)
+	go func() {
+		ran <- svr.Run()
+	}()
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Error("run failed, err is", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("should quit when stop")
+	}
+
+	if v := svr.quitReason(); v != "stop" {
+		t.Error("should quit for stop, actual is", v)
+	}
+
+	svr.Close()
+	svr.Close()
+	svr.Stop()
+	if v := svr.State(); v != StateClosed {
+		t.Error("should closed, actual is", v)
+	}
+}
+
+func TestServerRestartWorker(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	if err := svr.RestartWorker("htbt"); err == nil {
+		t.Error("should failed for no such worker")
+	}
+
+	runs, quits := make(chan bool, 4), make(chan error, 4)
+	svr.GFork("htbt", func(wc WorkerContainer) {
+		runs <- true
+		select {
+		case <-wc.QC():
+		case <-time.After(3 * time.Second):
+		}
+		quits <- wc.Context().Err()
+		// the restarting worker never quit the server.
+		wc.Quit()
+	})
+	svr.GFork("other", func(wc WorkerContainer) {
+		<-wc.QC()
+		wc.Quit()
+	})
+	<-runs
+
+	if err := svr.RestartWorker("htbt"); err != nil {
+		t.Fatal("restart failed, err is", err)
+	}
+	select {
+	case err := <-quits:
+		if err == nil {
+			t.Error("the context should be cancelled when restart")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("should quit when restart")
+	}
+	select {
+	case <-runs:
+	case <-time.After(3 * time.Second):
+		t.Fatal("should respawn when restart")
+	}
+	if v := svr.runningWorkers(); len(v) != 2 {
+		t.Error("should keep 2 workers, actual is", v)
+	}
+	if svr.ctx.Err() != nil {
+		t.Error("server should not quit when restart worker")
+	}
+
+	// the restarting worker is still running.
+	svr.workersLock.Lock()
+	for w := range svr.workers {
+		if w.name == "other" {
+			w.restarting = true
+		}
+	}
+	svr.workersLock.Unlock()
+	if err := svr.RestartWorker("other"); err == nil {
+		t.Error("should failed when restarting")
+	}
+	svr.workersLock.Lock()
+	for w := range svr.workers {
+		w.restarting = false
+	}
+	svr.workersLock.Unlock()
+
+	svr.Quit()
+	svr.waitWorkers()
+	if err := <-quits; err == nil {
+		t.Error("the context should be cancelled when quit")
+	}
+	if err := svr.RestartWorker("htbt"); err == nil {
+		t.Error("should failed when server quit")
+	}
+}
+
+func TestServerStateWhenClose(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	svr.lock.Lock()
+	svr.transit(StateReady, "test")
+	svr.lock.Unlock()
+
+	release := make(chan bool)
+	svr.GFork("slow", func(wc WorkerContainer) {
+		<-wc.QC()
+		<-release
+		wc.Quit()
+	})
+
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+		svr.Close()
+	}()
+	for i := 0; i < 100 && svr.ctx.Err() == nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	// never block to poll the state, while close wait for the workers.
+	polled := make(chan ServerState, 1)
+	go func() {
+		polled <- svr.State()
+	}()
+	select {
+	case v := <-polled:
+		if v != StateReady {
+			t.Error("should be ready when closing, actual is", v)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("should not block to poll the state")
+	}
+
+	close(release)
+	<-closed
+	if v := svr.State(); v != StateClosed {
+		t.Error("should closed, actual is", v)
+	}
+}
+
+func TestServerCloseLogger(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	f := path.Join(t.TempDir(), "oryx.log")
+	conf := writeTestConfig(t, fmt.Sprintf(`{"daemon": false, "log": {"tank": "file", "file": "%v", "async": true}}`, f))
+
+	svr := NewServer()
+	if err := svr.ParseConfig(conf); err != nil {
+		t.Fatal("parse config failed, err is", err)
+	}
+	if err := svr.PrepareLogger(); err != nil {
+		t.Fatal("prepare logger failed, err is", err)
+	}
+	if err := svr.Initialize(); err != nil {
+		t.Fatal("initialize failed, err is", err)
+	}
+
+	// the worker log right before shutdown.
+	svr.GFork("bye", func(wc WorkerContainer) {
+		<-wc.QC()
+		core.Trace.Println("worker bye")
+		wc.Quit()
+	})
+
+	running := make(chan bool)
+	svr.Hook(HookAfterRunning, func() error {
+		close(running)
+		return nil
+	})
+	go svr.Run()
+	<-running
+
+	svr.Close()
+
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatal("read log failed, err is", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if !strings.Contains(string(b), "worker bye") {
+		t.Error("should write the log of worker, actual is", string(b))
+	}
+	if v := lines[len(lines)-1]; !strings.Contains(v, "server closed") {
+		t.Error("server closed should be the last line, actual is", v)
+	}
+}
+
+func TestServerSelfCheck(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	conf := writeTestConfig(t, `{"daemon": false, "log": {"tank": "console"}, "api": {"listen": "127.0.0.1:0"}}`)
+
+	svr := NewServer()
+	if err := svr.SelfCheck(); !errors.Is(err, ErrInvalidState) {
+		t.Error("should parse config first, err is", err)
+	}
+
+	svr = NewServer()
+	if err := svr.ParseConfig(conf); err != nil {
+		t.Fatal("parse config failed, err is", err)
+	}
+	if err := svr.SelfCheck(); err != nil {
+		t.Error("self check failed, err is", err)
+	}
+	if v := svr.State(); v != StateClosed || len(svr.runningWorkers()) != 0 {
+		t.Error("should closed, actual is", v, svr.runningWorkers())
+	}
+
+	// fail when any subscriber rejects the config.
+	SetConfig(NewConfig())
+	svr = NewServer()
+	if err := svr.ParseConfig(conf); err != nil {
+		t.Fatal("parse config failed, err is", err)
+	}
+	svr.config().Subscribe(&mockReloadChecker{reject: errors.New("mock error")})
+	if err := svr.SelfCheck(); err == nil || !strings.Contains(err.Error(), "mock error") {
+		t.Error("should reject by subscriber, err is", err)
+	}
+	if v := svr.State(); v != StateClosed {
+		t.Error("should closed, actual is", v)
+	}
+}
+
+func TestServerState(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	if v := svr.State(); v != StateInit || v.String() != "init" {
+		t.Error("should be init, actual is", v)
+	}
+	if v := ServerState(100).String(); v != "unknown(100)" {
+		t.Error("invalid unknown state, actual is", v)
+	}
+
+	if err := svr.Run(); !errors.Is(err, ErrInvalidState) || !strings.Contains(err.Error(), "expect ready, actual init") {
+		t.Error("should fail with state, err is", err)
+	}
+	if err := svr.Initialize(); !errors.Is(err, ErrInvalidState) {
+		t.Error("should fail with state, err is", err)
+	}
+	if err := svr.PrepareLogger(); !errors.Is(err, ErrInvalidState) {
+		t.Error("should fail with state, err is", err)
+	}
+	if v := svr.State(); v != StateInit {
+		t.Error("should keep init, actual is", v)
+	}
+
+	svr.Close()
+	if v := svr.State(); v != StateClosed || v.String() != "closed" {
+		t.Error("should be closed, actual is", v)
+	}
+}
+
+func TestServerTransitions(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	var tank bytes.Buffer
+	core.Trace = log.New(&tank, core.LogTraceLabel, log.LstdFlags)
+
+	svr := NewServer()
+	svr.Hook(HookAfterRunning, func() error {
+		svr.sigs <- syscall.SIGTERM
+		return nil
+	})
+
+	conf := writeTestConfig(t, `{"daemon": false, "log": {"tank": "console"}}`)
+	if err := svr.ParseConfig(conf); err != nil {
+		t.Fatal("parse config failed, err is", err)
+	}
+	if err := svr.Initialize(); err != nil {
+		t.Fatal("initialize failed, err is", err)
+	}
+	if err := svr.Run(); err != nil {
+		t.Fatal("run failed, err is", err)
+	}
+	svr.Close()
+
+	v := tank.String()
+	for _, e := range []string{
+		"server state init => ready, reason is parse config " + conf,
+		"server state ready => running, reason is run",
+		"server state running => closed, reason is signal terminated",
+	} {
+		if !strings.Contains(v, e) {
+			t.Error("should log", e, "actual is", v)
+		}
+	}
+}
+
+func TestServerStrict(t *testing.T) {
+	var pc *Config
+	f := func(strict bool) (*Server, error) {
+		SetConfig(NewConfig())
+		pc = GetConfig()
+		GetConfig().Strict = strict
+		GetConfig().Heartbeat.Enabled = true
+		GetConfig().Heartbeat.Url = "ftp://127.0.0.1/api/v1/servers"
+
+		svr := NewServer()
+		svr.transit(StateReady, "test")
+		return svr, svr.Initialize()
+	}
+
+	defer restoreGlobals()()
+
+	if svr, err := f(true); err == nil {
+		t.Error("strict mode should fail")
+	} else if len(svr.workers) != 0 {
+		t.Error("strict mode should not fork workers")
+	}
+
+	svr, err := f(false)
+	if err != nil {
+		t.Error("lenient mode should ok, err is", err)
+	}
+	if GetConfig().Heartbeat.Enabled {
+		t.Error("lenient mode should disable heartbeat")
+	}
+	if GetConfig() == pc || !pc.Heartbeat.Enabled {
+		t.Error("should copy-on-write, never modify the shared config in place")
+	}
+
+	svr.Quit()
+	svr.waitWorkers()
+}
+
+func TestServerWorkersRamp(t *testing.T) {
+	f := func(ramp int) (steps []int) {
+		svr := NewServer()
+		defer GetConfig().Unsubscribe(svr)
+
+		procs := 8
+		svr.gomaxprocs = func(n int) int {
+			pv := procs
+			if n > 0 {
+				procs = n
+				steps = append(steps, n)
+			}
+			return pv
+		}
+
+		cc := NewConfig()
+		cc.Workers = 2
+		cc.Go.WorkersRampMs = ramp
+		svr.OnReloadGlobal(ReloadWorkers, cc, GetConfig())
+		svr.waitWorkers()
+		return
+	}
+
+	if steps := f(0); len(steps) != 1 || steps[0] != 2 {
+		t.Error("immediate apply, steps are", steps)
+	}
+	if steps := f(1); fmt.Sprint(steps) != "[7 6 5 4 3 2]" {
+		t.Error("ramp apply, steps are", steps)
+	}
+
+	// the ramp never block the reload, stopped by the fresh reload or quit.
+	svr := NewServer()
+	defer GetConfig().Unsubscribe(svr)
+	clock := core.NewFakeClock(time.Unix(1000, 0))
+	svr.clock = clock
+
+	var lock sync.Mutex
+	procs := 8
+	svr.gomaxprocs = func(n int) int {
+		lock.Lock()
+		defer lock.Unlock()
+		pv := procs
+		if n > 0 {
+			procs = n
+		}
+		return pv
+	}
+
+	cc := NewConfig()
+	cc.Workers = 2
+	cc.Go.WorkersRampMs = 1000
+	svr.OnReloadGlobal(ReloadWorkers, cc, GetConfig())
+	for i := 0; i < 100 && clock.Timers() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if v := svr.gomaxprocs(0); v != 7 {
+		t.Error("should ramp to 7, actual is", v)
+	}
+
+	cc.Workers, cc.Go.WorkersRampMs = 4, 0
+	svr.OnReloadGlobal(ReloadWorkers, cc, GetConfig())
+	if v := svr.gomaxprocs(0); v != 4 {
+		t.Error("should stop ramp and apply 4, actual is", v)
+	}
+	if v := svr.runningWorkers(); len(v) != 0 {
+		t.Error("should stop the ramp worker, actual is", v)
+	}
+
+	cc.Workers, cc.Go.WorkersRampMs = 1, 1000
+	svr.OnReloadGlobal(ReloadWorkers, cc, GetConfig())
+	svr.Quit()
+	svr.waitWorkers()
+	if v := svr.gomaxprocs(0); v != 3 {
+		t.Error("should stop ramp when quit, actual is", v)
+	}
+}
+
 // the goroutine cycle ignore any error.
 func ExampleWorkerContainer_recoverable() {
 	var wc WorkerContainer
@@ -101,3 +1804,107 @@ func ExampleWorkerContainer_fatal() {
 		}
 	})
 }
+
+func TestServerWithConfig(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+	pc := GetConfig()
+
+	newServer := func(conf string) (*Server, string) {
+		svr := NewServerWithConfig(NewConfig())
+		svr.gomaxprocs = func(n int) int {
+			return 1
+		}
+
+		f := writeTestConfig(t, conf)
+		if err := svr.ParseConfig(f); err != nil {
+			t.Fatal("parse config failed, err is", err)
+		}
+		return svr, f
+	}
+
+	s0, f0 := newServer(`{"workers": 1}`)
+	defer s0.Close()
+	s1, _ := newServer(`{"workers": 2}`)
+	defer s1.Close()
+
+	if s0.config().Workers != 1 || s1.config().Workers != 2 || GetConfig() != pc || GetConfig().Workers != 0 {
+		t.Error("should use the injected config, actual is", s0.config().Workers, s1.config().Workers, GetConfig().Workers)
+	}
+	for _, v := range GetConfig().reloadHandlers {
+		if v == s0 || v == s1 {
+			t.Error("should not subscribe the global config")
+		}
+	}
+
+	// reload the injected config only.
+	if err := ioutil.WriteFile(f0, []byte(`{"workers": 3}`), 0644); err != nil {
+		t.Fatal("write config failed, err is", err)
+	}
+	if err := s0.reload(); err != nil {
+		t.Error("reload failed, err is", err)
+	}
+	if s0.config().Workers != 3 || s0.config().Previous() == nil || s1.config().Workers != 2 || GetConfig() != pc {
+		t.Error("should reload the injected config, actual is", s0.config().Workers, s1.config().Workers, GetConfig().Workers)
+	}
+}
+
+func TestServerGForkOrdered(t *testing.T) {
+	svr := NewServer()
+	defer svr.Close()
+
+	var lock sync.Mutex
+	var quits []string
+	fork := func(name string, priority int) {
+		svr.GForkOrdered(name, priority, func(wc WorkerContainer) {
+			<-wc.QC()
+			wc.Quit()
+
+			// the lower never notified before the higher terminated.
+			time.Sleep(30 * time.Millisecond)
+			lock.Lock()
+			defer lock.Unlock()
+			quits = append(quits, name)
+		})
+	}
+	fork("net", 0)
+	fork("htbt", 1)
+	fork("htbt2", 1)
+	fork("first", 2)
+
+	svr.Quit()
+	select {
+	case <-svr.QC():
+		t.Error("server should quit after ordered workers")
+	default:
+	}
+	svr.waitWorkers()
+
+	if len(quits) != 4 || quits[0] != "first" || quits[3] != "net" {
+		t.Error("should quit in order, actual is", quits)
+	}
+	if err := svr.Context().Err(); err != context.Canceled {
+		t.Error("should cancel context when quit, err is", err)
+	}
+}
+
+func TestServerUptime(t *testing.T) {
+	defer restoreGlobals()()
+	SetConfig(NewConfig())
+
+	svr := NewServer()
+	defer svr.Close()
+	svr.transit(StateReady, "test")
+
+	if v := svr.Uptime(); v != 0 {
+		t.Error("should be 0 before run, actual is", v)
+	}
+
+	svr.Quit()
+	if err := svr.Run(); err != nil {
+		t.Error("run failed, err is", err)
+	}
+	if v := svr.Uptime(); v <= 0 {
+		t.Error("should uptime since run, actual is", v)
+	}
+}
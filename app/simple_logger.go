@@ -22,59 +22,1048 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/ossrs/go-oryx/core"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // the simple logger which implements the interface
 // and log to console or file.
 type simpleLogger struct {
+	file *rotateFile
+	// the file for error tank.
+	errorFile *rotateFile
+	// the syslog for syslog tank.
+	syslog syslogTank
+	// the throttle of all tanks, nil to disable.
+	throttle *logThrottle
+	// the async log of all tanks, nil to write in sync.
+	async *asyncLog
+	// the last lines of all tanks, for api to tail.
+	tail logTail
+}
+
+// the ring buffer of the last lines, disabled when size is 0.
+// @remark the write and snapshot is locked, safe for goroutines.
+type logTail struct {
+	ring []string
+	// the next position to write, and whether the ring is full.
+	next int
+	full bool
+	lock sync.Mutex
+}
+
+// resize the ring to keep the last n lines, 0 to disable,
+// the last lines are kept when resize.
+func (v *logTail) resize(n int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if n == len(v.ring) {
+		return
+	}
+
+	lines := v.snapshot()
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	v.ring = make([]string, n)
+	v.next = copy(v.ring, lines)
+	v.full = n > 0 && v.next == n
+	if v.full {
+		v.next = 0
+	}
+}
+
+// append a line to ring, drop the oldest when full.
+func (v *logTail) append(line string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if len(v.ring) == 0 {
+		return
+	}
+
+	v.ring[v.next] = line
+	if v.next++; v.next == len(v.ring) {
+		v.next, v.full = 0, true
+	}
+}
+
+// the copy of lines, the oldest first.
+func (v *logTail) last() []string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.snapshot()
+}
+
+// the copy of lines, the lock must be held.
+func (v *logTail) snapshot() []string {
+	if !v.full {
+		return append([]string{}, v.ring[:v.next]...)
+	}
+	return append(append([]string{}, v.ring[v.next:]...), v.ring[:v.next]...)
+}
+
+// the writer to append each line to tail, then write to w.
+type tailWriter struct {
+	w io.Writer
+	t *logTail
+}
+
+func (v *tailWriter) Write(p []byte) (int, error) {
+	v.t.append(strings.TrimRight(string(p), "\n"))
+	return v.w.Write(p)
+}
+
+// the syslog tank, each level writes in its priority.
+type syslogTank interface {
+	io.Closer
+	// the writer for level.
+	Level(level string) io.Writer
+}
+
+// the log file which rotate by size or daily,
+// the rotated file is renamed to name.timestamp and fresh file is opened,
+// the oldest rotated files more than backups are removed.
+// @remark the write and rotate is locked, safe for goroutines.
+type rotateFile struct {
+	name string
+	// the max size in bytes, 0 to disable.
+	maxSize int64
+	// whether rotate when day changed.
+	daily bool
+	// the max rotated files to keep, 0 to keep all.
+	backups int
+	// the clock, default to time.Now.
+	now func() time.Time
+
 	file *os.File
+	size int64
+	// the day of file opened, in YYYYMMDD.
+	day  string
+	lock sync.Mutex
+}
+
+func openRotateFile(c *Config, name string) (f *rotateFile, err error) {
+	if err = mkdirLog(c, name); err != nil {
+		return
+	}
+
+	f = &rotateFile{
+		name:    name,
+		maxSize: int64(c.Log.MaxSizeMB) * 1024 * 1024,
+		daily:   c.Log.Daily,
+		backups: c.Log.MaxBackups,
+		now:     time.Now,
+	}
+
+	if err = f.open(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// create the parent dir of log file in log.dir_perm, for the first-run deployment.
+func mkdirLog(c *Config, name string) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, c.logDirPerm()); err != nil {
+		return errors.New(fmt.Sprintf("create log dir %v of %v failed, err is %v", dir, name, err))
+	}
+	return nil
+}
+
+func (f *rotateFile) Name() string {
+	return f.name
+}
+
+// interface io.Writer
+func (f *rotateFile) Write(p []byte) (n int, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	// when rotate failed, write to the reopened file and return the error.
+	if (f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize) || (f.daily && f.now().Format("20060102") != f.day) {
+		if err = f.rotate(); err != nil && f.file == nil {
+			return
+		}
+	}
+
+	var werr error
+	n, werr = f.file.Write(p)
+	f.size += int64(n)
+	if werr != nil {
+		err = werr
+	}
+	return
+}
+
+func (f *rotateFile) Close() (err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return
+	}
+
+	err = f.file.Close()
+	f.file = nil
+	return
+}
+
+// close and open the file, for it maybe moved by logrotate,
+// the write never hits the closed file for it's locked.
+func (f *rotateFile) reopen() (err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file != nil {
+		if err = f.file.Close(); err != nil {
+			return
+		}
+		f.file = nil
+	}
+
+	return f.open()
+}
+
+// open the log file for append, the lock must be held.
+func (f *rotateFile) open() (err error) {
+	if f.file, err = os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		return
+	}
+
+	var fi os.FileInfo
+	if fi, err = f.file.Stat(); err != nil {
+		f.file.Close()
+		f.file = nil
+		return
+	}
+
+	f.size = fi.Size()
+	f.day = f.now().Format("20060102")
+	return
+}
+
+// the layout of backup suffix, for example, oryx.log.20151010101010.000000
+const rotateLayout = "20060102150405.000000"
+
+// the glob pattern of backups, only match the suffix of rotateLayout,
+// never match the others, for example, the error file oryx.log.err.
+func rotateBackups(name string) string {
+	return name + "." + strings.Repeat("[0-9]", 14) + "." + strings.Repeat("[0-9]", 6)
+}
+
+// rename the current file and open a fresh one, the lock must be held.
+// @remark reopen the current file when rename failed.
+func (f *rotateFile) rotate() (err error) {
+	if err = f.file.Close(); err != nil {
+		return
+	}
+	f.file = nil
+
+	backup := fmt.Sprintf("%v.%v", f.name, f.now().Format(rotateLayout))
+	if err = os.Rename(f.name, backup); err != nil {
+		if e := f.open(); e != nil {
+			return errors.New(fmt.Sprintf("rename %v failed, err is %v, reopen failed, err is %v", f.name, err, e))
+		}
+		return
+	}
+
+	if err = f.open(); err != nil {
+		return
+	}
+
+	// the backups is sorted by timestamp, remove the oldest.
+	if f.backups > 0 {
+		var backups []string
+		if backups, err = filepath.Glob(rotateBackups(f.name)); err != nil {
+			return
+		}
+		sort.Strings(backups)
+
+		for len(backups) > f.backups {
+			if err = os.Remove(backups[0]); err != nil {
+				return
+			}
+			backups = backups[1:]
+		}
+	}
+
+	return
+}
+
+// the placeholders for log prefix template.
+var logPlaceholders = []string{"{level}", "{time}", "{worker}", "{host}", "{pid}"}
+
+// parse the log prefix template to literals and placeholders,
+// for example, "[{level}] " => ["[", "{level}", "] "]
+func parseLogTemplate(tmpl string) (parts []string, err error) {
+	for len(tmpl) > 0 {
+		i := strings.Index(tmpl, "{")
+		if i < 0 {
+			parts = append(parts, tmpl)
+			break
+		}
+		if i > 0 {
+			parts = append(parts, tmpl[:i])
+			tmpl = tmpl[i:]
+		}
+
+		j := strings.Index(tmpl, "}")
+		if j < 0 {
+			return nil, errors.New(fmt.Sprintf("log prefix template unclosed placeholder %v", tmpl))
+		}
+
+		p := tmpl[:j+1]
+		var ok bool
+		for _, v := range logPlaceholders {
+			if ok = v == p; ok {
+				break
+			}
+		}
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("log prefix template invalid placeholder %v, must be %v", p, logPlaceholders))
+		}
+
+		parts = append(parts, p)
+		tmpl = tmpl[j+1:]
+	}
+
+	return
+}
+
+// the default layout of log time, same to the log.LstdFlags.
+const logTimeDefault = "2006/01/02 15:04:05"
+
+// the func to format the log time by log.time_format and log.utc.
+func logTimeFormat(c *Config) func(t time.Time) string {
+	layout, utc := c.Log.TimeFormat, c.Log.UTC
+	switch layout {
+	case "", "default":
+		layout = logTimeDefault
+	case "rfc3339":
+		layout = time.RFC3339
+	case "unix":
+		return func(t time.Time) string {
+			return strconv.FormatInt(t.Unix(), 10)
+		}
+	}
+
+	return func(t time.Time) string {
+		if utc {
+			t = t.UTC()
+		}
+		return t.Format(layout)
+	}
+}
+
+// the logger which render the prefix by template,
+// for example, "[{level}][{time}] " => "[trace][2015/10/10 10:10:10] "
+type templateLogger struct {
+	w      io.Writer
+	level  string
+	host   string
+	parts  []string
+	format func(t time.Time) string
+}
+
+func newTemplateLogger(w io.Writer, level string, parts []string, format func(t time.Time) string) *templateLogger {
+	host, _ := os.Hostname()
+	return &templateLogger{w: w, level: level, host: host, parts: parts, format: format}
+}
+
+// interface core.Logger
+func (l *templateLogger) Println(a ...interface{}) {
+	l.WorkerPrintln("main", a...)
+}
+
+// interface core.WorkerLogger
+func (l *templateLogger) WorkerPrintln(worker string, a ...interface{}) {
+	b := make([]byte, 0, 128)
+	for _, p := range l.parts {
+		switch p {
+		case "{level}":
+			b = append(b, l.level...)
+		case "{time}":
+			b = append(b, l.format(time.Now())...)
+		case "{worker}":
+			b = append(b, worker...)
+		case "{host}":
+			b = append(b, l.host...)
+		case "{pid}":
+			b = append(b, fmt.Sprint(os.Getpid())...)
+		default:
+			b = append(b, p...)
+		}
+	}
+	b = append(b, fmt.Sprintln(a...)...)
+
+	// write the whole line once.
+	l.w.Write(b)
+}
+
+// log the operation when it's slower than threshold in ms,
+// for example, defer logSlow("reload", 1000, time.Now())
+func logSlow(op string, threshold int, starttime time.Time) {
+	if d := time.Since(starttime); threshold > 0 && d > time.Duration(threshold)*time.Millisecond {
+		core.Warn.Println("slow operation", op, "cost", d, "threshold is", threshold, "ms")
+	}
+}
+
+// the logger which write each line in json,
+// for example, {"time":"2015/10/10 10:10:10","level":"trace","msg":"...","worker":"main"}
+type jsonLogger struct {
+	w      io.Writer
+	level  string
+	format func(t time.Time) string
+}
+
+func newJsonLogger(w io.Writer, level string, format func(t time.Time) string) *jsonLogger {
+	return &jsonLogger{w: w, level: level, format: format}
+}
+
+// interface core.Logger
+func (l *jsonLogger) Println(a ...interface{}) {
+	l.WorkerPrintln("main", a...)
+}
+
+// interface core.WorkerLogger
+func (l *jsonLogger) WorkerPrintln(worker string, a ...interface{}) {
+	v := struct {
+		Time   string `json:"time"`
+		Level  string `json:"level"`
+		Msg    string `json:"msg"`
+		Worker string `json:"worker"`
+	}{
+		Time:   l.format(time.Now()),
+		Level:  l.level,
+		Msg:    strings.TrimSuffix(fmt.Sprintln(a...), "\n"),
+		Worker: worker,
+	}
+
+	b, err := json.Marshal(&v)
+	if err != nil {
+		return
+	}
+
+	// write the whole line once.
+	l.w.Write(append(b, '\n'))
+}
+
+// check whether the log config can be opened, without apply it.
+func (l *simpleLogger) check(c *Config) (err error) {
+	if _, err = parseLogTemplate(c.Log.PrefixTemplate); err != nil {
+		return
+	}
+
+	files := []string{}
+	if c.LogToFile() {
+		files = append(files, c.Log.File)
+	}
+	if c.Log.ErrorTank == "file" {
+		files = append(files, c.Log.ErrorFile)
+	}
+
+	if c.LogToSyslog() || c.Log.ErrorTank == "syslog" {
+		var v syslogTank
+		if v, err = openSyslog(c); err != nil {
+			return
+		}
+		v.Close()
+	}
+
+	for _, name := range files {
+		if err = mkdirLog(c, name); err != nil {
+			return
+		}
+
+		var f *os.File
+		if f, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			return
+		}
+		f.Close()
+	}
+
+	return
 }
 
 func (l *simpleLogger) open(c *Config) (err error) {
 	core.Info.Println("apply log tank", c.Log.Tank)
 	core.Info.Println("apply log level", c.Log.Level)
 
+	var parts []string
+	if parts, err = parseLogTemplate(c.Log.PrefixTemplate); err != nil {
+		core.Error.Println("parse log template", c.Log.PrefixTemplate, "failed, err is", err)
+		return
+	}
+
+	// the writers of info, trace, warn and error.
+	var wi, wt, ww, we io.Writer = os.Stdout, os.Stdout, os.Stderr, os.Stderr
+
 	if c.LogToFile() {
 		core.Trace.Println("apply log", c.Log.Tank, c.Log.Level, c.Log.File)
 		core.Trace.Println("please see detail of log: tailf", c.Log.File)
 
-		if l.file, err = os.OpenFile(c.Log.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		if l.file, err = openRotateFile(c, c.Log.File); err != nil {
 			core.Error.Println("open log file", c.Log.File, "failed, err is", err)
 			return
-		} else {
-			core.Info = log.New(c.LogTank("info", l.file), core.LogInfoLabel, log.LstdFlags)
-			core.Trace = log.New(c.LogTank("trace", l.file), core.LogTraceLabel, log.LstdFlags)
-			core.Warn = log.New(c.LogTank("warn", l.file), core.LogWarnLabel, log.LstdFlags)
-			core.Error = log.New(c.LogTank("error", l.file), core.LogErrorLabel, log.LstdFlags)
 		}
+		wi, wt, ww, we = l.file, l.file, l.file, l.file
+	} else if c.LogToSyslog() {
+		core.Trace.Println("apply log", c.Log.Tank, c.Log.Level, c.Log.Syslog.Facility, c.Log.Syslog.Tag)
+
+		if l.syslog, err = openSyslog(c); err != nil {
+			core.Error.Println("open syslog", c.Log.Syslog.Facility, c.Log.Syslog.Tag, "failed, err is", err)
+			return
+		}
+		wi, wt, ww, we = l.syslog.Level("info"), l.syslog.Level("trace"), l.syslog.Level("warn"), l.syslog.Level("error")
 	} else {
 		core.Trace.Println("apply log", c.Log.Tank, c.Log.Level)
+	}
 
-		core.Info = log.New(c.LogTank("info", os.Stdout), core.LogInfoLabel, log.LstdFlags)
-		core.Trace = log.New(c.LogTank("trace", os.Stdout), core.LogTraceLabel, log.LstdFlags)
-		core.Warn = log.New(c.LogTank("warn", os.Stderr), core.LogWarnLabel, log.LstdFlags)
-		core.Error = log.New(c.LogTank("error", os.Stderr), core.LogErrorLabel, log.LstdFlags)
+	// the error tank override the error, and warn if required.
+	if c.Log.ErrorTank == "file" {
+		core.Trace.Println("apply error log", c.Log.ErrorTank, c.Log.ErrorFile, "warn", c.Log.ErrorTankWarn)
+
+		if l.errorFile, err = openRotateFile(c, c.Log.ErrorFile); err != nil {
+			core.Error.Println("open error log file", c.Log.ErrorFile, "failed, err is", err)
+			return
+		}
+		we = l.errorFile
+	} else if c.Log.ErrorTank == "syslog" {
+		core.Trace.Println("apply error log", c.Log.ErrorTank, c.Log.Syslog.Facility, c.Log.Syslog.Tag, "warn", c.Log.ErrorTankWarn)
+
+		// the syslog is shared with the tank.
+		if l.syslog == nil {
+			if l.syslog, err = openSyslog(c); err != nil {
+				core.Error.Println("open syslog", c.Log.Syslog.Facility, c.Log.Syslog.Tag, "failed, err is", err)
+				return
+			}
+		}
+		we = l.syslog.Level("error")
+	} else if c.Log.ErrorTank == "console" {
+		core.Trace.Println("apply error log", c.Log.ErrorTank, "warn", c.Log.ErrorTankWarn)
+		we = os.Stderr
+	}
+	if len(c.Log.ErrorTank) > 0 && c.Log.ErrorTankWarn {
+		ww = we
+	}
+
+	// the output of core.SetOutput wins the tanks, for example, to capture the logs in test.
+	if w := core.Output(); w != nil {
+		core.Trace.Println("apply log to output, override tank", c.Log.Tank)
+		wi, wt, ww, we = w, w, w, w
+	}
+
+	// the throttle shared by all tanks.
+	if c.Log.MaxLinesPerSec > 0 {
+		core.Trace.Println("apply log throttle", c.Log.MaxLinesPerSec, "lines per second")
+		l.throttle = &logThrottle{max: c.Log.MaxLinesPerSec, now: time.Now}
+	} else {
+		l.throttle = nil
+	}
+
+	// the async log is created once, for buffer_size donot support reload.
+	if c.Log.Async && l.async == nil {
+		core.Trace.Println("apply log async, buffer", c.Log.BufferSize, "lines, overflow", c.Log.OverflowPolicy)
+		l.async = &asyncLog{records: make(chan *logRecord, c.Log.BufferSize)}
+	}
+	if l.async != nil {
+		var drop int32
+		if c.Log.OverflowPolicy == "drop" {
+			drop = 1
+		}
+		atomic.StoreInt32(&l.async.drop, drop)
+	}
+
+	// the tail keeps the last lines when reload.
+	l.tail.resize(c.Log.TailSize)
+
+	core.Info = l.logger(c, "info", wi, core.LogInfoLabel, parts)
+	core.Trace = l.logger(c, "trace", wt, core.LogTraceLabel, parts)
+	core.Warn = l.logger(c, "warn", ww, core.LogWarnLabel, parts)
+	core.Error = l.logger(c, "error", we, core.LogErrorLabel, parts)
+	core.SetLogLevel(c.Log.Level)
+	core.SetModuleLogLevels(c.Log.Modules)
+
+	return
+}
+
+// create the logger for level, use the label when no template.
+func (l *simpleLogger) logger(c *Config, level string, w io.Writer, label string, parts []string) core.Logger {
+	if w = c.LogTank(level, w); w != ioutil.Discard && l.async != nil {
+		w = &asyncWriter{a: l.async, w: w}
+	}
+	if w != ioutil.Discard && c.Log.TailSize > 0 {
+		w = &tailWriter{w: w, t: &l.tail}
+	}
+
+	// the formatter of lines, json, the builtin prefix "[oryx][level] time " or template.
+	format := logTimeFormat(c)
+	formatter := func(w io.Writer, level, label string) core.Logger {
+		parts := parts
+		if len(parts) == 0 && c.Log.TimeFormat != "" && c.Log.TimeFormat != "default" {
+			parts = []string{label, "{time}", " "}
+		}
+
+		if c.Log.Format == "json" {
+			return newJsonLogger(w, level, format)
+		} else if len(parts) == 0 && c.Log.UTC {
+			return log.New(w, label, log.LstdFlags|log.LUTC)
+		} else if len(parts) == 0 {
+			return log.New(w, label, log.LstdFlags)
+		}
+		return newTemplateLogger(w, level, parts, format)
+	}
+
+	// the summary of throttle is a warn line in the same format.
+	if w != ioutil.Discard && l.throttle != nil {
+		w = &throttleWriter{w: w, t: l.throttle, summary: formatter(w, "warn", core.LogWarnLabel)}
+	}
+
+	v := formatter(w, level, label)
+
+	if c.Log.CoalesceMs > 0 && w != ioutil.Discard {
+		v = &coalesceLogger{l: v, interval: time.Duration(c.Log.CoalesceMs) * time.Millisecond}
+	}
+
+	// honor the global level, see core.SetLogLevel.
+	lv, _ := core.ParseLogLevel(level)
+	return core.LevelLogger(lv, v)
+}
+
+// the global throttle of log lines every second,
+// the lines exceed max are dropped and summary in next second,
+// or after interval when no more lines.
+type logThrottle struct {
+	max int
+	// the clock, default to time.Now.
+	now func() time.Time
+	// the interval to flush the summary, default to a second.
+	interval time.Duration
+
+	// the second of current window.
+	window  int64
+	lines   int
+	dropped int
+	// the timer and logger to flush the summary.
+	timer   *time.Timer
+	summary core.Logger
+	lock    sync.Mutex
+}
+
+// whether allow to write a line, and the dropped lines of previous window.
+func (t *logThrottle) allow() (ok bool, dropped int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if now := t.now().Unix(); now != t.window {
+		t.window, t.lines, dropped, t.dropped = now, 0, t.dropped, 0
+	}
+
+	if t.lines >= t.max {
+		t.dropped++
+		return false, dropped
+	}
+
+	t.lines++
+	return true, dropped
+}
+
+// drop a line, flush the summary to logger after interval.
+func (t *logThrottle) drop(summary core.Logger) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.timer != nil {
+		return
+	}
+
+	interval := t.interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	t.summary = summary
+	t.timer = time.AfterFunc(interval, t.flush)
+}
+
+// log the summary of dropped lines, for example, when the flood stopped.
+func (t *logThrottle) flush() {
+	t.lock.Lock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	dropped, summary := t.dropped, t.summary
+	t.dropped, t.summary = 0, nil
+	t.lock.Unlock()
+
+	if dropped > 0 && summary != nil {
+		summary.Println("log throttled, dropped", dropped, "lines")
+	}
+}
+
+// the writer to throttle, each write is a line of logger.
+type throttleWriter struct {
+	w io.Writer
+	t *logThrottle
+	// the logger to write the summary of dropped lines to w.
+	summary core.Logger
+}
+
+// interface io.Writer
+func (v *throttleWriter) Write(p []byte) (n int, err error) {
+	ok, dropped := v.t.allow()
+	if dropped > 0 {
+		v.summary.Println("log throttled, dropped", dropped, "lines")
+	}
+
+	if !ok {
+		v.t.drop(v.summary)
+		return len(p), nil
+	}
+	return v.w.Write(p)
+}
+
+// the logger to coalesce the identical consecutive lines of a level,
+// the repeats are logged when a different line arrives or after interval.
+type coalesceLogger struct {
+	l        core.Logger
+	interval time.Duration
+
+	// the last line and its worker.
+	last    string
+	worker  string
+	repeats int
+	// the timer to flush the repeats.
+	timer *time.Timer
+	lock  sync.Mutex
+}
+
+// interface core.Logger
+func (v *coalesceLogger) Println(a ...interface{}) {
+	v.WorkerPrintln("", a...)
+}
+
+// interface core.WorkerLogger
+func (v *coalesceLogger) WorkerPrintln(worker string, a ...interface{}) {
+	line := fmt.Sprintln(a...)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if line == v.last && worker == v.worker {
+		if v.repeats++; v.timer == nil {
+			v.timer = time.AfterFunc(v.interval, v.flush)
+		}
+		return
+	}
+
+	v.flushRepeats()
+	v.last, v.worker = line, worker
+	v.output(worker, a...)
+}
+
+func (v *coalesceLogger) flush() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.flushRepeats()
+}
+
+// log the repeats of last line, the lock must be held.
+func (v *coalesceLogger) flushRepeats() {
+	if v.timer != nil {
+		v.timer.Stop()
+		v.timer = nil
+	}
+
+	if v.repeats > 0 {
+		v.output(v.worker, fmt.Sprintf("last message repeated %v times", v.repeats))
+		v.repeats = 0
+	}
+}
+
+func (v *coalesceLogger) output(worker string, a ...interface{}) {
+	if len(worker) == 0 {
+		v.l.Println(a...)
+		return
+	}
+	core.Ctx(core.WithWorker(context.Background(), worker), v.l).Println(a...)
+}
+
+// the max bytes of a batch to write to tank by async log.
+const asyncBatchSize = 64 * 1024
+
+// the async log, the lines of tanks are buffered in records,
+// and written by the log worker in batch, flush when no pending lines.
+type asyncLog struct {
+	records chan *logRecord
+	// whether the log worker is running, write in sync when not.
+	running int32
+	// whether drop the line when records is full, otherwise block.
+	drop int32
+	// the dropped lines when records is full.
+	dropped int64
+}
+
+// the line to write to tank, or the flush request when done not nil.
+type logRecord struct {
+	w    io.Writer
+	b    []byte
+	done chan bool
+}
+
+// the log worker, write the buffered lines until quit,
+// then write the pending lines and the logs after quit are in sync.
+func (l *simpleLogger) asyncCycle(wc WorkerContainer) {
+	a := l.async
+	if a == nil {
+		return
+	}
+
+	atomic.StoreInt32(&a.running, 1)
+	defer func() {
+		atomic.StoreInt32(&a.running, 0)
+		a.drain()
+	}()
+
+	for {
+		select {
+		case r := <-a.records:
+			a.write(r)
+		case <-wc.QC():
+			wc.Quit()
+			return
+		}
+	}
+}
+
+// write the record and all pending records, the lines of a tank are batched.
+func (a *asyncLog) write(r *logRecord) {
+	var w io.Writer
+	var b []byte
+	flush := func() {
+		if len(b) > 0 {
+			w.Write(b)
+			b = b[:0]
+		}
+	}
+
+	for r != nil {
+		if r.done != nil {
+			flush()
+			close(r.done)
+		} else {
+			if r.w != w || len(b) >= asyncBatchSize {
+				flush()
+				w = r.w
+			}
+			b = append(b, r.b...)
+		}
+
+		select {
+		case r = <-a.records:
+		default:
+			r = nil
+		}
+	}
+	flush()
+
+	if n := atomic.SwapInt64(&a.dropped, 0); n > 0 {
+		core.Warn.Println("async log dropped", n, "lines for buffer full")
+	}
+}
+
+// write the pending records in sync.
+func (a *asyncLog) drain() {
+	select {
+	case r := <-a.records:
+		a.write(r)
+	default:
+	}
+}
+
+// wait for the pending records written, drain in sync when log worker not running.
+func (a *asyncLog) flush() {
+	r := &logRecord{done: make(chan bool)}
+	for records := a.records; ; {
+		if atomic.LoadInt32(&a.running) == 0 {
+			a.drain()
+			return
+		}
+
+		select {
+		case records <- r:
+			records = nil
+		case <-r.done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// the writer to write to tank by the async log.
+type asyncWriter struct {
+	a *asyncLog
+	w io.Writer
+}
+
+// interface io.Writer
+func (v *asyncWriter) Write(p []byte) (n int, err error) {
+	if atomic.LoadInt32(&v.a.running) == 0 {
+		return v.w.Write(p)
+	}
+
+	r := &logRecord{w: v.w, b: append([]byte(nil), p...)}
+	if atomic.LoadInt32(&v.a.drop) == 0 {
+		v.a.records <- r
+		return len(p), nil
+	}
+
+	select {
+	case v.a.records <- r:
+	default:
+		atomic.AddInt64(&v.a.dropped, 1)
+	}
+	return len(p), nil
+}
+
+// reopen the log files, for example, the logrotate moved the files.
+func (l *simpleLogger) reopen() (err error) {
+	for _, f := range []*rotateFile{l.file, l.errorFile} {
+		if f == nil {
+			continue
+		}
+
+		if err = f.reopen(); err != nil {
+			core.Error.Println("reopen log file", f.Name(), "failed, err is", err)
+			return
+		}
+		core.Trace.Println("reopen log file", f.Name(), "ok")
 	}
 
 	return
 }
 
 func (l *simpleLogger) close(c *Config) (err error) {
-	if l.file == nil {
+	// write the summary and buffered lines before the tanks closed.
+	if l.throttle != nil {
+		l.throttle.flush()
+	}
+	if l.async != nil {
+		l.async.flush()
+	}
+
+	if l.file == nil && l.errorFile == nil && l.syslog == nil {
 		return
 	}
 
 	// when log closed, set the logger warn to stderr for file closed.
 	core.Warn = log.New(os.Stderr, core.LogWarnLabel, log.LstdFlags)
 
-	// try to close the log file.
-	if err = l.file.Close(); err != nil {
-		core.Warn.Println("gracefully close log file", c.Log.File, "failed, err is", err)
-	} else {
-		core.Warn.Println("close log file", c.Log.File, "ok")
+	// try to close the log files.
+	for _, f := range []*rotateFile{l.file, l.errorFile} {
+		if f == nil {
+			continue
+		}
+
+		if err = f.Close(); err != nil {
+			core.Warn.Println("gracefully close log file", f.Name(), "failed, err is", err)
+		} else {
+			core.Warn.Println("close log file", f.Name(), "ok")
+		}
+	}
+	l.file, l.errorFile = nil, nil
+
+	if l.syslog != nil {
+		if err = l.syslog.Close(); err != nil {
+			core.Warn.Println("gracefully close syslog failed, err is", err)
+		} else {
+			core.Warn.Println("close syslog ok")
+		}
+		l.syslog = nil
+	}
+
+	return
+}
+
+// close and open the logger to apply the config.
+func (l *simpleLogger) apply(c *Config) (err error) {
+	if err = l.close(c); err != nil {
+		return
+	}
+	core.Info.Println("close logger ok")
+
+	if err = l.open(c); err != nil {
+		return
+	}
+	core.Info.Println("open logger ok")
+
+	return
+}
+
+// the initial backoff to retry to open the logger, double for each retry.
+var logOpenBackoff = 100 * time.Millisecond
+
+// apply the config at startup, retry at most log.open_retries times with backoff,
+// for the transient failure, for example, the busy nfs, return the last error.
+func (l *simpleLogger) prepare(c *Config) (err error) {
+	backoff := logOpenBackoff
+	for i := 0; ; i++ {
+		if err = l.apply(c); err == nil || i >= c.Log.OpenRetries {
+			return
+		}
+
+		core.Warn.Println("open logger failed, retry", i+1, "of", c.Log.OpenRetries, "in", backoff, "err is", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// interface ReloadChecker
+func (l *simpleLogger) CanReload(cc, pc *Config) (err error) {
+	return l.check(cc)
+}
+
+// interface ReloadTier
+// the logger reassigns the core loggers, never notified in parallel with others.
+func (l *simpleLogger) ReloadTier() int {
+	return ReloadTierLog
+}
+
+// interface ReloadHandler
+func (l *simpleLogger) OnReloadGlobal(scope int, cc, pc *Config) (err error) {
+	if scope != ReloadLog {
+		return
+	}
+
+	// keep the previous logger when failed, never leave the server logless.
+	if err = l.apply(cc); err != nil {
+		if err := l.apply(pc); err != nil {
+			core.Error.Println("restore the previous logger failed, err is", err)
+		}
+		core.Warn.Println("reload logger failed, keep the previous, err is", err)
 	}
 
 	return
@@ -0,0 +1,678 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ossrs/go-oryx/core"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLogTemplate(t *testing.T) {
+	f := func(tmpl, level, expect string) {
+		var b bytes.Buffer
+		if parts, err := parseLogTemplate(tmpl); err != nil {
+			t.Error("parse", tmpl, "failed, err is", err)
+		} else {
+			newTemplateLogger(&b, level, parts, logTimeFormat(NewConfig())).Println("test", "logger.")
+		}
+
+		if ok, _ := regexp.MatchString(expect, b.String()); !ok {
+			t.Error("template", tmpl, "expect", expect, "actual is", b.String())
+		}
+	}
+
+	f("[{level}] ", "trace", `^\[trace\] test logger\.\n$`)
+	f("[oryx][{level}][{time}] ", "warn", `^\[oryx\]\[warn\]\[\d{4}/\d\d/\d\d \d\d:\d\d:\d\d\] test logger\.\n$`)
+	f("{pid}@{host} {worker}: ", "info", fmt.Sprintf(`^%v@.* main: test logger\.\n$`, os.Getpid()))
+
+	for _, v := range []string{"{level", "[{levels}]", "{}", "{lev{el}"} {
+		if _, err := parseLogTemplate(v); err == nil {
+			t.Error("template", v, "should be invalid")
+		}
+	}
+
+	c := NewConfig()
+	c.Log.PrefixTemplate = "[{unknown}]"
+	if err := c.Validate(); err == nil {
+		t.Error("config should be invalid for template", c.Log.PrefixTemplate)
+	}
+}
+
+func TestLogErrorTank(t *testing.T) {
+	defer restoreGlobals()()
+
+	dir := t.TempDir()
+	c := NewConfig()
+	c.Log.Level = "info"
+	c.Log.File = path.Join(dir, "oryx.log")
+	c.Log.ErrorTank = "file"
+	c.Log.ErrorFile = path.Join(dir, "oryx.error.log")
+
+	l := &simpleLogger{}
+	if err := l.open(c); err != nil {
+		t.Fatal("open logger failed, err is", err)
+	}
+	core.Info.Println("info message.")
+	core.Error.Println("error message.")
+	if err := l.close(c); err != nil {
+		t.Error("close logger failed, err is", err)
+	}
+
+	if b, err := ioutil.ReadFile(c.Log.ErrorFile); err != nil {
+		t.Error("read error log failed, err is", err)
+	} else if v := string(b); !strings.Contains(v, "error message.") || strings.Contains(v, "info message.") {
+		t.Error("error tank should only contains error, actual is", v)
+	}
+
+	if b, err := ioutil.ReadFile(c.Log.File); err != nil {
+		t.Error("read log failed, err is", err)
+	} else if v := string(b); strings.Contains(v, "error message.") || !strings.Contains(v, "info message.") {
+		t.Error("tank should not contains error, actual is", v)
+	}
+}
+
+func TestLogOutput(t *testing.T) {
+	defer restoreGlobals()()
+
+	var b bytes.Buffer
+	core.SetOutput(&b)
+
+	dir := t.TempDir()
+	c := NewConfig()
+	c.Log.File = path.Join(dir, "oryx.log")
+	c.conf = path.Join(dir, "oryx.json")
+	if err := ioutil.WriteFile(c.conf, []byte(`{"workers": -1}`), 0644); err != nil {
+		t.Fatal("write config failed, err is", err)
+	}
+
+	l := &simpleLogger{}
+	if err := l.open(c); err != nil {
+		t.Fatal("open logger failed, err is", err)
+	}
+	if _, err := c.parseReload(); err == nil {
+		t.Error("should reload failed for invalid config")
+	}
+	if err := l.close(c); err != nil {
+		t.Error("close logger failed, err is", err)
+	}
+
+	if v := b.String(); !strings.Contains(v, "reload config failed") {
+		t.Error("should log to output, actual is", v)
+	}
+	if b, err := ioutil.ReadFile(c.Log.File); err == nil && strings.Contains(string(b), "reload config failed") {
+		t.Error("output should override the tank, actual is", string(b))
+	}
+}
+
+func TestLogTail(t *testing.T) {
+	defer restoreGlobals()()
+
+	c := NewConfig()
+	c.Log.Tank = "console"
+	c.Log.TailSize = 3
+	core.SetOutput(ioutil.Discard)
+
+	l := &simpleLogger{}
+	if err := l.open(c); err != nil {
+		t.Fatal("open logger failed, err is", err)
+	}
+	for i := 0; i < 5; i++ {
+		core.Trace.Println("line", i)
+	}
+	core.Info.Println("info is disabled")
+
+	v := l.tail.last()
+	if len(v) != 3 || !strings.HasSuffix(v[0], "line 2") || !strings.HasSuffix(v[2], "line 4") {
+		t.Error("should keep the last 3 lines, actual is", v)
+	}
+
+	// keep the last lines when resize.
+	l.tail.resize(2)
+	if v := l.tail.last(); len(v) != 2 || !strings.HasSuffix(v[1], "line 4") {
+		t.Error("should keep the last lines when resize, actual is", v)
+	}
+	l.tail.resize(0)
+	core.Trace.Println("line 5")
+	if v := l.tail.last(); len(v) != 0 {
+		t.Error("should disable the tail, actual is", v)
+	}
+}
+
+func TestLogPrepareRetry(t *testing.T) {
+	defer restoreGlobals()()
+	pb := logOpenBackoff
+	defer func() {
+		logOpenBackoff = pb
+	}()
+	logOpenBackoff = 100 * time.Millisecond
+
+	// the parent of log file is a file, fail to create the dir.
+	dir := t.TempDir()
+	blocker := path.Join(dir, "logs")
+	if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConfig()
+	c.Log.File = path.Join(blocker, "oryx.log")
+	c.Log.OpenRetries = 1
+
+	l := &simpleLogger{}
+	starttime := time.Now()
+	if err := l.prepare(c); err == nil {
+		t.Error("should fail after retries")
+	}
+	if v := time.Since(starttime); v < logOpenBackoff {
+		t.Error("should retry in backoff, actual is", v)
+	}
+
+	// ok when the transient failure recovered in retry.
+	removed := make(chan bool)
+	go func(d time.Duration) {
+		defer close(removed)
+		time.Sleep(d)
+		os.Remove(blocker)
+	}(logOpenBackoff / 5)
+	if err := l.prepare(c); err != nil {
+		t.Error("should ok after retry, err is", err)
+	}
+	<-removed
+	if err := l.close(c); err != nil {
+		t.Error("close logger failed, err is", err)
+	}
+}
+
+func TestLogReloadKeep(t *testing.T) {
+	defer restoreGlobals()()
+
+	dir := t.TempDir()
+	pc := NewConfig()
+	pc.Log.File = path.Join(dir, "oryx.log")
+
+	l := &simpleLogger{}
+	if err := l.open(pc); err != nil {
+		t.Fatal("open logger failed, err is", err)
+	}
+	defer l.close(pc)
+
+	// the fresh log file can not open, for the parent is a file.
+	cc := NewConfig()
+	cc.Log.File = path.Join(pc.Log.File, "oryx.log")
+	if err := l.OnReloadGlobal(ReloadLog, cc, pc); err == nil {
+		t.Error("reload should fail")
+	}
+	if l.file == nil || l.file.Name() != pc.Log.File {
+		t.Fatal("should keep the previous log file, actual is", l.file)
+	}
+
+	core.Trace.Println("after reload failed")
+	if b, err := ioutil.ReadFile(pc.Log.File); err != nil || !strings.Contains(string(b), "after reload failed") {
+		t.Error("should log to the previous file, actual is", string(b), err)
+	}
+}
+
+func TestLogMkdir(t *testing.T) {
+	defer restoreGlobals()()
+
+	dir := t.TempDir()
+	c := NewConfig()
+	c.Log.File = path.Join(dir, "logs", "oryx.log")
+	c.Log.DirPerm = "0700"
+
+	l := &simpleLogger{}
+	if err := l.open(c); err != nil {
+		t.Fatal("open logger failed, err is", err)
+	}
+	if err := l.close(c); err != nil {
+		t.Error("close logger failed, err is", err)
+	}
+	if fi, err := os.Stat(path.Dir(c.Log.File)); err != nil || !fi.IsDir() || fi.Mode().Perm() != 0700 {
+		t.Error("should create the log dir, actual is", fi, err)
+	}
+
+	// the reload check creates the fresh dir.
+	c.Log.File = path.Join(dir, "fresh", "oryx.log")
+	if err := l.check(c); err != nil {
+		t.Error("check failed, err is", err)
+	}
+	if _, err := os.Stat(path.Dir(c.Log.File)); err != nil {
+		t.Error("should create the fresh log dir, err is", err)
+	}
+
+	// fail when create dir failed, for the parent is a file.
+	c.Log.File = path.Join(dir, "fresh", "oryx.log", "oryx.log")
+	if err := l.check(c); err == nil || !strings.Contains(err.Error(), "create log dir") {
+		t.Error("should fail to create dir, actual is", err)
+	}
+}
+
+func TestLogRotate(t *testing.T) {
+	dir := t.TempDir()
+	c := NewConfig()
+	c.Log.MaxBackups = 2
+
+	name := path.Join(dir, "oryx.log")
+	f, err := openRotateFile(c, name)
+	if err != nil {
+		t.Fatal("open failed, err is", err)
+	}
+	defer f.Close()
+	f.maxSize = 10
+
+	// rotate by size, keep 2 backups.
+	for i := 0; i < 5; i++ {
+		f.Write([]byte("0123456789"))
+	}
+	if backups, _ := filepath.Glob(name + ".*"); len(backups) != 2 {
+		t.Error("should keep 2 backups, actual is", backups)
+	}
+	if b, _ := ioutil.ReadFile(name); string(b) != "0123456789" {
+		t.Error("invalid fresh log", string(b))
+	}
+
+	// rotate when day changed.
+	f.maxSize = 0
+	day := time.Now()
+	f.now = func() time.Time {
+		return day
+	}
+	f.Write([]byte("today"))
+	day = day.Add(24 * time.Hour)
+	f.daily = true
+	f.Write([]byte("tomorrow"))
+	if b, _ := ioutil.ReadFile(name); string(b) != "tomorrow" {
+		t.Error("should rotate daily, actual is", string(b))
+	}
+
+	// write and rotate in goroutines.
+	f.maxSize = 64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 32; j++ {
+				f.Write([]byte("concurrent write\n"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if b, err := ioutil.ReadFile(name); err != nil || len(b) > 64 {
+		t.Error("invalid file after rotate", len(b), err)
+	}
+}
+
+func TestLogRotateOthers(t *testing.T) {
+	dir := t.TempDir()
+	c := NewConfig()
+	c.Log.MaxBackups = 1
+
+	// the error file and others are not backups.
+	name := path.Join(dir, "oryx.log")
+	for _, v := range []string{name + ".err", name + ".1"} {
+		if err := ioutil.WriteFile(v, nil, 0644); err != nil {
+			t.Fatal("write failed, err is", err)
+		}
+	}
+
+	f, err := openRotateFile(c, name)
+	if err != nil {
+		t.Fatal("open failed, err is", err)
+	}
+	defer f.Close()
+	f.maxSize = 10
+
+	now := time.Now()
+	f.now = func() time.Time {
+		return now
+	}
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Second)
+		f.Write([]byte("0123456789"))
+	}
+	for _, v := range []string{name + ".err", name + ".1"} {
+		if _, err := os.Stat(v); err != nil {
+			t.Error("should not remove", v, "err is", err)
+		}
+	}
+	if backups, _ := filepath.Glob(rotateBackups(name)); len(backups) != 1 {
+		t.Error("should keep 1 backup, actual is", backups)
+	}
+
+	// the rename failed for the backup is a dir, keep writing to the file.
+	now = now.Add(time.Second)
+	backup := fmt.Sprintf("%v.%v", name, now.Format(rotateLayout))
+	if err := os.MkdirAll(path.Join(backup, "dir"), 0755); err != nil {
+		t.Fatal("mkdir failed, err is", err)
+	}
+	if n, err := f.Write([]byte("rename failed")); err == nil || n != 13 {
+		t.Error("should write and return the rename error", n, err)
+	}
+	f.Write([]byte(" and next"))
+	if b, _ := ioutil.ReadFile(name); !strings.HasSuffix(string(b), "rename failed and next") {
+		t.Error("should reopen the file, actual is", string(b))
+	}
+}
+
+func TestLogReopen(t *testing.T) {
+	defer restoreGlobals()()
+
+	dir := t.TempDir()
+	c := NewConfig()
+	c.Log.File = path.Join(dir, "oryx.log")
+
+	l := &simpleLogger{}
+	if err := l.open(c); err != nil {
+		t.Fatal("open logger failed, err is", err)
+	}
+	defer l.close(c)
+
+	// the logrotate moved the log file.
+	core.Warn.Println("before rotate")
+	if err := os.Rename(c.Log.File, c.Log.File+".1"); err != nil {
+		t.Fatal("rename failed, err is", err)
+	}
+
+	if err := l.reopen(); err != nil {
+		t.Error("reopen failed, err is", err)
+	}
+	core.Warn.Println("after rotate")
+
+	if b, _ := ioutil.ReadFile(c.Log.File + ".1"); !strings.Contains(string(b), "before rotate") || strings.Contains(string(b), "after rotate") {
+		t.Error("invalid rotated log", string(b))
+	}
+	if b, _ := ioutil.ReadFile(c.Log.File); !strings.Contains(string(b), "after rotate") {
+		t.Error("invalid fresh log", string(b))
+	}
+}
+
+func TestLogJsonFormat(t *testing.T) {
+	var b bytes.Buffer
+	newJsonLogger(&b, "warn", logTimeFormat(NewConfig())).Println("json", "logger.")
+
+	v := struct {
+		Time   string `json:"time"`
+		Level  string `json:"level"`
+		Msg    string `json:"msg"`
+		Worker string `json:"worker"`
+	}{}
+	if err := json.Unmarshal(b.Bytes(), &v); err != nil {
+		t.Fatal("invalid json line", b.String(), err)
+	}
+	if v.Level != "warn" || v.Msg != "json logger." || v.Worker != "main" || len(v.Time) == 0 {
+		t.Error("invalid json log", b.String())
+	}
+	if !strings.HasSuffix(b.String(), "}\n") || strings.Count(b.String(), "\n") != 1 {
+		t.Error("should write one line", b.String())
+	}
+
+	c := NewConfig()
+	c.Log.Format = "xml"
+	if err := c.Validate(); err == nil {
+		t.Error("config should be invalid for format", c.Log.Format)
+	}
+}
+
+func TestLogTimeFormat(t *testing.T) {
+	tm := time.Date(2015, 10, 10, 10, 10, 10, 0, time.FixedZone("cst", 8*3600))
+
+	c := NewConfig()
+	if v := logTimeFormat(c)(tm); v != "2015/10/10 10:10:10" {
+		t.Error("default format invalid, actual is", v)
+	}
+
+	c.Log.TimeFormat, c.Log.UTC = "rfc3339", true
+	if v := logTimeFormat(c)(tm); v != "2015-10-10T02:10:10Z" {
+		t.Error("rfc3339 utc format invalid, actual is", v)
+	}
+
+	c.Log.TimeFormat, c.Log.UTC = "unix", false
+	if v := logTimeFormat(c)(tm); v != "1444443010" {
+		t.Error("unix format invalid, actual is", v)
+	}
+
+	c.Log.TimeFormat = "2006-01-02"
+	if v := logTimeFormat(c)(tm); v != "2015-10-10" {
+		t.Error("layout format invalid, actual is", v)
+	}
+
+	var b bytes.Buffer
+	newTemplateLogger(&b, "trace", []string{"[", "{time}", "] "}, logTimeFormat(c)).Println("hello")
+	if v := b.String(); !strings.HasPrefix(v, "["+time.Now().Format("2006-01-02")+"] hello") {
+		t.Error("template time invalid, actual is", v)
+	}
+}
+
+func TestLogThrottle(t *testing.T) {
+	now := time.Now()
+	lt := &logThrottle{max: 3, now: func() time.Time {
+		return now
+	}}
+
+	var b bytes.Buffer
+	l := log.New(&throttleWriter{w: &b, t: lt, summary: log.New(&b, core.LogWarnLabel, 0)}, core.LogTraceLabel, 0)
+	for i := 0; i < 10; i++ {
+		l.Println("flood", i)
+	}
+	if v := b.String(); strings.Count(v, "flood") != 3 {
+		t.Error("should write 3 lines, actual is", v)
+	}
+
+	// the dropped lines summary in next second.
+	b.Reset()
+	now = now.Add(time.Second)
+	l.Println("flood", 10)
+	if v := b.String(); !strings.Contains(v, "dropped 7 lines") || !strings.HasSuffix(v, "flood 10\n") {
+		t.Error("should summary dropped lines, actual is", v)
+	}
+}
+
+func TestLogThrottleFlush(t *testing.T) {
+	now := time.Now()
+	lt := &logThrottle{max: 3, interval: 30 * time.Millisecond, now: func() time.Time {
+		return now
+	}}
+
+	var b bytes.Buffer
+	var lock sync.Mutex
+	w := &lockedWriter{w: &b, lock: &lock}
+	l := log.New(&throttleWriter{w: w, t: lt, summary: log.New(w, core.LogWarnLabel, 0)}, core.LogTraceLabel, 0)
+	for i := 0; i < 10; i++ {
+		l.Println("flood", i)
+	}
+
+	// the summary is flushed without any more lines.
+	for i := 0; i < 100 && !strings.Contains(readLocked(&b, &lock), "dropped"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := readLocked(&b, &lock); !strings.HasSuffix(v, "dropped 7 lines\n") || strings.Count(v, "flood") != 3 {
+		t.Error("should flush the summary after interval, actual is", v)
+	}
+
+	// the summary is never logged twice.
+	now = now.Add(time.Second)
+	l.Println("flood", 10)
+	if v := readLocked(&b, &lock); strings.Count(v, "dropped") != 1 {
+		t.Error("should summary once, actual is", v)
+	}
+}
+
+func TestLogThrottleJson(t *testing.T) {
+	now := time.Now()
+	l := &simpleLogger{throttle: &logThrottle{max: 3, now: func() time.Time {
+		return now
+	}}}
+
+	c := NewConfig()
+	c.Log.Level, c.Log.Format = "trace", "json"
+
+	var b bytes.Buffer
+	v := l.logger(c, "trace", &b, core.LogTraceLabel, nil)
+	for i := 0; i < 10; i++ {
+		v.Println("flood", i)
+	}
+	now = now.Add(time.Second)
+	v.Println("flood", 10)
+
+	// each line is json, the summary is a warn line.
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatal("should write 5 lines, actual is", lines)
+	}
+	var r struct {
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}
+	if err := json.Unmarshal([]byte(lines[3]), &r); err != nil {
+		t.Error("summary should be json, err is", err, lines[3])
+	} else if r.Level != "warn" || r.Msg != "log throttled, dropped 7 lines" {
+		t.Error("invalid summary", lines[3])
+	}
+}
+
+func TestLogCoalesce(t *testing.T) {
+	var b bytes.Buffer
+	var lock sync.Mutex
+	l := &coalesceLogger{l: log.New(&lockedWriter{w: &b, lock: &lock}, core.LogTraceLabel, 0), interval: 30 * time.Millisecond}
+	for i := 0; i < 5; i++ {
+		l.Println("flood")
+	}
+	if v := readLocked(&b, &lock); strings.Count(v, "flood") != 1 {
+		t.Error("should write 1 line, actual is", v)
+	}
+
+	// the repeats flushed when a different line arrives.
+	l.Println("other")
+	if v := readLocked(&b, &lock); !strings.Contains(v, "last message repeated 4 times\n") || !strings.HasSuffix(v, "other\n") {
+		t.Error("should flush repeats before different line, actual is", v)
+	}
+
+	// the repeats flushed after the interval.
+	lock.Lock()
+	b.Reset()
+	lock.Unlock()
+	l.Println("other")
+	l.Println("other")
+	time.Sleep(100 * time.Millisecond)
+	if v := readLocked(&b, &lock); v != core.LogTraceLabel+"last message repeated 2 times\n" {
+		t.Error("should flush repeats after interval, actual is", v)
+	}
+
+	// the same line of different workers is not coalesced.
+	lock.Lock()
+	b.Reset()
+	lock.Unlock()
+	l.WorkerPrintln("w0", "other")
+	if v := readLocked(&b, &lock); !strings.Contains(v, "[w0] other") {
+		t.Error("should not coalesce line of different worker, actual is", v)
+	}
+}
+
+type lockedWriter struct {
+	w    io.Writer
+	lock *sync.Mutex
+}
+
+func (v *lockedWriter) Write(p []byte) (int, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.w.Write(p)
+}
+
+func readLocked(b *bytes.Buffer, lock *sync.Mutex) string {
+	lock.Lock()
+	defer lock.Unlock()
+	return b.String()
+}
+
+func TestLogAsync(t *testing.T) {
+	defer restoreGlobals()()
+
+	dir := t.TempDir()
+	c := NewConfig()
+	c.Log.File = path.Join(dir, "oryx.log")
+	c.Log.Async = true
+
+	l := &simpleLogger{}
+	if err := l.open(c); err != nil {
+		t.Fatal("open logger failed, err is", err)
+	}
+
+	s := NewServer()
+	defer s.Close()
+	s.GFork("log", l.asyncCycle)
+	for i := 0; i < 100 && atomic.LoadInt32(&l.async.running) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 100; i++ {
+		core.Trace.Println("async", i)
+	}
+
+	// the buffered lines are written when close.
+	if err := l.close(c); err != nil {
+		t.Error("close logger failed, err is", err)
+	}
+	if b, err := ioutil.ReadFile(c.Log.File); err != nil {
+		t.Error("read log failed, err is", err)
+	} else if v := string(b); strings.Count(v, "async") != 100 || !strings.Contains(v, "async 99\n") {
+		t.Error("should write all lines, actual is", v)
+	}
+}
+
+func TestLogAsyncDrop(t *testing.T) {
+	defer restoreGlobals()()
+
+	var b bytes.Buffer
+	a := &asyncLog{records: make(chan *logRecord, 2), running: 1, drop: 1}
+	core.Warn = log.New(&b, core.LogWarnLabel, 0)
+
+	w := &asyncWriter{a: a, w: &b}
+	for i := 0; i < 5; i++ {
+		fmt.Fprintln(w, "flood", i)
+	}
+	if b.Len() != 0 {
+		t.Error("should buffer the lines, actual is", b.String())
+	}
+
+	// write the pending lines in sync when log worker quit.
+	a.running = 0
+	a.drain()
+	if v := b.String(); v != "flood 0\nflood 1\n"+core.LogWarnLabel+"async log dropped 3 lines for buffer full\n" {
+		t.Error("should drop 3 lines, actual is", v)
+	}
+}
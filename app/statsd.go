@@ -0,0 +1,86 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"fmt"
+	"github.com/ossrs/go-oryx/core"
+	"net"
+	"strings"
+	"time"
+)
+
+// push the metrics to statsd every statsd.interval_ms,
+// for the statsd maybe down, never quit when push failed.
+func (s *Server) statsdCycle(w WorkerContainer) {
+	ctx := w.Context()
+	for {
+		c := s.config()
+
+		select {
+		case <-w.QC():
+			w.Quit()
+			return
+		case <-time.After(time.Duration(c.Statsd.IntervalMs) * time.Millisecond):
+		}
+
+		if len(c.Statsd.Addr) == 0 {
+			continue
+		}
+
+		if err := s.statsdReport(c); err != nil {
+			core.Ctx(ctx, core.Info).Println("statsd push to", c.Statsd.Addr, "failed, err is", err)
+		}
+	}
+}
+
+// push the metrics to statsd in a udp packet.
+func (s *Server) statsdReport(c *Config) (err error) {
+	var conn net.Conn
+	if conn, err = net.DialTimeout("udp", c.Statsd.Addr, time.Second); err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(strings.Join(s.statsdMetrics(c.Statsd.Prefix), "\n")))
+	return
+}
+
+// the metrics in statsd gauge format, for example, oryx.workers:3|g
+func (s *Server) statsdMetrics(prefix string) []string {
+	s.workersLock.Lock()
+	workers, panics := len(s.workers), s.panics
+	s.workersLock.Unlock()
+
+	name := func(v string) string {
+		if len(prefix) == 0 {
+			return v
+		}
+		return prefix + "." + v
+	}
+
+	return []string{
+		fmt.Sprintf("%v:%v|g", name("workers"), workers),
+		fmt.Sprintf("%v:%v|g", name("panics"), panics),
+		fmt.Sprintf("%v:%v|g", name("heartbeat.failures"), s.htbt.Failures()),
+	}
+}
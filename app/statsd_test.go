@@ -0,0 +1,87 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdReport(t *testing.T) {
+	defer restoreGlobals()()
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen failed, err is", err)
+	}
+	defer l.Close()
+
+	SetConfig(NewConfig())
+	GetConfig().Statsd.Addr = l.LocalAddr().String()
+	GetConfig().Statsd.Prefix = "test"
+	GetConfig().Statsd.IntervalMs = 10
+
+	svr := NewServer()
+	defer svr.Close()
+
+	svr.GFork("statsd", svr.statsdCycle)
+	defer func() {
+		svr.Quit()
+		svr.waitWorkers()
+	}()
+
+	b := make([]byte, 1500)
+	l.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := l.ReadFrom(b)
+	if err != nil {
+		t.Fatal("read metrics failed, err is", err)
+	}
+
+	v := string(b[:n])
+	for _, m := range []string{"test.workers:1|g", "test.panics:0|g", "test.heartbeat.failures:0|g"} {
+		if !strings.Contains(v, m) {
+			t.Error("should push", m, "actual is", v)
+		}
+	}
+}
+
+func TestStatsdFailSoft(t *testing.T) {
+	defer restoreGlobals()()
+
+	SetConfig(NewConfig())
+	GetConfig().Statsd.Addr = "127.0.0.1:not-a-port"
+	GetConfig().Statsd.IntervalMs = 10
+
+	svr := NewServer()
+	defer svr.Close()
+
+	svr.GFork("statsd", svr.statsdCycle)
+	time.Sleep(50 * time.Millisecond)
+	if v := svr.runningWorkers(); len(v) != 1 || v[0] != "statsd" {
+		t.Error("statsd should not quit when push failed, actual is", v)
+	}
+
+	svr.Quit()
+	svr.waitWorkers()
+}
@@ -0,0 +1,100 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// +build darwin dragonfly freebsd nacl netbsd openbsd solaris linux
+
+// Unix syslog tank.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+)
+
+// the syslog facilities.
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// the syslog server to dial, empty to use the local syslog.
+var syslogNetwork, syslogAddr string
+
+// connect to syslog with the facility and tag.
+func openSyslog(c *Config) (v syslogTank, err error) {
+	facility, ok := syslogFacilities[c.Log.Syslog.Facility]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("log.syslog.facility %v is invalid", c.Log.Syslog.Facility))
+	}
+
+	var w *syslog.Writer
+	if w, err = syslog.Dial(syslogNetwork, syslogAddr, facility|syslog.LOG_INFO, c.Log.Syslog.Tag); err != nil {
+		return
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+// the syslog tank over the syslog writer.
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+// interface io.Closer
+func (v *syslogWriter) Close() error {
+	return v.w.Close()
+}
+
+// interface syslogTank
+// the level info is debug, trace is info, warn is warning and error is err of syslog.
+func (v *syslogWriter) Level(level string) io.Writer {
+	f := v.w.Info
+	switch level {
+	case "info":
+		f = v.w.Debug
+	case "warn":
+		f = v.w.Warning
+	case "error":
+		f = v.w.Err
+	}
+
+	return &syslogLevelWriter{f: f}
+}
+
+// the writer for a level of syslog.
+type syslogLevelWriter struct {
+	f func(m string) error
+}
+
+// interface io.Writer
+func (v *syslogLevelWriter) Write(p []byte) (n int, err error) {
+	if err = v.f(string(p)); err != nil {
+		return
+	}
+	return len(p), nil
+}
@@ -0,0 +1,133 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// +build darwin dragonfly freebsd nacl netbsd openbsd solaris linux
+
+package app
+
+import (
+	"github.com/ossrs/go-oryx/core"
+	"net"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSyslog(t *testing.T) {
+	defer restoreGlobals()()
+
+	addr := path.Join(t.TempDir(), "syslog.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal("listen failed, err is", err)
+	}
+	defer conn.Close()
+
+	pn, pa := syslogNetwork, syslogAddr
+	defer func() {
+		syslogNetwork, syslogAddr = pn, pa
+	}()
+	syslogNetwork, syslogAddr = "unixgram", addr
+
+	c := NewConfig()
+	c.Log.Tank = "syslog"
+	c.Log.Syslog.Facility = "local0"
+
+	l := &simpleLogger{}
+	if err := l.open(c); err != nil {
+		t.Fatal("open logger failed, err is", err)
+	}
+	core.Warn.Println("warn message.")
+
+	b := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := conn.Read(b); err != nil {
+		t.Error("read syslog failed, err is", err)
+	} else if v := string(b[:n]); !strings.HasPrefix(v, "<132>") || !strings.Contains(v, "oryx[") || !strings.Contains(v, "warn message.") {
+		t.Error("invalid syslog message", v)
+	}
+
+	if err := l.close(c); err != nil {
+		t.Error("close logger failed, err is", err)
+	}
+	if l.syslog != nil {
+		t.Error("syslog should be closed")
+	}
+
+	// the invalid facility.
+	c.Log.Syslog.Facility = "unknown"
+	if err := l.check(c); err == nil {
+		t.Error("should fail for invalid facility")
+	}
+}
+
+func TestLogErrorTankSyslog(t *testing.T) {
+	defer restoreGlobals()()
+
+	addr := path.Join(t.TempDir(), "syslog.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal("listen failed, err is", err)
+	}
+	defer conn.Close()
+
+	pn, pa := syslogNetwork, syslogAddr
+	defer func() {
+		syslogNetwork, syslogAddr = pn, pa
+	}()
+	syslogNetwork, syslogAddr = "unixgram", addr
+
+	c := NewConfig()
+	c.Log.Tank = "console"
+	c.Log.ErrorTank = "syslog"
+	c.Log.Syslog.Facility = "local0"
+	if err := c.Validate(); err != nil {
+		t.Fatal("error tank syslog should be valid, err is", err)
+	}
+
+	l := &simpleLogger{}
+	if err := l.check(c); err != nil {
+		t.Fatal("check logger failed, err is", err)
+	}
+	if err := l.open(c); err != nil {
+		t.Fatal("open logger failed, err is", err)
+	}
+
+	// only the error level is written to syslog, in the err priority.
+	core.Warn.Println("warn message.")
+	core.Error.Println("error message.")
+
+	b := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := conn.Read(b); err != nil {
+		t.Error("read syslog failed, err is", err)
+	} else if v := string(b[:n]); !strings.HasPrefix(v, "<131>") || !strings.Contains(v, "error message.") {
+		t.Error("invalid syslog message", v)
+	}
+
+	if err := l.close(c); err != nil {
+		t.Error("close logger failed, err is", err)
+	}
+	if l.syslog != nil {
+		t.Error("syslog should be closed")
+	}
+}
@@ -0,0 +1,147 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ossrs/go-oryx/core"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// the env to mark the process is started by upgrade,
+// the value is the fd of pipe to notify the parent when ready.
+const upgradeEnv = "GO_ORYX_UPGRADE_FD"
+
+// the timeout for the upgraded process to be ready.
+var upgradeTimeout = 30 * time.Second
+
+// the command to start the upgraded process, default to the current binary and args.
+// @remark the binary is read again, so it can be replaced by the new build.
+var upgradeCommand = func() *exec.Cmd {
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd
+}
+
+// whether the process is started by upgrade.
+func Upgrading() bool {
+	return len(os.Getenv(upgradeEnv)) > 0
+}
+
+// start the upgraded process and wait for it ready, then quit,
+// the process keeps serving when the upgraded one failed.
+// the files are the listeners inherited by the upgraded process in order,
+// for the first extra file is the ready pipe.
+func (s *Server) upgrade(wc WorkerContainer, files ...*os.File) (err error) {
+	var r, w *os.File
+	if r, w, err = os.Pipe(); err != nil {
+		return
+	}
+	defer r.Close()
+
+	cmd := upgradeCommand()
+	cmd.ExtraFiles = append([]*os.File{w}, files...)
+	// the extra files start from fd 3.
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%v=%v", upgradeEnv, 3))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return
+	}
+	core.Trace.Println("upgrade start process", cmd.Process.Pid, "wait for ready")
+
+	// the read returns when ready written, or the child quit.
+	ready := make(chan error, 1)
+	go func() {
+		b, err := ioutil.ReadAll(r)
+		if err == nil && len(b) == 0 {
+			err = errors.New("quit before ready")
+		}
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = errors.New(fmt.Sprintf("not ready in %v", upgradeTimeout))
+	case <-wc.QC():
+		wc.Quit()
+		err = errors.New("server quit")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return errors.New(fmt.Sprintf("upgrade process %v failed, err is %v", cmd.Process.Pid, err))
+	}
+
+	// release the process, which is reparented when we quit.
+	go cmd.Wait()
+	s.quitFor(fmt.Sprintf("upgrade to process %v", cmd.Process.Pid))
+	return
+}
+
+// start the upgrade in worker, ignore when upgrading.
+func (s *Server) startUpgrade() {
+	select {
+	case s.upgrading <- true:
+	default:
+		core.Warn.Println("upgrade ignored, the previous one is in progress")
+		return
+	}
+
+	s.GFork("upgrade", func(wc WorkerContainer) {
+		defer func() {
+			<-s.upgrading
+		}()
+
+		if err := s.upgrade(wc); err != nil {
+			core.Error.Println("upgrade failed, keep serving. err is", err)
+		}
+	})
+}
+
+// notify the parent ready when started by upgrade.
+func (s *Server) upgradeReady() {
+	if !Upgrading() {
+		return
+	}
+
+	fd, err := strconv.Atoi(os.Getenv(upgradeEnv))
+	if err != nil {
+		core.Warn.Println("upgrade invalid ready fd", os.Getenv(upgradeEnv))
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "upgrade")
+	defer f.Close()
+
+	if _, err := f.Write([]byte("ready")); err != nil {
+		core.Warn.Println("upgrade notify parent", os.Getppid(), "failed, err is", err)
+		return
+	}
+	core.Trace.Println("upgrade notify parent", os.Getppid(), "ready")
+}
@@ -0,0 +1,106 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// +build darwin dragonfly freebsd nacl netbsd openbsd solaris linux
+
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mockUpgradeCommand(script string) func() {
+	pc := upgradeCommand
+	upgradeCommand = func() *exec.Cmd {
+		return exec.Command("sh", "-c", script)
+	}
+	return func() {
+		upgradeCommand = pc
+	}
+}
+
+func TestUpgradeReady(t *testing.T) {
+	defer mockUpgradeCommand(`[ "$GO_ORYX_UPGRADE_FD" = 3 ] && printf ready >&3`)()
+
+	svr := NewServer()
+	defer svr.Close()
+
+	if err := svr.upgrade(svr); err != nil {
+		t.Fatal("upgrade failed, err is", err)
+	}
+	if v := svr.quitReason(); !strings.HasPrefix(v, "upgrade to process ") {
+		t.Error("should quit for upgrade, actual is", v)
+	}
+}
+
+func TestUpgradeFailed(t *testing.T) {
+	pt := upgradeTimeout
+	defer func() {
+		upgradeTimeout = pt
+	}()
+	upgradeTimeout = 50 * time.Millisecond
+
+	svr := NewServer()
+	defer svr.Close()
+
+	func() {
+		defer mockUpgradeCommand(`exit 0`)()
+		if err := svr.upgrade(svr); err == nil || !strings.Contains(err.Error(), "quit before ready") {
+			t.Error("should fail when quit before ready, actual is", err)
+		}
+	}()
+
+	func() {
+		defer mockUpgradeCommand(`sleep 3`)()
+		if err := svr.upgrade(svr); err == nil || !strings.Contains(err.Error(), "not ready in") {
+			t.Error("should fail when not ready, actual is", err)
+		}
+	}()
+
+	select {
+	case <-svr.QC():
+		t.Error("should keep serving when upgrade failed")
+	default:
+	}
+}
+
+func TestUpgradePidFile(t *testing.T) {
+	f := path.Join(t.TempDir(), "oryx.pid")
+
+	// the pid file is overwritten by the upgraded process.
+	if err := ioutil.WriteFile(f, []byte("1\n"), 0644); err != nil {
+		t.Fatal("write pid file failed, err is", err)
+	}
+	removePidFile(f)
+	if _, err := os.Stat(f); err != nil {
+		t.Error("should not remove the pid file of others, err is", err)
+	}
+
+	if err := writePidFile(f); err == nil {
+		t.Error("should fail when pid alive")
+	}
+}
@@ -0,0 +1,125 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/ossrs/go-oryx/core"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// the interval to poll the config file when watcher not available.
+var watchPollInterval = 3 * time.Second
+
+// create the watcher of file system notifications.
+var newWatcher = fsnotify.NewWatcher
+
+// the identity of config file to detect the change, the file maybe a symlink,
+// for example, the kubernetes configmap swaps the ..data symlink to update.
+type watchState struct {
+	// the resolved file of symlink, or the file itself.
+	target  string
+	modTime time.Time
+}
+
+// stat the config file, follow the symlinks.
+func statWatched(name string) (v watchState) {
+	if target, err := filepath.EvalSymlinks(name); err == nil {
+		v.target = target
+	}
+	if fi, err := os.Stat(name); err == nil {
+		v.modTime = fi.ModTime()
+	}
+	return
+}
+
+// watch the config file and reload when changed,
+// the events in debounce are merged, for editors write then rename the file.
+// the file is stat on any event of dir, for the symlink changed by the event of other file.
+// fall back to poll the modify time when watcher can not be established.
+// @remark the reload is in run loop and validated as the SIGHUP.
+func (s *Server) reloadCycle(wc WorkerContainer) {
+	ctx := wc.Context()
+	name := filepath.Clean(s.config().Info().Path)
+	debounce := time.Duration(s.config().Reloader.DebounceMs) * time.Millisecond
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	var poll <-chan time.Time
+
+	// watch the dir, for the watch of file is lost when renamed.
+	w, err := newWatcher()
+	if err == nil {
+		if err = w.Add(filepath.Dir(name)); err != nil {
+			w.Close()
+		}
+	}
+	if err != nil {
+		core.Ctx(ctx, core.Warn).Println("watch", name, "failed, poll every", watchPollInterval, "err is", err)
+		t := s.clock.NewTicker(watchPollInterval)
+		defer t.Stop()
+		poll = t.C()
+	} else {
+		core.Ctx(ctx, core.Trace).Println("watch", name, "to reload, debounce", debounce)
+		defer w.Close()
+		events, errs = w.Events, w.Errors
+	}
+
+	state := statWatched(name)
+	stated := func() bool {
+		v := statWatched(name)
+		if v.target == state.target && v.modTime.Equal(state.modTime) {
+			return false
+		}
+		state = v
+		return true
+	}
+
+	var changed <-chan time.Time
+	for {
+		select {
+		case <-wc.QC():
+			wc.Quit()
+			return
+		case e := <-events:
+			if filepath.Clean(e.Name) == name && e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				stated()
+				changed = s.clock.After(debounce)
+			} else if stated() {
+				changed = s.clock.After(debounce)
+			}
+		case err := <-errs:
+			core.Ctx(ctx, core.Warn).Println("watch", name, "failed, err is", err)
+		case <-poll:
+			if stated() {
+				changed = s.clock.After(debounce)
+			}
+		case <-changed:
+			changed = nil
+			core.Ctx(ctx, core.Trace).Println("config", name, "changed, reload")
+			s.pendSignal(syscall.SIGHUP)
+		}
+	}
+}
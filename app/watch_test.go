@@ -0,0 +1,164 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package app
+
+import (
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"github.com/ossrs/go-oryx/core"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloadWatchPoll(t *testing.T) {
+	defer restoreGlobals()()
+
+	pw, pi := newWatcher, watchPollInterval
+	defer func() {
+		newWatcher, watchPollInterval = pw, pi
+	}()
+	newWatcher = func() (*fsnotify.Watcher, error) {
+		return nil, errors.New("not supported")
+	}
+	watchPollInterval = 10 * time.Millisecond
+
+	f := writeTestConfig(t, `{"reload": {"watch": true, "debounce_ms": 30}}`)
+	SetConfig(NewConfig())
+	if err := GetConfig().Loads(f); err != nil {
+		t.Fatal("loads failed, err is", err)
+	}
+
+	// quit and wait for the reload worker before restore the globals,
+	// for close without wait the workers in init state.
+	svr := NewServer()
+	defer func() {
+		svr.Quit()
+		svr.waitWorkers()
+		svr.Close()
+	}()
+	svr.GFork("reload", svr.reloadCycle)
+
+	// the changes in debounce are merged to one reload.
+	for i := 0; i < 3; i++ {
+		mtime := time.Now().Add(time.Duration(i+1) * time.Second)
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal("touch config failed, err is", err)
+		}
+		time.Sleep(15 * time.Millisecond)
+	}
+
+	select {
+	case <-svr.signaled:
+	case <-time.After(3 * time.Second):
+		t.Fatal("should reload when config changed")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if v := svr.takeSignals(); len(v) != 1 || v[0] != syscall.SIGHUP {
+		t.Error("should reload once, actual is", v)
+	}
+}
+
+func TestReloadWatchSymlink(t *testing.T) {
+	defer restoreGlobals()()
+
+	pw := newWatcher
+	defer func() {
+		newWatcher = pw
+	}()
+	newWatcher = func() (*fsnotify.Watcher, error) {
+		return nil, errors.New("not supported")
+	}
+
+	// the configmap of kubernetes, oryx.json => ..data/oryx.json, ..data => ..v1
+	dir := t.TempDir()
+	mtime := time.Now().Add(-time.Hour)
+	version := func(v string) {
+		if err := os.Mkdir(path.Join(dir, v), 0755); err != nil {
+			t.Fatal("mkdir failed, err is", err)
+		}
+		f := path.Join(dir, v, "oryx.json")
+		if err := ioutil.WriteFile(f, []byte(`{"reload": {"watch": true, "debounce_ms": 30}}`), 0644); err != nil {
+			t.Fatal("write config failed, err is", err)
+		}
+		// the same modify time, the swap is detected by the symlink target.
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal("touch config failed, err is", err)
+		}
+	}
+	version("..v1")
+	if err := os.Symlink("..v1", path.Join(dir, "..data")); err != nil {
+		t.Fatal("symlink failed, err is", err)
+	}
+	f := path.Join(dir, "oryx.json")
+	if err := os.Symlink(path.Join("..data", "oryx.json"), f); err != nil {
+		t.Fatal("symlink failed, err is", err)
+	}
+
+	SetConfig(NewConfig())
+	if err := GetConfig().Loads(f); err != nil {
+		t.Fatal("loads failed, err is", err)
+	}
+
+	svr := NewServer()
+	defer func() {
+		svr.Quit()
+		svr.waitWorkers()
+		svr.Close()
+	}()
+	clock := core.NewFakeClock(time.Now())
+	svr.clock = clock
+	svr.GFork("reload", svr.reloadCycle)
+
+	// wait for the poll ticker.
+	for i := 0; i < 100 && clock.Timers() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	// swap the ..data to ..v2 atomically, as kubernetes.
+	version("..v2")
+	if err := os.Symlink("..v2", path.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal("symlink failed, err is", err)
+	}
+	if err := os.Rename(path.Join(dir, "..data_tmp"), path.Join(dir, "..data")); err != nil {
+		t.Fatal("swap failed, err is", err)
+	}
+
+	// poll then debounce, by the clock of server.
+	clock.Advance(watchPollInterval)
+	for i := 0; i < 100 && clock.Timers() < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(30 * time.Millisecond)
+
+	select {
+	case <-svr.signaled:
+	case <-time.After(3 * time.Second):
+		t.Fatal("should reload when symlink swapped")
+	}
+	if v := svr.takeSignals(); len(v) != 1 || v[0] != syscall.SIGHUP {
+		t.Error("should reload once, actual is", v)
+	}
+}
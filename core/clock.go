@@ -0,0 +1,184 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// the clock to get the time and timers,
+// use the FakeClock to test the timers without real sleep.
+type Clock interface {
+	// the current time, as time.Now.
+	Now() time.Time
+	// the channel got the time after d, as time.After.
+	After(d time.Duration) <-chan time.Time
+	// the ticker every d, as time.NewTicker.
+	NewTicker(d time.Duration) Ticker
+}
+
+// the ticker of clock.
+type Ticker interface {
+	// the channel got the time every tick.
+	C() <-chan time.Time
+	// stop the ticker, the channel is not closed.
+	Stop()
+}
+
+// the real clock by package time.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (v realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (v realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (v realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (v *realTicker) C() <-chan time.Time {
+	return v.Ticker.C
+}
+
+// the fake clock for test, the time only advances by Advance,
+// which fires the timers and tickers due.
+type FakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	lock   sync.Mutex
+}
+
+// the timer or ticker of fake clock, the period is 0 for timer.
+type fakeTimer struct {
+	c       chan time.Time
+	when    time.Time
+	period  time.Duration
+	stopped bool
+	clock   *FakeClock
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// interface Clock
+func (v *FakeClock) Now() time.Time {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.now
+}
+
+// interface Clock
+func (v *FakeClock) After(d time.Duration) <-chan time.Time {
+	return v.add(d, 0).c
+}
+
+// interface Clock
+func (v *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return v.add(d, d)
+}
+
+func (v *FakeClock) add(d, period time.Duration) *fakeTimer {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	t := &fakeTimer{c: make(chan time.Time, 1), when: v.now.Add(d), period: period, clock: v}
+	if d <= 0 {
+		t.c <- v.now
+		return t
+	}
+
+	v.timers = append(v.timers, t)
+	return t
+}
+
+// the pending timers and tickers, for test to wait for the worker to wait on the clock.
+func (v *FakeClock) Timers() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return len(v.timers)
+}
+
+// advance the time by d, fire the timers due,
+// the ticker drops the ticks when channel is full, as time.Ticker.
+func (v *FakeClock) Advance(d time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.now = v.now.Add(d)
+
+	timers := v.timers[:0]
+	for _, t := range v.timers {
+		for !t.stopped && !t.when.After(v.now) {
+			select {
+			case t.c <- t.when:
+			default:
+			}
+
+			if t.period <= 0 {
+				t.stopped = true
+			} else {
+				t.when = t.when.Add(t.period)
+			}
+		}
+
+		if !t.stopped {
+			timers = append(timers, t)
+		}
+	}
+	v.timers = timers
+}
+
+// interface Ticker
+func (v *fakeTimer) C() <-chan time.Time {
+	return v.c
+}
+
+// interface Ticker
+func (v *fakeTimer) Stop() {
+	v.clock.lock.Lock()
+	defer v.clock.lock.Unlock()
+
+	v.stopped = true
+	for i, t := range v.clock.timers {
+		if t == v {
+			v.clock.timers = append(v.clock.timers[:i], v.clock.timers[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFakeClock(start)
+
+	after := c.After(3 * time.Second)
+	ticker := c.NewTicker(time.Second)
+	if c.Timers() != 2 {
+		t.Error("should pending 2 timers, actual is", c.Timers())
+	}
+
+	c.Advance(time.Second)
+	select {
+	case <-after:
+		t.Error("should not fire before due")
+	default:
+	}
+	if v := <-ticker.C(); !v.Equal(start.Add(time.Second)) {
+		t.Error("invalid tick", v)
+	}
+
+	c.Advance(2 * time.Second)
+	if v := <-after; !v.Equal(start.Add(3 * time.Second)) {
+		t.Error("invalid after", v)
+	}
+	// the ticks are dropped when channel is full.
+	if v := <-ticker.C(); !v.Equal(start.Add(2 * time.Second)) {
+		t.Error("invalid tick", v)
+	}
+	if c.Timers() != 1 || !c.Now().Equal(start.Add(3*time.Second)) {
+		t.Error("invalid clock", c.Timers(), c.Now())
+	}
+
+	ticker.Stop()
+	c.Advance(time.Second)
+	select {
+	case <-ticker.C():
+		t.Error("should not tick after stop")
+	default:
+	}
+	if c.Timers() != 0 {
+		t.Error("should no timers, actual is", c.Timers())
+	}
+
+	select {
+	case <-c.After(0):
+	default:
+		t.Error("should fire immediately")
+	}
+}
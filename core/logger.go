@@ -22,9 +22,16 @@
 package core
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -35,20 +42,293 @@ const (
 	LogErrorLabel = logLabel + "[error] "
 )
 
+// the log levels, the higher is more important.
+const (
+	LogLevelInfo = iota
+	LogLevelTrace
+	LogLevelWarn
+	LogLevelError
+)
+
 // the application loggers
 // info, the verbose info level, very detail log, the lowest level, to discard.
-var Info Logger = log.New(ioutil.Discard, LogInfoLabel, log.LstdFlags)
+var Info Logger = LevelLogger(LogLevelInfo, log.New(ioutil.Discard, LogInfoLabel, log.LstdFlags))
 
 // trace, the trace level, something important, the default log level, to stdout.
-var Trace Logger = log.New(os.Stdout, LogTraceLabel, log.LstdFlags)
+var Trace Logger = LevelLogger(LogLevelTrace, log.New(os.Stdout, LogTraceLabel, log.LstdFlags))
 
 // warn, the warning level, dangerous information, to stderr.
-var Warn Logger = log.New(os.Stderr, LogWarnLabel, log.LstdFlags)
+var Warn Logger = LevelLogger(LogLevelWarn, log.New(os.Stderr, LogWarnLabel, log.LstdFlags))
 
 // error, the error level, fatal error things, ot stderr.
-var Error Logger = log.New(os.Stderr, LogErrorLabel, log.LstdFlags)
+var Error Logger = LevelLogger(LogLevelError, log.New(os.Stderr, LogErrorLabel, log.LstdFlags))
+
+// the output of all levels set by SetOutput, nil to use the default.
+var output io.Writer
+var outputLock sync.Mutex
+
+// set the loggers to write all levels to w, safe for goroutines to write,
+// for example, to capture the logs in test, the app logger also use it over the tanks.
+// nil to restore the default loggers.
+func SetOutput(w io.Writer) {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+
+	if w == nil {
+		output = nil
+		Info = LevelLogger(LogLevelInfo, log.New(ioutil.Discard, LogInfoLabel, log.LstdFlags))
+		Trace = LevelLogger(LogLevelTrace, log.New(os.Stdout, LogTraceLabel, log.LstdFlags))
+		Warn = LevelLogger(LogLevelWarn, log.New(os.Stderr, LogWarnLabel, log.LstdFlags))
+		Error = LevelLogger(LogLevelError, log.New(os.Stderr, LogErrorLabel, log.LstdFlags))
+		return
+	}
+
+	output = &syncWriter{w: w}
+	Info = LevelLogger(LogLevelInfo, log.New(output, LogInfoLabel, log.LstdFlags))
+	Trace = LevelLogger(LogLevelTrace, log.New(output, LogTraceLabel, log.LstdFlags))
+	Warn = LevelLogger(LogLevelWarn, log.New(output, LogWarnLabel, log.LstdFlags))
+	Error = LevelLogger(LogLevelError, log.New(output, LogErrorLabel, log.LstdFlags))
+}
+
+// the output set by SetOutput, nil when not set.
+func Output() io.Writer {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+
+	return output
+}
+
+// the writer to serialize the writes of goroutines.
+type syncWriter struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+func (v *syncWriter) Write(p []byte) (n int, err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.w.Write(p)
+}
+
+// the global log level, the level loggers below it are no-ops.
+var logLevel int32 = LogLevelTrace
+
+// parse the level name, info, trace, warn or error.
+func ParseLogLevel(level string) (v int, ok bool) {
+	switch level {
+	case "info":
+		return LogLevelInfo, true
+	case "trace":
+		return LogLevelTrace, true
+	case "warn":
+		return LogLevelWarn, true
+	case "error":
+		return LogLevelError, true
+	}
+	return
+}
+
+// set the global log level, for example, warn to ignore the info and trace.
+// ignore the unknown level.
+func SetLogLevel(level string) {
+	if v, ok := ParseLogLevel(level); ok {
+		atomic.StoreInt32(&logLevel, int32(v))
+	}
+}
+
+// whether the level is enabled, to skip the expensive arguments, for example,
+//      if core.LogEnabled(core.LogLevelInfo) {
+//          core.Info.Println("dump", dump(v))
+//      }
+func LogEnabled(level int) bool {
+	return int32(level) >= atomic.LoadInt32(&logLevel)
+}
+
+// the log level of modules, the module name to level.
+var moduleLevels atomic.Value
+
+// set the log level of modules, for example, {"htbt": "info"}
+// to log the info of heartbeat workers, the others use the global level.
+// ignore the unknown level.
+func SetModuleLogLevels(modules map[string]string) {
+	v := map[string]int{}
+	for k, level := range modules {
+		if lv, ok := ParseLogLevel(level); ok {
+			v[k] = lv
+		}
+	}
+	moduleLevels.Store(v)
+}
+
+// whether the level is enabled for the module, fall back to the global level.
+// the module is the worker name or its base name, for example, htbt for htbt(main).
+func ModuleLogEnabled(module string, level int) bool {
+	if v, ok := moduleLevels.Load().(map[string]int); ok && len(v) > 0 {
+		if lv, ok := v[module]; ok {
+			return level >= lv
+		}
+		if i := strings.Index(module, "("); i > 0 {
+			if lv, ok := v[module[:i]]; ok {
+				return level >= lv
+			}
+		}
+	}
+	return LogEnabled(level)
+}
+
+// the logger to log only when the level is enabled.
+func LevelLogger(level int, l Logger) Logger {
+	return &levelLogger{l: l, level: level}
+}
+
+type levelLogger struct {
+	l     Logger
+	level int
+}
+
+func (l *levelLogger) Println(a ...interface{}) {
+	if LogEnabled(l.level) {
+		l.l.Println(a...)
+	}
+}
+
+func (l *levelLogger) WorkerPrintln(worker string, a ...interface{}) {
+	if ModuleLogEnabled(worker, l.level) {
+		workerPrintln(l.l, worker, a...)
+	}
+}
 
 // the logger for gsrs.
 type Logger interface {
 	Println(a ...interface{})
 }
+
+// the logger which can log with the worker name,
+// for example, the logger to render the worker in template.
+type WorkerLogger interface {
+	WorkerPrintln(worker string, a ...interface{})
+}
+
+// the key of worker name in context.
+type workerKey struct{}
+
+// the context with the worker name, for the log in worker.
+func WithWorker(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, workerKey{}, name)
+}
+
+// the worker name in context, empty when not in worker.
+func WorkerName(ctx context.Context) string {
+	if v, ok := ctx.Value(workerKey{}).(string); ok {
+		return v
+	}
+	return ""
+}
+
+// the logger to log with the worker name of context,
+// for example, core.Ctx(ctx, core.Trace).Println("...")
+// the worker name is prefixed as [name] if logger not support worker.
+func Ctx(ctx context.Context, l Logger) Logger {
+	name := WorkerName(ctx)
+	if len(name) == 0 {
+		return l
+	}
+	return &ctxLogger{l: l, worker: name}
+}
+
+type ctxLogger struct {
+	l      Logger
+	worker string
+}
+
+func (l *ctxLogger) Println(a ...interface{}) {
+	workerPrintln(l.l, l.worker, a...)
+}
+
+// log with the worker, prefix the worker name if logger not support worker.
+func workerPrintln(l Logger, worker string, a ...interface{}) {
+	if v, ok := l.(WorkerLogger); ok {
+		v.WorkerPrintln(worker, a...)
+		return
+	}
+
+	l.Println(append([]interface{}{"[" + worker + "]"}, a...)...)
+}
+
+// the clock of rate-limited loggers, for test.
+var limitClock Clock = RealClock
+
+// the rate limits by key of loggers by Every.
+var limits = struct {
+	keys map[string]*logLimit
+	lock sync.Mutex
+}{keys: make(map[string]*logLimit)}
+
+// the max keys of limits, to remove the expired keys when exceed.
+const maxLogLimits = 1024
+
+// the last line and suppressed lines of a key.
+type logLimit struct {
+	last       time.Time
+	interval   time.Duration
+	suppressed int
+}
+
+// the logger to log at most one line per key in interval d,
+// the suppressed lines are counted and appended to the next line, for example,
+//      core.Every(core.Error, time.Minute, "heartbeat").Println("heartbeat failed")
+// to prevent the log storm of the same error in outage.
+func Every(l Logger, d time.Duration, key string) Logger {
+	return &limitLogger{l: l, interval: d, key: key}
+}
+
+type limitLogger struct {
+	l        Logger
+	interval time.Duration
+	key      string
+}
+
+func (l *limitLogger) Println(a ...interface{}) {
+	if a, ok := l.allow(a); ok {
+		l.l.Println(a...)
+	}
+}
+
+func (l *limitLogger) WorkerPrintln(worker string, a ...interface{}) {
+	if a, ok := l.allow(a); ok {
+		workerPrintln(l.l, worker, a...)
+	}
+}
+
+// whether the key is allowed to log now, append the suppressed count to args.
+func (l *limitLogger) allow(a []interface{}) ([]interface{}, bool) {
+	now := limitClock.Now()
+
+	limits.lock.Lock()
+	defer limits.lock.Unlock()
+
+	v, ok := limits.keys[l.key]
+	if ok && now.Sub(v.last) < l.interval {
+		v.suppressed++
+		return a, false
+	}
+
+	if !ok {
+		if len(limits.keys) >= maxLogLimits {
+			for k, e := range limits.keys {
+				if now.Sub(e.last) >= e.interval {
+					delete(limits.keys, k)
+				}
+			}
+		}
+		v = &logLimit{}
+		limits.keys[l.key] = v
+	}
+
+	if v.suppressed > 0 {
+		a = append(a, fmt.Sprintf("(suppressed %v lines in %v)", v.suppressed, now.Sub(v.last)))
+	}
+	v.last, v.interval, v.suppressed = now, l.interval, 0
+	return a, true
+}
@@ -22,9 +22,12 @@
 package core
 
 import (
+	"context"
 	"log"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // convert a func to interface io.Writer
@@ -79,3 +82,186 @@ func TestBasicLogger(t *testing.T) {
 		t.Error("logger format failed. tank is", tank)
 	}
 }
+
+type mockWorkerLogger struct {
+	worker string
+}
+
+func (l *mockWorkerLogger) Println(a ...interface{}) {
+	l.worker = ""
+}
+
+func (l *mockWorkerLogger) WorkerPrintln(worker string, a ...interface{}) {
+	l.worker = worker
+}
+
+func TestWorkerLogger(t *testing.T) {
+	var tank string
+	var writer = func(p []byte) (n int, err error) {
+		tank = string(p)
+		return len(tank), nil
+	}
+	l := log.New(WriterFunc(writer), LogTraceLabel, log.LstdFlags)
+
+	ctx := context.Background()
+	if Ctx(ctx, l) != l {
+		t.Error("should use the logger when not in worker")
+	}
+
+	ctx = WithWorker(ctx, "htbt(main)")
+	if v := WorkerName(ctx); v != "htbt(main)" {
+		t.Error("invalid worker name", v)
+	}
+
+	Ctx(ctx, l).Println("test logger.")
+	if !strings.HasPrefix(tank, "[oryx][trace]") || !strings.HasSuffix(tank, "[htbt(main)] test logger.\n") {
+		t.Error("should prefix worker name, tank is", tank)
+	}
+
+	wl := &mockWorkerLogger{}
+	Ctx(ctx, wl).Println("test logger.")
+	if wl.worker != "htbt(main)" {
+		t.Error("should log with worker, actual is", wl.worker)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	defer SetLogLevel("trace")
+
+	var tank string
+	var writer = func(p []byte) (n int, err error) {
+		tank += string(p)
+		return len(p), nil
+	}
+	info := LevelLogger(LogLevelInfo, log.New(WriterFunc(writer), LogInfoLabel, 0))
+	trace := LevelLogger(LogLevelTrace, log.New(WriterFunc(writer), LogTraceLabel, 0))
+	warn := LevelLogger(LogLevelWarn, log.New(WriterFunc(writer), LogWarnLabel, 0))
+
+	SetLogLevel("warn")
+	if LogEnabled(LogLevelInfo) || LogEnabled(LogLevelTrace) || !LogEnabled(LogLevelWarn) {
+		t.Error("only warn and error should be enabled")
+	}
+	info.Println("info")
+	trace.Println("trace")
+	Ctx(WithWorker(context.Background(), "w0"), trace).Println("trace")
+	warn.Println("warn")
+	if tank != LogWarnLabel+"warn\n" {
+		t.Error("should only log warn, tank is", tank)
+	}
+
+	// ignore the unknown level.
+	SetLogLevel("debug")
+	if LogEnabled(LogLevelTrace) {
+		t.Error("should ignore unknown level")
+	}
+
+	tank = ""
+	SetLogLevel("info")
+	Ctx(WithWorker(context.Background(), "w0"), info).Println("info")
+	if tank != LogInfoLabel+"[w0] info\n" {
+		t.Error("should log info with worker, tank is", tank)
+	}
+}
+
+func TestModuleLogLevel(t *testing.T) {
+	defer SetLogLevel("trace")
+	defer SetModuleLogLevels(nil)
+
+	var tank string
+	var writer = func(p []byte) (n int, err error) {
+		tank += string(p)
+		return len(p), nil
+	}
+	info := LevelLogger(LogLevelInfo, log.New(WriterFunc(writer), LogInfoLabel, 0))
+
+	SetLogLevel("warn")
+	SetModuleLogLevels(map[string]string{"htbt": "info", "api": "trace"})
+	for _, v := range []string{"htbt(main)", "htbt(discovery)", "api", "statsd"} {
+		Ctx(WithWorker(context.Background(), v), info).Println("info")
+	}
+	info.Println("info")
+	if tank != LogInfoLabel+"[htbt(main)] info\n"+LogInfoLabel+"[htbt(discovery)] info\n" {
+		t.Error("should only log info of htbt, tank is", tank)
+	}
+
+	if !ModuleLogEnabled("api", LogLevelTrace) || ModuleLogEnabled("statsd", LogLevelTrace) {
+		t.Error("statsd should fall back to global level")
+	}
+}
+
+func TestLogOutput(t *testing.T) {
+	pi, pt, pw, pe := Info, Trace, Warn, Error
+	defer func() {
+		SetOutput(nil)
+		Info, Trace, Warn, Error = pi, pt, pw, pe
+	}()
+
+	var b strings.Builder
+	SetOutput(&b)
+	if Output() == nil {
+		t.Error("should set the output")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Trace.Println("trace message.")
+			Warn.Println("warn message.")
+		}()
+	}
+	wg.Wait()
+
+	if v := b.String(); strings.Count(v, LogTraceLabel) != 10 || strings.Count(v, "warn message.\n") != 10 {
+		t.Error("should write all levels to output, actual is", v)
+	}
+
+	SetOutput(nil)
+	if Output() != nil {
+		t.Error("should restore the output")
+	}
+}
+
+func TestLogEvery(t *testing.T) {
+	// the limits of keys are global, start from empty for each run.
+	limits.lock.Lock()
+	pv, pk := limitClock, limits.keys
+	limits.keys = make(map[string]*logLimit)
+	limits.lock.Unlock()
+	defer func() {
+		limits.lock.Lock()
+		defer limits.lock.Unlock()
+		limitClock, limits.keys = pv, pk
+	}()
+	clock := NewFakeClock(time.Unix(1000, 0))
+	limitClock = clock
+
+	var b strings.Builder
+	l := log.New(&b, "", 0)
+
+	for i := 0; i < 5; i++ {
+		Every(l, time.Minute, "test.every").Println("heartbeat failed")
+	}
+	// the key is independent.
+	Every(l, time.Minute, "test.every2").Println("reload failed")
+	if v := b.String(); v != "heartbeat failed\nreload failed\n" {
+		t.Error("should log once per key, actual is", v)
+	}
+
+	b.Reset()
+	clock.Advance(time.Minute)
+	Every(l, time.Minute, "test.every").Println("heartbeat failed")
+	if v := b.String(); v != "heartbeat failed (suppressed 4 lines in 1m0s)\n" {
+		t.Error("should log the suppressed count, actual is", v)
+	}
+
+	// keep the worker of context.
+	b.Reset()
+	clock.Advance(time.Minute)
+	ctx := WithWorker(context.Background(), "htbt")
+	Ctx(ctx, Every(l, time.Minute, "test.every")).Println("heartbeat failed")
+	if v := b.String(); v != "[htbt] heartbeat failed\n" {
+		t.Error("should log with worker, actual is", v)
+	}
+}
@@ -20,3 +20,31 @@
 // CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 
 package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// validate the listen address, host:port, for example, 127.0.0.1:1985 or :1985,
+// the port must be a number in [0, 65535], the 0 is allowed for a random port,
+// for example, 127.0.0.1:0 to listen the api in test.
+func ValidateListen(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.New(fmt.Sprintf("address %v must be host:port, err is %v", addr, err))
+	}
+
+	if strings.ContainsAny(host, " \t/") {
+		return errors.New(fmt.Sprintf("address %v host %v is invalid", addr, host))
+	}
+
+	if v, err := strconv.Atoi(port); err != nil || v < 0 || v > 65535 {
+		return errors.New(fmt.Sprintf("address %v port must in [0, 65535], 0 for a random port, actual is %v", addr, port))
+	}
+
+	return nil
+}
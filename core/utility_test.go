@@ -0,0 +1,46 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateListen(t *testing.T) {
+	for _, v := range []string{"127.0.0.1:1985", ":1985", "localhost:65535", "[::1]:1985", "127.0.0.1:0"} {
+		if err := ValidateListen(v); err != nil {
+			t.Error("should valid", v, "err is", err)
+		}
+	}
+
+	for _, v := range []string{"1985", ":99999", ":-1", ":http", "", "127.0.0.1", "my host:1985"} {
+		if err := ValidateListen(v); err == nil {
+			t.Error("should invalid", v)
+		}
+	}
+
+	// the error shows the range which is checked.
+	if err := ValidateListen(":65536"); err == nil || !strings.Contains(err.Error(), "[0, 65535]") {
+		t.Error("invalid error", err)
+	}
+}
@@ -29,6 +29,17 @@ const (
 	reversion = 5
 )
 
+// the git commit of build, set by -ldflags "-X github.com/ossrs/go-oryx/core.GitCommit=xxx"
+var GitCommit = "unknown"
+
+// the date of build, set by -ldflags "-X github.com/ossrs/go-oryx/core.BuildDate=xxx"
+var BuildDate = "unknown"
+
 func Version() string {
 	return fmt.Sprintf("%v.%v.%v", major, minor, reversion)
 }
+
+// the version with git commit and build date, for example, 0.1.5/d6dba83/2015-09-01
+func FullVersion() string {
+	return fmt.Sprintf("%v/%v/%v", Version(), GitCommit, BuildDate)
+}
@@ -31,10 +31,12 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/ossrs/go-oryx/app"
 	"github.com/ossrs/go-oryx/core"
+	"io"
 	"os"
 )
 
@@ -43,7 +45,44 @@ import (
 //          --c conf/oryx.json
 //          -c=conf/oryx.json
 //          --c=conf/oryx.json
-var confFile = flag.String("c", "conf/oryx.json", "the config file.")
+//          -c - to read config from stdin
+var confFile = flag.String("c", "conf/oryx.json", "the config file, - for stdin.")
+
+// the argv to test the config and exit, like nginx -t:
+//          -t -c conf/oryx.json
+var testConf = flag.Bool("t", false, "test the config file and exit.")
+
+// the argv to initialize the server and exit, for smoke test:
+//          -once -c conf/oryx.json
+var once = flag.Bool("once", false, "initialize the server then exit.")
+
+// test the config file without starting the server,
+// print all problems of config, return 0 when ok.
+func check(conf string, w io.Writer) int {
+	c := app.NewConfig()
+
+	var err error
+	if conf == "-" {
+		err = c.LoadsFrom(os.Stdin)
+	} else {
+		err = c.Loads(conf)
+	}
+
+	if err == nil {
+		fmt.Fprintln(w, "the config file", conf, "test is successful")
+		return 0
+	}
+
+	fmt.Fprintln(w, "the config file", conf, "test failed:")
+	var errs app.ConfigErrors
+	if !errors.As(err, &errs) {
+		errs = app.ConfigErrors{err}
+	}
+	for _, err := range errs {
+		fmt.Fprintln(w, "    "+err.Error())
+	}
+	return -1
+}
 
 func serve(svr *app.Server) int {
 	if err := svr.PrepareLogger(); err != nil {
@@ -72,6 +111,10 @@ func serve(svr *app.Server) int {
 func main() {
 	flag.Parse()
 
+	if *testConf {
+		os.Exit(check(*confFile, os.Stderr))
+	}
+
 	svr := app.NewServer()
 	defer svr.Close()
 
@@ -80,6 +123,16 @@ func main() {
 		os.Exit(-1)
 	}
 
+	if *once {
+		if err := svr.SelfCheck(); err != nil {
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
+
 	ret := run(svr)
+
+	// the defer is not called by exit, close to cleanup, for example, the pid file.
+	svr.Close()
 	os.Exit(ret)
 }
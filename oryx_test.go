@@ -22,10 +22,45 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"path"
+	"strings"
 	"testing"
 )
 
 func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+
+	f := path.Join(dir, "oryx.json")
+	if err := ioutil.WriteFile(f, []byte(`{"workers": 1, "daemon": false}`), 0644); err != nil {
+		t.Fatal("write config failed, err is", err)
+	}
+	var b strings.Builder
+	if r := check(f, &b); r != 0 || !strings.Contains(b.String(), "successful") {
+		t.Error("config should be ok, actual is", r, b.String())
+	}
+
+	// all problems are reported.
+	if err := ioutil.WriteFile(f, []byte(`{"workers": -1, "listen": 0, "log": {"level": "verbose"}}`), 0644); err != nil {
+		t.Fatal("write config failed, err is", err)
+	}
+	b.Reset()
+	if r := check(f, &b); r == 0 {
+		t.Error("config should fail")
+	}
+	for _, field := range []string{"workers", "listen", "log.level"} {
+		if !strings.Contains(b.String(), "    "+field+" must") {
+			t.Error("should report", field, "actual is", b.String())
+		}
+	}
+
+	b.Reset()
+	if r := check(path.Join(dir, "not-found.json"), &b); r == 0 || !strings.Contains(b.String(), "test failed") {
+		t.Error("should fail for not found, actual is", r, b.String())
+	}
+}
@@ -24,17 +24,28 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/ossrs/go-daemon"
 	"github.com/ossrs/go-oryx/app"
 	"github.com/ossrs/go-oryx/core"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// the timeout for parent to wait for the daemon child to write pid file.
+const daemonTimeout = 10 * time.Second
+
 func run(svr *app.Server) int {
 	d := new(daemon.Context)
 	var c *os.Process
-	if app.Conf.Daemon {
-		core.Trace.Println("run in daemon mode, log file", app.Conf.Log.File)
+	conf := svr.Config()
+	// the upgraded process is already daemon, started by the daemon parent.
+	if conf.Daemon && !app.Upgrading() {
+		core.Trace.Println("run in daemon mode, log file", conf.Log.File)
 		if child, err := d.Reborn(); err != nil {
 			core.Error.Println("daemon failed. err is", err)
 			return -1
@@ -44,13 +55,49 @@ func run(svr *app.Server) int {
 	}
 	defer d.Release()
 
+	// the parent exit after the child written the pid file,
+	// so the caller, for example, the init script can read the pid.
 	if c != nil {
+		if err := waitDaemon(c, conf.PidFile, daemonTimeout); err != nil {
+			core.Error.Println("daemon failed. err is", err)
+			os.Exit(-1)
+		}
 		os.Exit(0)
 	}
 
 	return serve(svr)
 }
 
+// wait for the daemon child to write its pid to the pid file,
+// ok when no pid file, fail when child quit or timeout.
+func waitDaemon(c *os.Process, pidFile string, timeout time.Duration) error {
+	if len(pidFile) == 0 {
+		return nil
+	}
+
+	exited := make(chan bool, 1)
+	go func() {
+		c.Wait()
+		exited <- true
+	}()
+
+	deadline := time.After(timeout)
+	for {
+		if b, err := ioutil.ReadFile(pidFile); err == nil && strings.TrimSpace(string(b)) == strconv.Itoa(c.Pid) {
+			core.Trace.Println("daemon child", c.Pid, "write pid file", pidFile, "ok")
+			return nil
+		}
+
+		select {
+		case <-exited:
+			return errors.New(fmt.Sprintf("daemon child %v quit before write pid file %v", c.Pid, pidFile))
+		case <-deadline:
+			return errors.New(fmt.Sprintf("daemon child %v not write pid file %v in %v", c.Pid, pidFile, timeout))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
 func oryxMain(svr *app.Server) {
 	core.Trace.Println("Oryx start serve, pid is", os.Getpid(), "and ppid is", os.Getppid())
 }
@@ -0,0 +1,71 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013-2015 Oryx(ossrs)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// +build darwin dragonfly freebsd nacl netbsd openbsd solaris linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestWaitDaemon(t *testing.T) {
+	f := path.Join(t.TempDir(), "oryx.pid")
+
+	cmd := exec.Command("sleep", "3")
+	if err := cmd.Start(); err != nil {
+		t.Skip("start child failed, err is", err)
+	}
+	defer cmd.Process.Kill()
+
+	if err := waitDaemon(cmd.Process, f, 50*time.Millisecond); err == nil {
+		t.Error("should timeout when pid file not written")
+	}
+
+	time.AfterFunc(30*time.Millisecond, func() {
+		ioutil.WriteFile(f, []byte(fmt.Sprintf("%v\n", cmd.Process.Pid)), 0644)
+	})
+	if err := waitDaemon(cmd.Process, f, 3*time.Second); err != nil {
+		t.Error("wait daemon failed, err is", err)
+	}
+
+	if err := waitDaemon(cmd.Process, "", 0); err != nil {
+		t.Error("should ok without pid file, err is", err)
+	}
+}
+
+func TestWaitDaemonQuit(t *testing.T) {
+	f := path.Join(t.TempDir(), "oryx.pid")
+
+	cmd := exec.Command("true")
+	if err := cmd.Start(); err != nil {
+		t.Skip("start child failed, err is", err)
+	}
+
+	if err := waitDaemon(cmd.Process, f, 3*time.Second); err == nil {
+		t.Error("should fail when child quit")
+	}
+}